@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// Number of KV keys read at once by the admin listings
+	adminKVPageSize = 200
+	// Number of users read at once when listing users without keys
+	adminUsersPageSize = 100
+	// Number of items from which an admin listing page is full
+	adminListPageSize = 100
+)
+
+// AdminChannel is an encrypted channel, as listed for system admins.
+type AdminChannel struct {
+	ChanID      string `json:"chanID"`
+	TeamID      string `json:"teamID"`
+	DisplayName string `json:"displayName"`
+	Method      string `json:"method"`
+	// Last change of the method, nil if it happened before it was recorded
+	Change *ChanEncryptionChange `json:"change,omitempty"`
+}
+
+// AdminChannelsPage is a page of encrypted channels. Admin listings go
+// through stored data one chunk at a time, and a page ends with the chunk
+// that fills it: it holds at least adminListPageSize items unless it is the
+// last one. The next page starts at the chunk NextPage.
+type AdminChannelsPage struct {
+	Page     int             `json:"page"`
+	NextPage int             `json:"nextPage,omitempty"`
+	HasMore  bool            `json:"hasMore"`
+	Channels []*AdminChannel `json:"channels"`
+}
+
+// AdminUser tells whether a user has an encryption key.
+type AdminUser struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	HasKey   bool   `json:"hasKey"`
+}
+
+// AdminUsersPage is a page of users, paged like AdminChannelsPage.
+type AdminUsersPage struct {
+	Page     int          `json:"page"`
+	NextPage int          `json:"nextPage,omitempty"`
+	HasMore  bool         `json:"hasMore"`
+	Users    []*AdminUser `json:"users"`
+}
+
+// AdminKeyHistory sums up the keys of a user.
+type AdminKeyHistory struct {
+	UserID string  `json:"userID"`
+	PubKey *PubKey `json:"pubkey"`
+	KeyID  string  `json:"keyID,omitempty"`
+	// When the current key was set up, 0 if unknown
+	CreateAt int64 `json:"createAt,omitempty"`
+	// When the user last revoked a key, 0 if never
+	RevokeAt int64 `json:"revokeAt,omitempty"`
+	// Latest key changes, oldest first
+	Events []*PubKeyChange `json:"events"`
+}
+
+func parsePage(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 0 {
+		return 0
+	}
+	return page
+}
+
+// scanAdminKV calls add with the end of the KV keys starting with prefix,
+// from the chunk of KV keys page on, until add has kept a full page of items
+// or there are no more keys. It returns the chunk to continue from, or -1 if
+// all keys have been scanned.
+func (p *Plugin) scanAdminKV(page int, prefix string, add func(suffix string) (bool, *model.AppError)) (int, *model.AppError) {
+	added := 0
+	for ; ; page++ {
+		keys, appErr := p.API.KVList(page, adminKVPageSize)
+		if appErr != nil {
+			return 0, appErr
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			kept, appErr := add(strings.TrimPrefix(key, prefix))
+			if appErr != nil {
+				return 0, appErr
+			}
+			if kept {
+				added++
+			}
+		}
+		if len(keys) < adminKVPageSize {
+			return -1, nil
+		}
+		if added >= adminListPageSize {
+			return page + 1, nil
+		}
+	}
+}
+
+// ListEncryptedChannels returns a page of the channels whose encryption
+// method isn't none, starting at the chunk of KV keys page.
+func (p *Plugin) ListEncryptedChannels(page int) (*AdminChannelsPage, *model.AppError) {
+	ret := &AdminChannelsPage{Page: page, Channels: make([]*AdminChannel, 0)}
+	next, appErr := p.scanAdminKV(page, ChanEncryptionMethodKeyPrefix, func(chanID string) (bool, *model.AppError) {
+		method := p.ChanEncrMethods.get(chanID)
+		if method == ChanEncryptionMethodNone {
+			return false, nil
+		}
+		channel := &AdminChannel{ChanID: chanID, Method: ChanEncryptionMethodString(method)}
+		// The channel may have been deleted
+		if mmChannel, appErr := p.API.GetChannel(chanID); appErr == nil {
+			channel.TeamID = mmChannel.TeamId
+			channel.DisplayName = mmChannel.DisplayName
+		}
+		var appErr *model.AppError
+		channel.Change, appErr = p.GetChanEncryptionChange(chanID)
+		if appErr != nil {
+			return false, appErr
+		}
+		ret.Channels = append(ret.Channels, channel)
+		return true, nil
+	})
+	if appErr != nil {
+		return nil, appErr
+	}
+	if next >= 0 {
+		ret.NextPage, ret.HasMore = next, true
+	}
+	return ret, nil
+}
+
+// ListUsersWithKey returns a page of the users with an encryption key,
+// starting at the chunk of KV keys page.
+func (p *Plugin) ListUsersWithKey(page int) (*AdminUsersPage, *model.AppError) {
+	ret := &AdminUsersPage{Page: page, Users: make([]*AdminUser, 0)}
+	next, appErr := p.scanAdminKV(page, StoreKeyPubKeyPrefix, func(userID string) (bool, *model.AppError) {
+		user := &AdminUser{UserID: userID, HasKey: true}
+		if mmUser, appErr := p.API.GetUser(userID); appErr == nil {
+			user.Username = mmUser.Username
+		}
+		ret.Users = append(ret.Users, user)
+		return true, nil
+	})
+	if appErr != nil {
+		return nil, appErr
+	}
+	if next >= 0 {
+		ret.NextPage, ret.HasMore = next, true
+	}
+	return ret, nil
+}
+
+// ListUsersWithoutKey returns a page of the active users without an
+// encryption key, starting at the chunk of users page. Users without keys
+// have nothing in the KV store, so all users are listed.
+func (p *Plugin) ListUsersWithoutKey(page int) (*AdminUsersPage, *model.AppError) {
+	ret := &AdminUsersPage{Page: page, Users: make([]*AdminUser, 0)}
+	for ; ; page++ {
+		users, appErr := p.API.GetUsers(&model.UserGetOptions{Page: page, PerPage: adminUsersPageSize, Active: true})
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, user := range users {
+			hasKey, appErr := p.HasUserPubKey(user.Id)
+			if appErr != nil {
+				return nil, appErr
+			}
+			if !hasKey {
+				ret.Users = append(ret.Users, &AdminUser{UserID: user.Id, Username: user.Username})
+			}
+		}
+		if len(users) < adminUsersPageSize {
+			return ret, nil
+		}
+		if len(ret.Users) >= adminListPageSize {
+			ret.NextPage, ret.HasMore = page+1, true
+			return ret, nil
+		}
+	}
+}
+
+// GetAdminKeyHistory returns the current key of userID, when it was set up
+// and the latest changes of their key.
+func (p *Plugin) GetAdminKeyHistory(userID string) (*AdminKeyHistory, *model.AppError) {
+	ret := &AdminKeyHistory{UserID: userID}
+	pubkey, err := p.GetUserPubKey(userID)
+	if err != nil {
+		return nil, model.NewAppError("GetAdminKeyHistory", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if pubkey != nil {
+		ret.PubKey = pubkey
+		ret.KeyID = KeyIDString(pubkey.ID())
+		meta, appErr := p.GetPubKeyMetadata(userID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if meta != nil {
+			ret.CreateAt = meta.CreateAt
+		}
+	}
+	data, appErr := p.API.KVGet(StoreKeyPubKeyRevoked(userID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	var revocation PubKeyRevocation
+	if data != nil && json.Unmarshal(data, &revocation) == nil {
+		ret.RevokeAt = revocation.RevokeAt
+	}
+	ret.Events, appErr = p.GetPubKeyHistory(userID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return ret, nil
+}
+
+// ResetUserKey revokes the key of userID and removes their GPG backup, on
+// behalf of the system admin adminID. The user is told by our bot.
+func (p *Plugin) ResetUserKey(adminID string, userID string) *model.AppError {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return model.NewAppError("ResetUserKey", "mm-e2ee.unknown_user", nil, appErr.Error(), http.StatusNotFound)
+	}
+	appErr = p.ResetUserPubKey(userID, adminID)
+	if appErr != nil && appErr.StatusCode != http.StatusNotFound {
+		return appErr
+	}
+	appErr = p.DeleteGPGBackup(userID)
+	if appErr != nil {
+		return appErr
+	}
+	p.API.LogInfo("encryption key reset by a system admin", "user_id", userID, "admin_id", adminID)
+	appErr = p.SendBotDM(user.Id, "A system admin reset your encryption key. Run `/e2ee init` to setup a new one.")
+	if appErr != nil {
+		p.API.LogError("unable to notify key reset", "user_id", userID, "error", appErr.Error())
+	}
+	return nil
+}
+
+func (p *Plugin) ListEncryptedChannelsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	channels, appErr := p.ListEncryptedChannels(parsePage(r))
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, channels)
+}
+
+func (p *Plugin) ListUsersHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	page := parsePage(r)
+	var users *AdminUsersPage
+	var appErr *model.AppError
+	switch r.URL.Query().Get("hasKey") {
+	case "true":
+		users, appErr = p.ListUsersWithKey(page)
+	case "false":
+		users, appErr = p.ListUsersWithoutKey(page)
+	default:
+		http.Error(w, "hasKey must be true or false", http.StatusBadRequest)
+		return
+	}
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, users)
+}
+
+func (p *Plugin) GetAdminKeyHistoryHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	history, appErr := p.GetAdminKeyHistory(r.URL.Query().Get("userID"))
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, history)
+}
+
+func (p *Plugin) ResetUserKeyHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	appErr := p.ResetUserKey(c.UserID, r.URL.Query().Get("userID"))
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
+
+// ForceChanEncryptionMethodHandler sets the encryption method of a channel,
+// whether the admin is a member of it or not, and whether it is locked or
+// not.
+func (p *Plugin) ForceChanEncryptionMethodHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chanID := query.Get("chanID")
+	methodName := query.Get("method")
+	method := ChanEncryptionMethodFromString(methodName)
+	if ChanEncryptionMethodString(method) != methodName {
+		http.Error(w, "invalid encryption method", http.StatusBadRequest)
+		return
+	}
+	_, appErr := p.API.GetChannel(chanID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusNotFound)
+		return
+	}
+	_, appErr = p.SetChanEncryptionMethodAndNotify(chanID, c.UserID, method)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, ChanEncryptionMethodResponse{ChanEncryptionMethodString(method)})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_admin_listings(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	none, _ := json.Marshal(ChanEncryptionMethodNone)
+	kv.data[ChanEncryptionMethodKey("chan1")] = p2p
+	kv.data[ChanEncryptionMethodKey("chan2")] = none
+	kv.data[ChanEncryptionMethodKey("chan3")] = p2p
+	change := &ChanEncryptionChange{Method: "p2p", UserID: "user1", At: 42}
+	kv.data[ChanEncryptionChangeKey("chan1")], _ = json.Marshal(change)
+	pubkey := GenerateValidPubKey()
+	kv.data[StoreKeyPubKey("user1")], _ = json.Marshal(NewPubKeyRecord(&pubkey))
+	mockAPI.On("GetChannel", "chan1").Return(&model.Channel{Id: "chan1", TeamId: "team1", DisplayName: "Chan 1"}, nil)
+	mockAPI.On("GetChannel", "chan3").Return(nil, &model.AppError{Message: "deleted"})
+	mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "alice"}, nil)
+	mockAPI.On("GetUsers", &model.UserGetOptions{Page: 0, PerPage: adminUsersPageSize, Active: true}).Return([]*model.User{
+		{Id: "user1", Username: "alice"},
+		{Id: "user2", Username: "bob"},
+	}, nil)
+
+	channels, appErr := p.ListEncryptedChannels(0)
+	tassert.Nil(appErr)
+	tassert.Equal(&AdminChannelsPage{
+		Channels: []*AdminChannel{
+			{ChanID: "chan1", TeamID: "team1", DisplayName: "Chan 1", Method: "p2p", Change: change},
+			{ChanID: "chan3", Method: "p2p"},
+		},
+	}, channels)
+
+	withKey, appErr := p.ListUsersWithKey(0)
+	tassert.Nil(appErr)
+	tassert.Equal([]*AdminUser{{UserID: "user1", Username: "alice", HasKey: true}}, withKey.Users)
+
+	withoutKey, appErr := p.ListUsersWithoutKey(0)
+	tassert.Nil(appErr)
+	tassert.Equal([]*AdminUser{{UserID: "user2", Username: "bob"}}, withoutKey.Users)
+}
+
+func Test_admin_listingFullPages(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	// The first chunk holds a single key, the second one fills the page
+	chunks := [][]string{make([]string, 0), make([]string, 0), {StoreKeyPubKey("last")}}
+	for i := 0; i < adminKVPageSize; i++ {
+		other := fmt.Sprintf("other%d", i)
+		if i == 0 {
+			chunks[0] = append(chunks[0], StoreKeyPubKey("first"))
+		} else {
+			chunks[0] = append(chunks[0], ChanEncryptionChangeKey(other))
+		}
+		chunks[1] = append(chunks[1], StoreKeyPubKey(other))
+	}
+	for i, chunk := range chunks {
+		mockAPI.On("KVList", i, adminKVPageSize).Return(chunk, nil)
+	}
+	mockAPI.On("GetUser", mock.Anything).Return(nil, &model.AppError{})
+
+	users, appErr := p.ListUsersWithKey(0)
+	tassert.Nil(appErr)
+	tassert.Len(users.Users, adminKVPageSize+1)
+	tassert.True(users.HasMore)
+	tassert.Equal(2, users.NextPage)
+
+	users, appErr = p.ListUsersWithKey(users.NextPage)
+	tassert.Nil(appErr)
+	tassert.Equal([]*AdminUser{{UserID: "last", HasKey: true}}, users.Users)
+	tassert.False(users.HasMore)
+}
+
+func Test_admin_resetUserKey(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+
+	pubkey := GenerateValidPubKey()
+	tassert.Nil(p.SetUserPubKey("user1", &pubkey))
+	kv.data[StoreBackupGPGKey("user1")] = []byte("backup")
+	mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "alice"}, nil)
+	mockAPI.On("GetUser", "unknown").Return(nil, &model.AppError{Message: "not found"})
+	mockAPI.On("GetTeamsForUser", "user1").Return([]*model.Team{}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "user1", false).Return([]*model.Channel{}, nil)
+	mockAPI.On("GetDirectChannel", "bot", "user1").Return(&model.Channel{Id: "dm1"}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+	mockAPI.On("LogInfo", "encryption key reset by a system admin", "user_id", "user1", "admin_id", "admin").Return()
+
+	tassert.Nil(p.ResetUserKey("admin", "user1"))
+	got, err := p.GetUserPubKey("user1")
+	tassert.Nil(err)
+	tassert.Nil(got)
+	tassert.NotContains(kv.data, StoreBackupGPGKey("user1"))
+	mockAPI.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "dm1" && post.UserId == "bot"
+	}))
+
+	history, appErr := p.GetAdminKeyHistory("user1")
+	tassert.Nil(appErr)
+	tassert.Nil(history.PubKey)
+	tassert.NotZero(history.RevokeAt)
+	tassert.Len(history.Events, 1)
+	tassert.Equal(KeyChangeReset, history.Events[0].Kind)
+	tassert.Equal("admin", history.Events[0].AdminID)
+	changes, appErr := p.GetPubKeyChanges(0)
+	tassert.Nil(appErr)
+	tassert.Len(changes.Events, 1)
+	tassert.Equal(KeyChangeReset, changes.Events[0].Kind)
+	tassert.Equal("admin", changes.Events[0].AdminID)
+
+	// Users without keys can be reset too, unknown users can't
+	tassert.Nil(p.ResetUserKey("admin", "user1"))
+	appErr = p.ResetUserKey("admin", "unknown")
+	tassert.NotNil(appErr)
+	tassert.Equal(http.StatusNotFound, appErr.StatusCode)
+}
+
+func Test_plugin_ServeHTTP_Admin(t *testing.T) {
+	mockAPI := plugintest.API{}
+	mockAPI.On("HasPermissionTo", "admin", model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	mockAPI.On("HasPermissionTo", "user1", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+	mockAPI.On("KVList", 0, adminKVPageSize).Return([]string{ChanEncryptionMethodKey("chan1")}, nil)
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan1")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanEncryptionChangeKey("chan1")).Return(nil, nil)
+	mockAPI.On("GetChannel", "chan1").Return(&model.Channel{Id: "chan1", TeamId: "team1", DisplayName: "Chan 1"}, nil)
+	mockAPI.On("GetChannel", "unknown").Return(nil, &model.AppError{Message: "not found"})
+
+	tests := []TestDesc{
+		{
+			name: "ListChannels",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    "/api/v1/admin/channels",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body: AdminChannelsPage{
+					Channels: []*AdminChannel{
+						{ChanID: "chan1", TeamID: "team1", DisplayName: "Chan 1", Method: "p2p"},
+					},
+				},
+			},
+			userID: "admin",
+		},
+		{
+			name: "ListChannelsNotAdmin",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    "/api/v1/admin/channels",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			userID: "user1",
+		},
+		{
+			name: "ListUsersInvalidFilter",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    "/api/v1/admin/users?hasKey=maybe",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			userID: "admin",
+		},
+		{
+			name: "ResetKeyNotAdmin",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    "/api/v1/admin/user/reset_key?userID=user2",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			userID: "user1",
+		},
+		{
+			name: "ForceInvalidMethod",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    "/api/v1/admin/channel/encryption_method?chanID=chan1&method=foo",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			userID: "admin",
+		},
+		{
+			name: "ForceUnknownChannel",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    "/api/v1/admin/channel/encryption_method?chanID=unknown&method=p2p",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusNotFound,
+			},
+			userID: "admin",
+		},
+		{
+			name: "ForceUnchanged",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    "/api/v1/admin/channel/encryption_method?chanID=chan1&method=p2p",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body:       ChanEncryptionMethodResponse{"p2p"},
+			},
+			userID: "admin",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"runtime/debug"
 	"strings"
@@ -42,17 +41,34 @@ func (p *Plugin) PushPubKey(c *Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err := p.SetUserPubKey(userID, pubkey)
+	oldPubkey, err := p.GetUserPubKey(userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	p.API.PublishWebSocketEvent("newPubkey",
-		map[string]interface{}{
-			"userID": userID,
-		},
-		&model.WebsocketBroadcast{OmitUsers: map[string]bool{userID: true}})
+	err = p.SetUserPubKey(userID, pubkey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	appErr := p.SetPubKeyMetadata(userID, &PubKeyMetadata{CreateAt: model.GetMillis()})
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if appErr := p.IndexUserPubKey(userID, oldPubkey, pubkey); appErr != nil {
+		p.API.LogError("unable to index public key", "user_id", userID, "error", appErr.Error())
+	}
+
+	if appErr := p.PublishNewUserPubKey(userID, oldPubkey, pubkey); appErr != nil {
+		p.API.LogError("unable to publish key change", "user_id", userID, "error", appErr.Error())
+	}
+
+	if appErr := p.AutoEncryptDMsOfUser(userID); appErr != nil {
+		p.API.LogError("unable to automatically encrypt direct channels", "user_id", userID, "error", appErr.Error())
+	}
 
 	if !p.GPGBackupEnabled() {
 		return
@@ -66,7 +82,7 @@ func (p *Plugin) PushPubKey(c *Context, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	appErr := p.StoreGPGBackup(userID, *req.BackupGPG)
+	appErr = p.StoreGPGBackup(userID, *req.BackupGPG)
 	if appErr != nil {
 		http.Error(w, appErr.Error(), http.StatusInternalServerError)
 		return
@@ -79,12 +95,26 @@ func (p *Plugin) PushPubKey(c *Context, w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (p *Plugin) RevokePubKeyHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	appErr := p.RevokeUserPubKey(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
+
 type GetPubKeysRequest struct {
 	UserIds []string `json:"userIds"`
 }
 
 type GetPubKeysResponse struct {
 	PubKeys map[string]*PubKey `json:"pubKeys"`
+	// Users whose key expired, if the key expiry policy is enabled
+	Expired map[string]bool `json:"expired,omitempty"`
+	// Users the caller isn't allowed to see, who are not in PubKeys
+	NotVisible map[string]bool `json:"notVisible,omitempty"`
+	// Users whose key wasn't looked up because the caller reached their
+	// lookup limit, who are not in PubKeys
+	RateLimited map[string]bool `json:"rateLimited,omitempty"`
 }
 
 func NewGetPubKeysReponse() *GetPubKeysResponse {
@@ -93,25 +123,72 @@ func NewGetPubKeysReponse() *GetPubKeysResponse {
 	return ret
 }
 
-func (p *Plugin) GetPubKeys(w http.ResponseWriter, r *http.Request) {
+func (p *Plugin) GetPubKeys(c *Context, w http.ResponseWriter, r *http.Request) {
 	var req GetPubKeysRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	allowed, appErr := p.checkPubKeyLookupRate(c.UserID, len(req.UserIds))
+	if appErr != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	viewer, appErr := p.newPubKeyViewer(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	res := NewGetPubKeysReponse()
-	for _, uid := range req.UserIds {
+	for _, uid := range req.UserIds[:allowed] {
+		visible, appErr := viewer.CanSee(uid)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			if res.NotVisible == nil {
+				res.NotVisible = make(map[string]bool)
+			}
+			res.NotVisible[uid] = true
+			continue
+		}
 		pubkey, err := p.GetUserPubKey(uid)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		res.PubKeys[uid] = pubkey
+		if pubkey == nil {
+			continue
+		}
+		expired, appErr := p.IsUserPubKeyExpired(uid)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if expired {
+			if res.Expired == nil {
+				res.Expired = make(map[string]bool)
+			}
+			res.Expired[uid] = true
+		}
+	}
+	for _, uid := range req.UserIds[allowed:] {
+		if _, ok := res.PubKeys[uid]; ok || res.NotVisible[uid] {
+			continue
+		}
+		if res.RateLimited == nil {
+			w.Header().Set("Retry-After", "60")
+			res.RateLimited = make(map[string]bool)
+		}
+		res.RateLimited[uid] = true
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	p.WriteJSON(w, res)
+	p.WriteJSONWithETag(w, r, res)
 }
 
 type ChanEncryptionMethodResponse struct {
@@ -143,77 +220,11 @@ func (p *Plugin) GetChanEncryptionMethod(c *Context, w http.ResponseWriter, r *h
 }
 
 func (p *Plugin) SetChanEncryptionMethod(c *Context, w http.ResponseWriter, r *http.Request) {
-	userID := c.UserID
 	chanID := r.URL.Query().Get("chanID")
-
-	// Check user is in channel and has the right to do so
-	_, appErr := p.API.GetChannelMember(chanID, userID)
-	if appErr != nil {
-		http.Error(w, appErr.Error(), http.StatusUnauthorized)
-		return
-	}
-	// TODO: check rights
-
 	method := ChanEncryptionMethodFromString(r.URL.Query().Get("method"))
-	changed, appErr := p.ChanEncrMethods.setIfDifferent(chanID, method)
+	appErr := p.SetChanEncryptionMethodOfUser(chanID, c.UserID, method)
 	if appErr != nil {
-		http.Error(w, appErr.Error(), http.StatusInternalServerError)
-		return
-	}
-	if !changed {
-		post := &model.Post{
-			Message:   fmt.Sprintf("Channel is already on encryption mode '%s'", ChanEncryptionMethodString(method)),
-			UserId:    p.BotUserID,
-			ChannelId: chanID,
-		}
-		_ = p.API.SendEphemeralPost(userID, post)
-		return
-	}
-
-	p.API.PublishWebSocketEvent("channelStateChanged",
-		map[string]interface{}{
-			"chanID": chanID,
-			"method": ChanEncryptionMethodString(method),
-		},
-		&model.WebsocketBroadcast{ChannelId: chanID})
-
-	user, appErr := p.API.GetUser(userID)
-	if appErr != nil {
-		http.Error(w, appErr.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	var msg string
-	if method == ChanEncryptionMethodNone {
-		msg = fmt.Sprintf("@all: messages on this channel **aren't encrypted anymore**. Set by @%s", user.Username)
-	} else {
-		msg = fmt.Sprintf("@all: message on this channel are now encrypted. Set by @%s. Please note that **people not in this channel won't be able to read the backlog**.", user.Username)
-		noPubKeys, appErrMWK := p.GetChannelMembersWithoutKeys(chanID)
-		if appErrMWK != nil {
-			http.Error(w, appErrMWK.Error(), http.StatusInternalServerError)
-			return
-		}
-		if len(noPubKeys) > 0 {
-			msg += "\n**WARNING**: these people in the channel do not have setup an encryption key, and therefore won't be able to read messages:"
-			for _, nokeyUID := range noPubKeys {
-				nokeyUser, appErrU := p.API.GetUser(nokeyUID)
-				if appErrU != nil {
-					http.Error(w, appErrU.Error(), http.StatusInternalServerError)
-					return
-				}
-				msg += " @" + nokeyUser.Username
-			}
-		}
-	}
-
-	post := &model.Post{
-		Message:   msg,
-		UserId:    p.BotUserID,
-		ChannelId: chanID,
-	}
-	_, appErr = p.API.CreatePost(post)
-	if appErr != nil {
-		http.Error(w, appErr.Error(), http.StatusInternalServerError)
+		http.Error(w, appErr.Error(), appErr.StatusCode)
 	}
 }
 
@@ -237,6 +248,7 @@ func (p *Plugin) GPGBackupEnabled() bool {
 
 func (p *Plugin) InitializeAPI() {
 	p.ChanEncrMethods = NewChanEncrMethodDB(p.API)
+	p.initCaches()
 
 	// Inspired by the Github plugin
 	p.router = mux.NewRouter()
@@ -245,9 +257,42 @@ func (p *Plugin) InitializeAPI() {
 	apiRouter := p.router.PathPrefix("/api/v1").Subrouter()
 
 	apiRouter.HandleFunc("/pubkey/push", p.CheckAuth(p.AttachContext(p.PushPubKey))).Methods(http.MethodPost)
-	apiRouter.HandleFunc("/pubkey/get", p.CheckAuth(p.GetPubKeys)).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/pubkey/revoke", p.CheckAuth(p.AttachContext(p.RevokePubKeyHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/pubkey/get", p.CheckAuth(p.AttachContext(p.GetPubKeys))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/pubkey/by_id/{keyID}", p.CheckAuth(p.AttachContext(p.GetPubKeyByIDHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/pubkey/changes", p.CheckAuth(p.AttachContext(p.GetPubKeyChangesHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/pubkey/fingerprint", p.CheckAuth(p.AttachContext(p.GetFingerprintHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/pubkey/safety_number", p.CheckAuth(p.AttachContext(p.GetSafetyNumberHandler))).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/channel/encryption_method", p.CheckAuth(p.AttachContext(p.GetChanEncryptionMethod))).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/channel/encryption_method", p.CheckAuth(p.AttachContext(p.SetChanEncryptionMethod))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/channel/who", p.CheckAuth(p.AttachContext(p.GetChanWhoHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/channel/keyring", p.CheckAuth(p.AttachContext(p.GetChanKeyringHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/channel/encryption_lock", p.CheckAuth(p.AttachContext(p.GetChanEncryptionLock))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/channel/encryption_lock", p.CheckAuth(p.AttachContext(p.SetChanEncryptionLockHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/channel/encryption_change", p.CheckAuth(p.AttachContext(p.HandleChanEncryptionChangeAction))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/channel/settings", p.CheckAuth(p.AttachContext(p.GetChanSettingsHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/channel/strict", p.CheckAuth(p.AttachContext(p.SetChanStrictHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/channel/strict_removals", p.CheckAuth(p.AttachContext(p.GetStrictRemovalsHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/channel/verified_only", p.CheckAuth(p.AttachContext(p.SetChanVerifiedOnlyHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/attestations", p.CheckAuth(p.AttachContext(p.GetKeyAttestationsHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/attestations", p.CheckAuth(p.AttachContext(p.AddKeyAttestationHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/attestations/graph", p.CheckAuth(p.AttachContext(p.GetAttestationGraphHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/channel/key_notices", p.CheckAuth(p.AttachContext(p.SetChanKeyChangeNoticesHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/channel/monitor_report", p.CheckAuth(p.AttachContext(p.GetMonitorReportHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/default/encryption_method", p.CheckAuth(p.AttachContext(p.GetDefaultEncrMethodHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/default/encryption_method", p.CheckAuth(p.AttachContext(p.SetDefaultEncrMethodHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/user/prefs", p.CheckAuth(p.AttachContext(p.GetUserPrefsHandler))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/user/prefs", p.CheckAuth(p.AttachContext(p.SetUserPrefsHandler))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/admin/posting_rules", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.GetPostingRulesHandler)))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/admin/posting_rules", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.SetPostingRulesHandler)))).Methods(http.MethodPut)
+	apiRouter.HandleFunc("/admin/posting_rules/dry_run", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.PostingRulesDryRun)))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/admin/channels", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.ListEncryptedChannelsHandler)))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/admin/channel/encryption_method", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.ForceChanEncryptionMethodHandler)))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/admin/users", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.ListUsersHandler)))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/admin/user/key_history", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.GetAdminKeyHistoryHandler)))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/admin/user/reset_key", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.ResetUserKeyHandler)))).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/admin/cache_stats", p.CheckAuth(p.CheckSysAdmin(p.AttachContext(p.GetCacheStatsHandler)))).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/autocomplete/users", p.CheckAuth(p.AttachContext(p.AutocompleteUsers))).Methods(http.MethodGet)
 	apiRouter.HandleFunc("/gpg/key_server", p.CheckAuth(p.AttachContext(p.GetKeyServer))).Methods(http.MethodGet)
 }
 
@@ -292,6 +337,19 @@ func (p *Plugin) AttachContext(handler HTTPHandlerFuncWithContext) http.HandlerF
 	}
 }
 
+// CheckSysAdmin must be used after CheckAuth.
+func (p *Plugin) CheckSysAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("Mattermost-User-ID")
+		if !p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
 func (p *Plugin) CheckAuth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Header.Get("Mattermost-User-ID")
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/mattermost/mattermost-server/v5/model"
@@ -47,8 +48,21 @@ func Test_plugin_ServeHTTP_PushPubKey(t *testing.T) {
 	// KVSet always work
 	mockAPI.On("KVSet", "pubkey:user1", mock.AnythingOfType("[]uint8")).Return(nil)
 	mockAPI.On("KVDelete", "backup_gpg:user1").Return(nil)
-	mockAPI.On("PublishWebSocketEvent", "newPubkey", mock.Anything,
-		&model.WebsocketBroadcast{OmitUsers: map[string]bool{"user1": true}})
+	mockAPI.On("KVSet", "pubkey_meta:user1", mock.AnythingOfType("[]uint8")).Return(nil)
+	// user1 has no key yet
+	mockAPI.On("KVGet", "pubkey:user1").Return(nil, nil)
+	// user1 never revoked a key, and is in no team
+	mockAPI.On("KVGet", "pubkey_revoked:user1").Return(nil, nil)
+	mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "user1"}, nil)
+	mockAPI.On("GetTeamsForUser", "user1").Return([]*model.Team{}, nil)
+	mockEmptyPubKeyChanges(&mockAPI)
+	mockAPI.On("KVGet", "pubkey_history:user1").Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", "pubkey_history:user1", mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+	// Nobody else has the same key
+	mockAPI.On("KVGet", mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, "keyid:") })).Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, "keyid:") }), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+	// user1 has no direct channel
+	mockAPI.On("GetChannelsForTeamForUser", "", "user1", false).Return([]*model.Channel{}, nil)
 	apiURL := "/api/v1/pubkey/push"
 
 	validPubKey := GenerateValidPubKey()
@@ -132,7 +146,7 @@ func Test_plugin_ServeHTTP_GetPubKeys(t *testing.T) {
 			},
 			expectedResponse: testutils.ExpectedResponse{
 				StatusCode: http.StatusOK,
-				Body:       GetPubKeysResponse{map[string]*PubKey{"user1": &user1Key, "user2": nil}},
+				Body:       GetPubKeysResponse{PubKeys: map[string]*PubKey{"user1": &user1Key, "user2": nil}},
 			},
 			userID: "user",
 		},
@@ -245,13 +259,11 @@ func mockAPISetChannelEncryptionSuccess(mockAPI *plugintest.API, chanID string,
 		&model.WebsocketBroadcast{ChannelId: chanID}).Return()
 
 	// "userNoKey" has no key
-	mockAPI.On("GetUser", "userNoKey").Return(&model.User{Username: "userNoKey"}, nil)
-	maxUsersPerTeam := 100
-	mockAPI.On("GetConfig").Return(&model.Config{TeamSettings: model.TeamSettings{MaxUsersPerTeam: &maxUsersPerTeam}})
-	mockAPI.On("GetChannelMembers", chanID, 0, maxUsersPerTeam).Return(
-		&model.ChannelMembers{
-			{UserId: userID},
-			{UserId: "userNoKey"}}, nil)
+	mockAPI.On("GetUsersInChannel", chanID, model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return(
+		[]*model.User{
+			{Id: userID},
+			{Id: "userNoKey", Username: "userNoKey"}}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey(userID)).Return([]byte("{}"), nil)
 
 	user1Key := PubKey{[]byte{0}, []byte{1}}
 	user1KeyJSON, _ := json.Marshal(user1Key)
@@ -267,7 +279,8 @@ func Test_plugin_ServeHTTP_SetChannelEncryptionMethodWillChange(t *testing.T) {
 	none, _ := json.Marshal(ChanEncryptionMethodNone)
 	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
 	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(none, nil)
-	mockAPI.On("KVSet", ChanEncryptionMethodKey(chanID), p2p).Return(nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(chanID), p2p, mock.Anything).Return(true, nil)
+	mockAPI.On("KVSet", ChanEncryptionChangeKey(chanID), mock.AnythingOfType("[]uint8")).Return(nil)
 	mockAPISetChannelEncryptionSuccess(&mockAPI, chanID, userID, ChanEncryptionMethodP2P)
 
 	apiURL := "/api/v1/channel/encryption_method"
@@ -295,7 +308,8 @@ func Test_plugin_ServeHTTP_SetChannelEncryptionMethodFirstTime(t *testing.T) {
 	mockAPI := plugintest.API{}
 	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
 	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(nil, nil)
-	mockAPI.On("KVSet", ChanEncryptionMethodKey(chanID), p2p).Return(nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(chanID), p2p, mock.Anything).Return(true, nil)
+	mockAPI.On("KVSet", ChanEncryptionChangeKey(chanID), mock.AnythingOfType("[]uint8")).Return(nil)
 	mockAPISetChannelEncryptionSuccess(&mockAPI, chanID, userID, ChanEncryptionMethodP2P)
 
 	apiURL := "/api/v1/channel/encryption_method"
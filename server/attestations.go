@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// MaxAttestationGraphDepth is the maximum number of hops followed when
+// building an attestation graph.
+const MaxAttestationGraphDepth = 3
+
+// KeyAttestation states that a user verified the key of another user, for
+// instance by comparing fingerprints out of band. It is signed by the
+// attester with their ECDSA key.
+type KeyAttestation struct {
+	AttesterID string `json:"attesterID"`
+	// Key of the attester that signed the attestation
+	AttesterKeyID string `json:"attesterKeyID"`
+	TargetUserID  string `json:"targetUserID"`
+	// Base64 encoded key ID, as in encrypted posts
+	KeyID string `json:"keyID"`
+	// ECDSA P-256 signature of AttestationStatement, in the format used by
+	// WebCrypto (r || s)
+	Signature []byte `json:"signature"`
+	CreateAt  int64  `json:"createAt"`
+}
+
+// KeyAttestations are the attestations made by a user, by target user ID.
+// Only the latest attestation of each target is kept.
+type KeyAttestations map[string]*KeyAttestation
+
+func StoreKeyAttestations(userID string) string {
+	return fmt.Sprintf("attestations:%s", userID)
+}
+
+// StoreKeyAttestationsOfKey is where the attestations of a key are stored.
+// The key ID is encoded in unpadded URL base64, so that the KV key fits in 50
+// characters.
+func StoreKeyAttestationsOfKey(keyID []byte) string {
+	return fmt.Sprintf("katt:%s", base64.RawURLEncoding.EncodeToString(keyID))
+}
+
+// AttestationStatement returns the data signed by an attester.
+func AttestationStatement(targetUserID string, keyID string) []byte {
+	return []byte(fmt.Sprintf("mm-e2ee attestation v1\n%s\n%s", targetUserID, keyID))
+}
+
+// Attests returns whether these attestations cover the key keyID of
+// targetUserID. The attestation must have been signed by attesterKey, the
+// current key of the attester: attestations made with a previous key don't
+// count anymore.
+func (a KeyAttestations) Attests(targetUserID string, keyID string, attesterKey *PubKey) bool {
+	att, has := a[targetUserID]
+	if !has || att.KeyID != keyID || attesterKey == nil || att.AttesterKeyID != KeyIDString(attesterKey.ID()) {
+		return false
+	}
+	return attesterKey.VerifySignature(AttestationStatement(targetUserID, keyID), att.Signature)
+}
+
+// VerifySignature returns whether signature is a valid signature of data by
+// the ECDSA key of pubkey.
+func (pubkey *PubKey) VerifySignature(data []byte, signature []byte) bool {
+	// JSON tags are swapped: Encr holds the ECDSA point
+	pt := ValidateECPoint(pubkey.Encr)
+	if pt == nil {
+		return false
+	}
+	CL := ECCurve.Params().BitSize / 8
+	if len(signature) != 2*CL {
+		return false
+	}
+	r := new(big.Int).SetBytes(signature[:CL])
+	s := new(big.Int).SetBytes(signature[CL:])
+	hash := sha256.Sum256(data)
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: ECCurve, X: &pt.x, Y: &pt.y}, hash[:], r, s)
+}
+
+func (p *Plugin) GetKeyAttestations(userID string) (KeyAttestations, *model.AppError) {
+	data, appErr := p.API.KVGet(StoreKeyAttestations(userID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := make(KeyAttestations)
+	if data == nil {
+		return ret, nil
+	}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, model.NewAppError("GetKeyAttestations", "mm-e2ee.invalid_attestations", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// GetAttestationsOfKey returns the attestations of the key keyID, made by
+// any user.
+func (p *Plugin) GetAttestationsOfKey(keyID []byte) ([]*KeyAttestation, *model.AppError) {
+	data, appErr := p.API.KVGet(StoreKeyAttestationsOfKey(keyID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := make([]*KeyAttestation, 0)
+	if data == nil {
+		return ret, nil
+	}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, model.NewAppError("GetAttestationsOfKey", "mm-e2ee.invalid_attestations", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// AddKeyAttestation checks and stores the attestation of att.TargetUserID's
+// key by userID. The attested key must be the current key of the target, and
+// the attestation must be signed by the current key of userID.
+func (p *Plugin) AddKeyAttestation(userID string, att *KeyAttestation) *model.AppError {
+	if att.TargetUserID == userID {
+		return model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_attestation", nil, "you can't attest your own key", http.StatusBadRequest)
+	}
+	pubkey, err := p.GetUserPubKey(att.TargetUserID)
+	if err != nil {
+		return model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if pubkey == nil || KeyIDString(pubkey.ID()) != att.KeyID {
+		return model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_attestation", nil, "attested key isn't the current key of this user", http.StatusBadRequest)
+	}
+	attesterKey, err := p.GetUserPubKey(userID)
+	if err != nil {
+		return model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if attesterKey == nil {
+		return model.NewAppError("AddKeyAttestation", "mm-e2ee.no_pubkey", nil, "you need a key to attest other keys", http.StatusBadRequest)
+	}
+	if !attesterKey.VerifySignature(AttestationStatement(att.TargetUserID, att.KeyID), att.Signature) {
+		return model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_attestation", nil, "invalid attestation signature", http.StatusBadRequest)
+	}
+
+	att.AttesterID = userID
+	att.AttesterKeyID = KeyIDString(attesterKey.ID())
+	att.CreateAt = model.GetMillis()
+	appErr := p.kvAtomicUpdate(StoreKeyAttestations(userID), func(old []byte) ([]byte, *model.AppError) {
+		attestations := make(KeyAttestations)
+		if old != nil {
+			if err := json.Unmarshal(old, &attestations); err != nil {
+				return nil, model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_attestations", nil, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		attestations[att.TargetUserID] = att
+		data, _ := json.Marshal(attestations)
+		return data, nil
+	})
+	if appErr != nil {
+		return appErr
+	}
+	return p.kvAtomicUpdate(StoreKeyAttestationsOfKey(pubkey.ID()), func(old []byte) ([]byte, *model.AppError) {
+		attestations := make([]*KeyAttestation, 0)
+		if old != nil {
+			if err := json.Unmarshal(old, &attestations); err != nil {
+				return nil, model.NewAppError("AddKeyAttestation", "mm-e2ee.invalid_attestations", nil, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		// Only keep the latest attestation of each attester
+		kept := make([]*KeyAttestation, 0, len(attestations)+1)
+		for _, a := range attestations {
+			if a.AttesterID != userID {
+				kept = append(kept, a)
+			}
+		}
+		kept = append(kept, att)
+		data, _ := json.Marshal(kept)
+		return data, nil
+	})
+}
+
+// AttestationGraph is made of keys linked by the attestations of their
+// owners.
+type AttestationGraph struct {
+	// Key the graph was built from
+	KeyID string `json:"keyID"`
+	// Edges go from the attester key to the attested key
+	Attestations []*KeyAttestation `json:"attestations"`
+}
+
+// GetAttestationGraph returns the attestations of keyID, and recursively of
+// the keys of their attesters, up to depth hops. Only attestations between
+// users the viewer can see are followed.
+func (p *Plugin) GetAttestationGraph(viewer *pubKeyViewer, keyID []byte, depth int) (*AttestationGraph, *model.AppError) {
+	ret := &AttestationGraph{KeyID: KeyIDString(keyID), Attestations: make([]*KeyAttestation, 0)}
+	visited := map[string]bool{ret.KeyID: true}
+	current := [][]byte{keyID}
+	for hop := 0; hop < depth && len(current) > 0; hop++ {
+		next := make([][]byte, 0)
+		for _, id := range current {
+			attestations, appErr := p.GetAttestationsOfKey(id)
+			if appErr != nil {
+				return nil, appErr
+			}
+			for _, att := range attestations {
+				visible, appErr := viewer.CanSee(att.TargetUserID)
+				if appErr == nil && visible {
+					visible, appErr = viewer.CanSee(att.AttesterID)
+				}
+				if appErr != nil {
+					return nil, appErr
+				}
+				if !visible {
+					continue
+				}
+				ret.Attestations = append(ret.Attestations, att)
+				if visited[att.AttesterKeyID] {
+					continue
+				}
+				visited[att.AttesterKeyID] = true
+				attesterKeyID, err := base64.StdEncoding.DecodeString(att.AttesterKeyID)
+				if err != nil {
+					continue
+				}
+				next = append(next, attesterKeyID)
+			}
+		}
+		current = next
+	}
+	return ret, nil
+}
+
+// isValidKeyID returns whether keyID is a base64 encoded SHA256.
+func isValidKeyID(keyID string) bool {
+	data, err := base64.StdEncoding.DecodeString(keyID)
+	return err == nil && len(data) == sha256.Size
+}
+
+func (p *Plugin) GetKeyAttestationsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	attestations, appErr := p.GetKeyAttestations(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, attestations)
+}
+
+func (p *Plugin) AddKeyAttestationHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	var att KeyAttestation
+	if err := json.NewDecoder(r.Body).Decode(&att); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isValidKeyID(att.KeyID) {
+		http.Error(w, "invalid key ID", http.StatusBadRequest)
+		return
+	}
+	appErr := p.AddKeyAttestation(c.UserID, &att)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
+
+func (p *Plugin) GetAttestationGraphHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("keyID")
+	if !isValidKeyID(keyID) {
+		http.Error(w, "invalid key ID", http.StatusBadRequest)
+		return
+	}
+	depth := 1
+	if v := r.URL.Query().Get("depth"); v != "" {
+		var err error
+		depth, err = strconv.Atoi(v)
+		if err != nil || depth < 1 || depth > MaxAttestationGraphDepth {
+			http.Error(w, "invalid depth", http.StatusBadRequest)
+			return
+		}
+	}
+	viewer, appErr := p.newPubKeyViewer(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	rawKeyID, _ := base64.StdEncoding.DecodeString(keyID)
+	graph, appErr := p.GetAttestationGraph(viewer, rawKeyID, depth)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, graph)
+}
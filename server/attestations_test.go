@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+// GenerateSigningPubKey returns a valid public key along with the private
+// part of its ECDSA key.
+func GenerateSigningPubKey() (PubKey, *ecdsa.PrivateKey) {
+	priv, _ := ecdsa.GenerateKey(ECCurve, rand.Reader)
+	_, x, y, _ := elliptic.GenerateKey(ECCurve, rand.Reader)
+	return PubKey{
+		SerializePubKey(priv.X, priv.Y),
+		SerializePubKey(x, y),
+	}, priv
+}
+
+func signAttestation(priv *ecdsa.PrivateKey, targetUserID string, keyID string) []byte {
+	hash := sha256.Sum256(AttestationStatement(targetUserID, keyID))
+	r, s, _ := ecdsa.Sign(rand.Reader, priv, hash[:])
+	CL := ECCurve.Params().BitSize / 8
+	ret := make([]byte, 2*CL)
+	r.FillBytes(ret[:CL])
+	s.FillBytes(ret[CL:])
+	return ret
+}
+
+func Test_attestations_verifySignature(t *testing.T) {
+	tassert := assert.New(t)
+	pubkey, priv := GenerateSigningPubKey()
+	sig := signAttestation(priv, "user1", "keyid")
+	tassert.True(pubkey.VerifySignature(AttestationStatement("user1", "keyid"), sig))
+	tassert.False(pubkey.VerifySignature(AttestationStatement("user2", "keyid"), sig))
+	tassert.False(pubkey.VerifySignature(AttestationStatement("user1", "keyid"), sig[1:]))
+}
+
+func Test_plugin_ServeHTTP_AddKeyAttestation(t *testing.T) {
+	mockAPI := plugintest.API{}
+	attesterKey, attesterPriv := GenerateSigningPubKey()
+	targetKey := GenerateValidPubKey()
+	attesterKeyJSON, _ := json.Marshal(attesterKey)
+	targetKeyJSON, _ := json.Marshal(targetKey)
+	targetKeyID := KeyIDString(targetKey.ID())
+
+	mockAPI.On("KVGet", StoreKeyPubKey("attester")).Return(attesterKeyJSON, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("target")).Return(targetKeyJSON, nil)
+	mockAPI.On("KVGet", StoreKeyAttestations("attester")).Return(nil, nil)
+	mockAPI.On("KVGet", StoreKeyAttestationsOfKey(targetKey.ID())).Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", StoreKeyAttestations("attester"), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+	mockAPI.On("KVSetWithOptions", StoreKeyAttestationsOfKey(targetKey.ID()), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+
+	apiURL := "/api/v1/attestations"
+	tests := []TestDesc{
+		{
+			name: "valid",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL,
+				Body: KeyAttestation{
+					TargetUserID: "target",
+					KeyID:        targetKeyID,
+					Signature:    signAttestation(attesterPriv, "target", targetKeyID),
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+			},
+			userID: "attester",
+		},
+		{
+			name: "bad signature",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL,
+				Body: KeyAttestation{
+					TargetUserID: "target",
+					KeyID:        targetKeyID,
+					Signature:    signAttestation(attesterPriv, "other", targetKeyID),
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			userID: "attester",
+		},
+		{
+			name: "own key",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL,
+				Body: KeyAttestation{
+					TargetUserID: "attester",
+					KeyID:        KeyIDString(attesterKey.ID()),
+					Signature:    signAttestation(attesterPriv, "attester", KeyIDString(attesterKey.ID())),
+				},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			userID: "attester",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+	mockAPI.AssertNumberOfCalls(t, "KVSetWithOptions", 2)
+}
+
+func Test_plugin_ServeHTTP_GetAttestationGraph(t *testing.T) {
+	mockAPI := plugintest.API{}
+	keyA := GenerateValidPubKey()
+	keyB := GenerateValidPubKey()
+	keyC := GenerateValidPubKey()
+
+	// B attested A, C attested B, and A attested C
+	attA := []*KeyAttestation{{AttesterID: "b", AttesterKeyID: KeyIDString(keyB.ID()), TargetUserID: "a", KeyID: KeyIDString(keyA.ID())}}
+	attB := []*KeyAttestation{{AttesterID: "c", AttesterKeyID: KeyIDString(keyC.ID()), TargetUserID: "b", KeyID: KeyIDString(keyB.ID())}}
+	attC := []*KeyAttestation{{AttesterID: "a", AttesterKeyID: KeyIDString(keyA.ID()), TargetUserID: "c", KeyID: KeyIDString(keyC.ID())}}
+	for id, atts := range map[*PubKey][]*KeyAttestation{&keyA: attA, &keyB: attB, &keyC: attC} {
+		data, _ := json.Marshal(atts)
+		mockAPI.On("KVGet", StoreKeyAttestationsOfKey(id.ID())).Return(data, nil)
+	}
+
+	graph := func(name string, depth string, expected []*KeyAttestation) TestDesc {
+		return TestDesc{
+			name: name,
+			request: testutils.Request{
+				Method: "GET",
+				URL:    "/api/v1/attestations/graph?depth=" + depth + "&keyID=" + url.QueryEscape(KeyIDString(keyA.ID())),
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body:       AttestationGraph{KeyID: KeyIDString(keyA.ID()), Attestations: expected},
+			},
+			userID: "user1",
+		}
+	}
+	tests := []TestDesc{
+		graph("direct", "1", attA),
+		graph("two hops", "2", append(append([]*KeyAttestation{}, attA...), attB...)),
+		graph("cycle", "3", append(append(append([]*KeyAttestation{}, attA...), attB...), attC...)),
+	}
+	RunTests(&tests, t, &mockAPI)
+}
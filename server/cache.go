@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum number of entries of a cache. Expired entries are dropped when it
+// is reached, and all of them if that's not enough.
+const maxCacheEntries = 10000
+
+// CacheStats gives the usage of one of our caches on this server.
+type CacheStats struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+type cacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// ttlCache is an in-memory cache of KV store or server data. Entries are
+// invalidated when they are changed through this server, and expire after
+// ttl(). A ttl of 0 disables the cache.
+//
+// The server version we build against has no cluster events, so entries
+// can't be invalidated on the other servers of a cluster when they change:
+// caches are disabled on clusters.
+//
+// A nil *ttlCache is a valid, disabled, cache.
+type ttlCache struct {
+	name string
+	ttl  func() time.Duration
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	hits    uint64
+	misses  uint64
+}
+
+func newTTLCache(name string, ttl func() time.Duration) *ttlCache {
+	return &ttlCache{name: name, ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// get returns the value cached for key, if any.
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	if c == nil || c.ttl() <= 0 {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	ttl := c.ttl()
+	if ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.entries) >= maxCacheEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			c.entries = make(map[string]cacheEntry)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expiresAt: now.Add(ttl)}
+}
+
+func (c *ttlCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *ttlCache) stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return CacheStats{Name: c.name, Entries: len(c.entries), Hits: c.hits, Misses: c.misses}
+}
+
+// cacheTTL is how long cached entries are kept, according to the
+// configuration. It is 0 on a cluster, where a channel that was just
+// encrypted through a server could keep accepting unencrypted messages on
+// the others until their cached mode expires.
+func (p *Plugin) cacheTTL() time.Duration {
+	config := p.getConfiguration()
+	if config.clusterEnabled {
+		return 0
+	}
+	return time.Duration(config.CacheTTLSeconds) * time.Second
+}
+
+func (p *Plugin) initCaches() {
+	p.chanMethodCache = newTTLCache("channel encryption methods", p.cacheTTL)
+	p.pubKeyCache = newTTLCache("public keys", p.cacheTTL)
+	p.botCache = newTTLCache("bot flags", p.cacheTTL)
+	p.postingRulesCache = newTTLCache("posting rules", p.cacheTTL)
+	p.ChanEncrMethods.cache = p.chanMethodCache
+}
+
+// GetCacheStats returns the usage of the caches of this server.
+func (p *Plugin) GetCacheStats() []CacheStats {
+	return []CacheStats{
+		p.chanMethodCache.stats(),
+		p.pubKeyCache.stats(),
+		p.botCache.stats(),
+		p.postingRulesCache.stats(),
+	}
+}
+
+func (p *Plugin) GetCacheStatsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, p.GetCacheStats())
+}
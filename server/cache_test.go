@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_cache_ttl(t *testing.T) {
+	tassert := assert.New(t)
+	ttl := time.Hour
+	c := newTTLCache("test", func() time.Duration { return ttl })
+
+	_, ok := c.get("a")
+	tassert.False(ok)
+	c.set("a", 1)
+	v, ok := c.get("a")
+	tassert.True(ok)
+	tassert.Equal(1, v)
+	c.invalidate("a")
+	_, ok = c.get("a")
+	tassert.False(ok)
+	tassert.Equal(CacheStats{Name: "test", Entries: 0, Hits: 1, Misses: 2}, c.stats())
+
+	c.set("a", 1)
+	c.entries["a"] = cacheEntry{value: 1, expiresAt: time.Now().Add(-time.Second)}
+	_, ok = c.get("a")
+	tassert.False(ok)
+
+	// Disabled
+	ttl = 0
+	c.set("b", 2)
+	_, ok = c.get("b")
+	tassert.False(ok)
+	var nilCache *ttlCache
+	nilCache.set("b", 2)
+	_, ok = nilCache.get("b")
+	tassert.False(ok)
+}
+
+func Test_cache_chanEncrMethod(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{CacheTTLSeconds: 60})
+	tassert := assert.New(t)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	none, _ := json.Marshal(ChanEncryptionMethodNone)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan1")).Return(p2p, nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey("chan1"), none, mock.Anything).Return(true, nil)
+
+	tassert.Equal(ChanEncryptionMethodP2P, p.ChanEncrMethods.get("chan1"))
+	tassert.Equal(ChanEncryptionMethodP2P, p.ChanEncrMethods.get("chan1"))
+	isSet, _ := p.ChanEncrMethods.isSet("chan1")
+	tassert.True(isSet)
+	mockAPI.AssertNumberOfCalls(t, "KVGet", 1)
+
+	// Changes made through this server are seen at once
+	changed, appErr := p.ChanEncrMethods.setIfDifferent("chan1", ChanEncryptionMethodNone)
+	tassert.Nil(appErr)
+	tassert.True(changed)
+	tassert.Equal(ChanEncryptionMethodNone, p.ChanEncrMethods.get("chan1"))
+	mockAPI.AssertNumberOfCalls(t, "KVGet", 2)
+
+	stats := p.GetCacheStats()[0]
+	tassert.Equal(uint64(3), stats.Hits)
+	tassert.Equal(uint64(1), stats.Misses)
+}
+
+func Test_cache_pubKey(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{CacheTTLSeconds: 60})
+	tassert := assert.New(t)
+
+	key := GenerateValidPubKey()
+	keyJSON, _ := json.Marshal(NewPubKeyRecord(&key))
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(nil, nil).Once()
+	mockAPI.On("KVSet", StoreKeyPubKey("user1"), keyJSON).Return(nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(keyJSON, nil).Once()
+
+	pubkey, err := p.GetUserPubKey("user1")
+	tassert.Nil(err)
+	tassert.Nil(pubkey)
+	pubkey, _ = p.GetUserPubKey("user1")
+	tassert.Nil(pubkey)
+
+	tassert.Nil(p.SetUserPubKey("user1", &key))
+	pubkey, _ = p.GetUserPubKey("user1")
+	tassert.Equal(&key, pubkey)
+	pubkey, _ = p.GetUserPubKey("user1")
+	tassert.Equal(&key, pubkey)
+	mockAPI.AssertNumberOfCalls(t, "KVGet", 2)
+}
+
+func Test_cache_botFlag(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{CacheTTLSeconds: 60})
+	tassert := assert.New(t)
+
+	mockAPI.On("GetUser", "bot1").Return(&model.User{Id: "bot1", Username: "ci", IsBot: true}, nil)
+	rule := &PostingRule{Action: PostingRuleAllow, BotUsername: "ci"}
+	for i := 0; i < 3; i++ {
+		matches, appErr := rule.matches(&postingRuleSubject{p: &p, post: &model.Post{UserId: "bot1"}})
+		tassert.Nil(appErr)
+		tassert.True(matches)
+	}
+	mockAPI.AssertNumberOfCalls(t, "GetUser", 1)
+}
+
+func Test_cache_disabledOnCluster(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	tassert := assert.New(t)
+
+	mockAPI.On("LoadPluginConfiguration", mock.AnythingOfType("*main.configuration")).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(0).(*configuration).CacheTTLSeconds = 60
+	})
+	clusterEnabled := false
+	mockAPI.On("GetConfig").Return(func() *model.Config {
+		return &model.Config{ClusterSettings: model.ClusterSettings{Enable: &clusterEnabled}}
+	})
+
+	tassert.Nil(p.OnConfigurationChange())
+	tassert.Equal(60*time.Second, p.cacheTTL())
+
+	clusterEnabled = true
+	tassert.Nil(p.OnConfigurationChange())
+	tassert.Equal(time.Duration(0), p.cacheTTL())
+}
+
+func Test_plugin_ServeHTTP_GetCacheStats(t *testing.T) {
+	mockAPI := plugintest.API{}
+	mockAPI.On("HasPermissionTo", "admin", model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	mockAPI.On("HasPermissionTo", "user1", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+
+	tests := []TestDesc{
+		{
+			name: "admin",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    "/api/v1/admin/cache_stats",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body: []CacheStats{
+					{Name: "channel encryption methods"},
+					{Name: "public keys"},
+					{Name: "bot flags"},
+					{Name: "posting rules"},
+				},
+			},
+			userID: "admin",
+		},
+		{
+			name: "not admin",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    "/api/v1/admin/cache_stats",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			userID: "user1",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 	"github.com/mattermost/mattermost-server/v5/plugin"
@@ -11,19 +14,65 @@ import (
 
 type ChanEncryptionMethod int
 
+// membersReportTimeout bounds the time spent looking for members without keys
+// when encryption is turned on, so that the announcement is posted before the
+// request that turned it on times out.
+const membersReportTimeout = 3 * time.Second
+
 const (
 	ChanEncryptionMethodNone ChanEncryptionMethod = 0
 	ChanEncryptionMethodP2P  ChanEncryptionMethod = 1
+	// Unencrypted messages are allowed, but the ones that would be rejected
+	// are recorded
+	ChanEncryptionMethodMonitor ChanEncryptionMethod = 2
 )
 
+// IsEncrypted returns whether messages must be encrypted with this method.
+func (m ChanEncryptionMethod) IsEncrypted() bool {
+	return m == ChanEncryptionMethodP2P
+}
+
+// ChanEncryptionMethodKeyPrefix starts the KV keys of channel encryption
+// methods, which end with the channel ID.
+const ChanEncryptionMethodKeyPrefix = "chanEncrMethod:"
+
 func ChanEncryptionMethodKey(chanID string) string {
-	return fmt.Sprintf("chanEncrMethod:%s", chanID)
+	return ChanEncryptionMethodKeyPrefix + chanID
+}
+
+// ChanEncryptionChangeKey is where the last change of the encryption method
+// of chanID is recorded.
+func ChanEncryptionChangeKey(chanID string) string {
+	return fmt.Sprintf("chanEncrChange:%s", chanID)
+}
+
+// ChanEncryptionChange records who set the encryption method of a channel.
+type ChanEncryptionChange struct {
+	Method string `json:"method"`
+	// Empty if set by the default encryption policy
+	UserID string `json:"userID"`
+	At     int64  `json:"at"`
+}
+
+func (p *Plugin) GetChanEncryptionChange(chanID string) (*ChanEncryptionChange, *model.AppError) {
+	data, appErr := p.API.KVGet(ChanEncryptionChangeKey(chanID))
+	if appErr != nil || data == nil {
+		return nil, appErr
+	}
+	var ret ChanEncryptionChange
+	err := json.Unmarshal(data, &ret)
+	if err != nil {
+		return nil, model.NewAppError("GetChanEncryptionChange", "mm-e2ee.invalid_encryption_change", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return &ret, nil
 }
 
 func ChanEncryptionMethodString(m ChanEncryptionMethod) string {
 	switch m {
 	case ChanEncryptionMethodP2P:
 		return "p2p"
+	case ChanEncryptionMethodMonitor:
+		return "monitor"
 	case ChanEncryptionMethodNone:
 		return "none"
 	default:
@@ -35,6 +84,8 @@ func ChanEncryptionMethodFromString(m string) ChanEncryptionMethod {
 	switch m {
 	case "p2p":
 		return ChanEncryptionMethodP2P
+	case "monitor":
+		return ChanEncryptionMethodMonitor
 	case "none":
 		return ChanEncryptionMethodNone
 	default:
@@ -45,55 +96,194 @@ func ChanEncryptionMethodFromString(m string) ChanEncryptionMethod {
 type ChanEncrMethodDB struct {
 	mutex sync.RWMutex
 	API   plugin.API
+	// Cache of cachedChanMethod by KV key, disabled if nil
+	cache *ttlCache
 }
 
 func NewChanEncrMethodDB(api plugin.API) *ChanEncrMethodDB {
 	return &ChanEncrMethodDB{mutex: sync.RWMutex{}, API: api}
 }
 
+// cachedChanMethod is what is known of the encryption method of a channel.
+type cachedChanMethod struct {
+	method ChanEncryptionMethod
+	isSet  bool
+}
+
+// load reads the encryption method of chanID from the cache, or from the KV
+// store if it isn't cached. Must be called with db.mutex held.
+func (db *ChanEncrMethodDB) load(chanID string) (cachedChanMethod, *model.AppError) {
+	key := ChanEncryptionMethodKey(chanID)
+	if cached, ok := db.cache.get(key); ok {
+		return cached.(cachedChanMethod), nil
+	}
+	method, appErr := db.API.KVGet(key)
+	if appErr != nil {
+		return cachedChanMethod{}, appErr
+	}
+	ret := cachedChanMethod{method: ChanEncryptionMethodNone, isSet: method != nil}
+	if method != nil && json.Unmarshal(method, &ret.method) != nil {
+		ret.method = ChanEncryptionMethodNone
+	}
+	db.cache.set(key, ret)
+	return ret, nil
+}
+
 func (db *ChanEncrMethodDB) get(chanID string) ChanEncryptionMethod {
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
-	method, appErr := db.API.KVGet(ChanEncryptionMethodKey(chanID))
-	if method == nil || appErr != nil {
+	cached, appErr := db.load(chanID)
+	if appErr != nil {
 		return ChanEncryptionMethodNone
 	}
-	var ret ChanEncryptionMethod
-	err := json.Unmarshal(method, &ret)
-	if err != nil {
-		return ChanEncryptionMethodNone
+	return cached.method
+}
+
+// isSet returns whether an encryption method has ever been set for chanID.
+func (db *ChanEncrMethodDB) isSet(chanID string) (bool, *model.AppError) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	cached, appErr := db.load(chanID)
+	if appErr != nil {
+		return false, appErr
 	}
-	return ret
+	return cached.isSet, nil
 }
 
+// setIfDifferent sets the encryption method of chanID to newMethod, and
+// returns whether it changed. The update is atomic, so that when several
+// servers of a cluster concurrently set the same method, only one of them
+// sees it changing.
 func (db *ChanEncrMethodDB) setIfDifferent(chanID string, newMethod ChanEncryptionMethod) (bool, *model.AppError) {
+	// The mutex only keeps the cache of this server consistent with the KV
+	// store
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	// TODO: KVCompareAndUpdate does not seem to return true if the key doesn't
-	// exist. Using a mutex here waiting for better...
 	key := ChanEncryptionMethodKey(chanID)
-	omJS, appErr := db.API.KVGet(key)
+	changed, existed := false, false
+	appErr := kvAtomicUpdateWithAPI(db.API, key, func(omJS []byte) ([]byte, *model.AppError) {
+		changed, existed = false, omJS != nil
+		oldMethod := ChanEncryptionMethodNone
+		if omJS != nil {
+			err := json.Unmarshal(omJS, &oldMethod)
+			if err != nil {
+				return nil, model.NewAppError("setIfDifferent", "mm-e2ee.invalid_encryption_method", nil, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		if newMethod == oldMethod {
+			return nil, nil
+		}
+		changed = true
+		nmJS, _ := json.Marshal(newMethod)
+		return nmJS, nil
+	})
 	if appErr != nil {
+		db.cache.invalidate(key)
 		return false, appErr
 	}
-	var oldMethod ChanEncryptionMethod
-	if omJS == nil {
-		oldMethod = ChanEncryptionMethodNone
-	} else {
-		err := json.Unmarshal(omJS, &oldMethod)
-		if err != nil {
-			return false, &model.AppError{}
+	db.cache.set(key, cachedChanMethod{method: newMethod, isSet: changed || existed})
+	return changed, nil
+}
+
+// SetChanEncryptionMethodAndNotify sets the encryption method of a channel on
+// behalf of setByUserID, or of the default encryption policy if setByUserID is
+// empty. If the method changed, channel members are notified through a
+// websocket event and a post from our bot. It returns whether the method
+// actually changed.
+func (p *Plugin) SetChanEncryptionMethodAndNotify(chanID string, setByUserID string, method ChanEncryptionMethod) (bool, *model.AppError) {
+	guestPolicy := GuestPolicyAllow
+	var report *ChannelMembersReport
+	if method.IsEncrypted() {
+		var appErr *model.AppError
+		guestPolicy, appErr = p.GetGuestPolicy(chanID)
+		if appErr != nil {
+			return false, appErr
+		}
+		if guestPolicy == GuestPolicyRefuse {
+			report, appErr = p.GetChannelMembersReport(chanID)
+			if appErr != nil {
+				return false, appErr
+			}
+			appErr = checkGuestPolicy(guestPolicy, report)
+			if appErr != nil {
+				return false, appErr
+			}
 		}
 	}
-	if newMethod == oldMethod {
-		return false, nil
+
+	changed, appErr := p.ChanEncrMethods.setIfDifferent(chanID, method)
+	if appErr != nil || !changed {
+		return false, appErr
 	}
-	nmJS, _ := json.Marshal(newMethod)
-	appErr = db.API.KVSet(key, nmJS)
+
+	change, _ := json.Marshal(ChanEncryptionChange{
+		Method: ChanEncryptionMethodString(method),
+		UserID: setByUserID,
+		At:     model.GetMillis(),
+	})
+	appErr = p.API.KVSet(ChanEncryptionChangeKey(chanID), change)
 	if appErr != nil {
-		return false, appErr
+		p.API.LogError("unable to record encryption method change", "channel_id", chanID, "error", appErr.Error())
+	}
+
+	p.API.PublishWebSocketEvent("channelStateChanged",
+		map[string]interface{}{
+			"chanID": chanID,
+			"method": ChanEncryptionMethodString(method),
+		},
+		&model.WebsocketBroadcast{ChannelId: chanID})
+
+	setBy := "the default encryption policy"
+	if setByUserID != "" {
+		user, appErr := p.API.GetUser(setByUserID)
+		if appErr != nil {
+			return true, appErr
+		}
+		setBy = "@" + user.Username
+	}
+
+	if method == ChanEncryptionMethodMonitor {
+		appErr = p.ResetMonitorReport(chanID)
+		if appErr != nil {
+			return true, appErr
+		}
+	}
+
+	var msg string
+	switch method {
+	case ChanEncryptionMethodNone:
+		msg = fmt.Sprintf("@all: messages on this channel **aren't encrypted anymore**. Set by %s", setBy)
+	case ChanEncryptionMethodMonitor:
+		msg = fmt.Sprintf("@all: this channel is now in **monitor** mode. Set by %s. Messages are not encrypted yet, but the ones that would be rejected once encryption is enforced are recorded. Channel admins can see them with `/e2ee monitor_report`.", setBy)
+	default:
+		msg = fmt.Sprintf("@all: message on this channel are now encrypted. Set by %s. Please note that **people not in this channel won't be able to read the backlog**.", setBy)
+		if report == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), membersReportTimeout)
+			report, appErr = p.GetChannelMembersReportWithin(ctx, chanID)
+			cancel()
+			if appErr != nil {
+				return true, appErr
+			}
+		}
+		if len(report.WithoutKeys) > 0 {
+			msg += "\n**WARNING**: these people in the channel do not have setup an encryption key, and therefore won't be able to read messages: " + report.Mentions(report.WithoutKeys)
+		}
+		if report.Incomplete {
+			msg += "\n**WARNING**: this channel has too many members to check them all. Run `/e2ee who` to see who can't read messages."
+		}
+		if guestPolicy == GuestPolicyWarn && len(report.Guests) > 0 {
+			msg += "\n**WARNING**: these people in the channel are guests: " + report.Mentions(report.Guests)
+		}
+	}
+
+	post := &model.Post{
+		Message:   msg,
+		UserId:    p.BotUserID,
+		ChannelId: chanID,
 	}
-	return true, nil
+	_, appErr = p.API.CreatePost(post)
+	return true, appErr
 }
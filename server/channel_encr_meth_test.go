@@ -6,6 +6,7 @@ import (
 
 	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func Test_chanencrmeth_set_noexist(t *testing.T) {
@@ -16,7 +17,7 @@ func Test_chanencrmeth_set_noexist(t *testing.T) {
 
 	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(nil, nil)
 	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
-	mockAPI.On("KVSet", ChanEncryptionMethodKey(chanID), p2p).Return(nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(chanID), p2p, mock.Anything).Return(true, nil)
 
 	changed, err := db.setIfDifferent(chanID, ChanEncryptionMethodP2P)
 	tassert.Nil(err)
@@ -32,7 +33,7 @@ func Test_chanencrmeth_set_different(t *testing.T) {
 	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
 	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(p2p, nil)
 	none, _ := json.Marshal(ChanEncryptionMethodNone)
-	mockAPI.On("KVSet", ChanEncryptionMethodKey(chanID), none).Return(nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(chanID), none, mock.Anything).Return(true, nil)
 
 	changed, _ := db.setIfDifferent(chanID, ChanEncryptionMethodNone)
 	tassert.Equal(changed, true)
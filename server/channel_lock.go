@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+
+	root "github.com/quarkslab/mattermost-plugin-e2ee"
+)
+
+// PendingChanEncrMethodChangeTTL is the number of seconds after which a
+// pending change of a locked channel expires if nobody approved it.
+const PendingChanEncrMethodChangeTTL = 24 * 60 * 60
+
+// PendingChanEncrMethodChange is a request to change the encryption method of
+// a locked channel, waiting for the approval of a second authorized member.
+type PendingChanEncrMethodChange struct {
+	ID          string               `json:"id"`
+	RequesterID string               `json:"requesterID"`
+	Method      ChanEncryptionMethod `json:"method"`
+	CreateAt    int64                `json:"createAt"`
+}
+
+func PendingChanEncrMethodChangeKey(chanID string) string {
+	return fmt.Sprintf("pendingChanEncrMethod:%s", chanID)
+}
+
+func (p *Plugin) GetPendingChanEncrMethodChange(chanID string) (*PendingChanEncrMethodChange, *model.AppError) {
+	data, appErr := p.API.KVGet(PendingChanEncrMethodChangeKey(chanID))
+	if appErr != nil || data == nil {
+		return nil, appErr
+	}
+	var ret PendingChanEncrMethodChange
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, model.NewAppError("GetPendingChanEncrMethodChange", "mm-e2ee.invalid_pending_change", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return &ret, nil
+}
+
+// SetChanEncryptionLock locks or unlocks the encryption state of a channel,
+// and tells the channel about it.
+func (p *Plugin) SetChanEncryptionLock(chanID string, userID string, locked bool) *model.AppError {
+	allowed, appErr := p.CanManageChanEncryption(chanID, userID)
+	if appErr != nil {
+		return appErr
+	}
+	if !allowed {
+		return model.NewAppError("SetChanEncryptionLock", "mm-e2ee.not_allowed", nil, "only channel and system admins can lock or unlock channel encryption", http.StatusForbidden)
+	}
+
+	changed, appErr := p.UpdateChanSettings(chanID, func(settings *ChanSettings) bool {
+		if settings.Locked == locked {
+			return false
+		}
+		settings.Locked = locked
+		return true
+	})
+	if appErr != nil || !changed {
+		return appErr
+	}
+	if !locked {
+		// A pending change makes no sense on an unlocked channel
+		_ = p.API.KVDelete(PendingChanEncrMethodChangeKey(chanID))
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+	var msg string
+	if locked {
+		msg = fmt.Sprintf("Encryption on this channel has been **locked** by @%s. Disabling it now requires the approval of another channel admin.", user.Username)
+	} else {
+		msg = fmt.Sprintf("Encryption on this channel has been **unlocked** by @%s.", user.Username)
+	}
+	_, appErr = p.API.CreatePost(&model.Post{
+		Message:   msg,
+		UserId:    p.BotUserID,
+		ChannelId: chanID,
+	})
+	return appErr
+}
+
+// RequestOrSetChanEncryptionMethod sets the encryption method of chanID on
+// behalf of userID, unless that would stop enforcing encryption on a locked
+// channel. In this case, a change request is created instead and pending is
+// true.
+func (p *Plugin) RequestOrSetChanEncryptionMethod(chanID string, userID string, method ChanEncryptionMethod) (changed bool, pending bool, appErr *model.AppError) {
+	if !method.IsEncrypted() && p.ChanEncrMethods.get(chanID).IsEncrypted() {
+		settings, appErr := p.GetChanSettings(chanID)
+		if appErr != nil {
+			return false, false, appErr
+		}
+		if settings.Locked {
+			return false, true, p.RequestChanEncryptionMethodChange(chanID, userID, method)
+		}
+	}
+
+	changed, appErr = p.SetChanEncryptionMethodAndNotify(chanID, userID, method)
+	return changed, false, appErr
+}
+
+// RequestChanEncryptionMethodChange records a pending change of the
+// encryption method of a locked channel, and posts an interactive message
+// asking for its approval. It fails if another change is already pending.
+func (p *Plugin) RequestChanEncryptionMethodChange(chanID string, userID string, method ChanEncryptionMethod) *model.AppError {
+	pending := &PendingChanEncrMethodChange{
+		ID:          model.NewId(),
+		RequesterID: userID,
+		Method:      method,
+		CreateAt:    model.GetMillis(),
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return model.NewAppError("RequestChanEncryptionMethodChange", "mm-e2ee.invalid_pending_change", nil, err.Error(), http.StatusInternalServerError)
+	}
+	// Only one request can be pending at a time
+	ok, appErr := p.API.KVSetWithOptions(PendingChanEncrMethodChangeKey(chanID), data, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: PendingChanEncrMethodChangeTTL,
+	})
+	if appErr != nil {
+		return appErr
+	}
+	if !ok {
+		return model.NewAppError("RequestChanEncryptionMethodChange", "mm-e2ee.change_pending", nil, "another change of the encryption mode of this channel is already waiting for approval", http.StatusConflict)
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+
+	url := fmt.Sprintf("/plugins/%s/api/v1/channel/encryption_change", root.Manifest.Id)
+	actionContext := map[string]interface{}{
+		"chanID":    chanID,
+		"requestID": pending.ID,
+	}
+	post := &model.Post{
+		UserId:    p.BotUserID,
+		ChannelId: chanID,
+	}
+	model.ParseSlackAttachment(post, []*model.SlackAttachment{{
+		Text: fmt.Sprintf("@%s wants to set the encryption mode of this **locked** channel to '%s'. Another channel admin needs to approve this change within 24 hours.",
+			user.Username, ChanEncryptionMethodString(method)),
+		Actions: []*model.PostAction{
+			{
+				Id:    "approve",
+				Name:  "Approve",
+				Type:  model.POST_ACTION_TYPE_BUTTON,
+				Style: "danger",
+				Integration: &model.PostActionIntegration{
+					URL:     url,
+					Context: withAction(actionContext, "approve"),
+				},
+			},
+			{
+				Id:   "reject",
+				Name: "Reject",
+				Type: model.POST_ACTION_TYPE_BUTTON,
+				Integration: &model.PostActionIntegration{
+					URL:     url,
+					Context: withAction(actionContext, "reject"),
+				},
+			},
+		},
+	}})
+	_, appErr = p.API.CreatePost(post)
+	return appErr
+}
+
+func withAction(ctx map[string]interface{}, action string) map[string]interface{} {
+	ret := make(map[string]interface{}, len(ctx)+1)
+	for k, v := range ctx {
+		ret[k] = v
+	}
+	ret["action"] = action
+	return ret
+}
+
+// ResolveChanEncryptionMethodChange approves or rejects the pending change
+// requestID of chanID on behalf of userID. It returns whether the request has
+// been resolved, and a message to show to userID.
+func (p *Plugin) ResolveChanEncryptionMethodChange(chanID string, requestID string, userID string, approve bool) (bool, string, *model.AppError) {
+	const handledMsg = "This change request has expired or has already been handled."
+	pending, appErr := p.GetPendingChanEncrMethodChange(chanID)
+	if appErr != nil {
+		return false, "", appErr
+	}
+	if pending == nil || pending.ID != requestID {
+		return false, handledMsg, nil
+	}
+
+	allowed, appErr := p.CanManageChanEncryption(chanID, userID)
+	if appErr != nil {
+		return false, "", appErr
+	}
+	if !allowed {
+		return false, "Only channel and system admins can handle this request.", nil
+	}
+	if approve && userID == pending.RequesterID {
+		return false, "This change must be approved by someone else.", nil
+	}
+
+	// Make sure only one member handles this request
+	ok, appErr := p.API.KVCompareAndDelete(PendingChanEncrMethodChangeKey(chanID), mustMarshalJSON(pending))
+	if appErr != nil {
+		return false, "", appErr
+	}
+	if !ok {
+		return false, handledMsg, nil
+	}
+	if !approve {
+		return true, "Change rejected.", nil
+	}
+
+	_, appErr = p.SetChanEncryptionMethodAndNotify(chanID, pending.RequesterID, pending.Method)
+	if appErr != nil {
+		return true, "", appErr
+	}
+	return true, "Change approved.", nil
+}
+
+func mustMarshalJSON(v interface{}) []byte {
+	ret, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+type ChanEncryptionLockResponse struct {
+	Locked bool `json:"locked"`
+}
+
+func (p *Plugin) GetChanEncryptionLock(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+
+	// Check user is in channel
+	_, appErr := p.API.GetChannelMember(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	settings, appErr := p.GetChanSettings(chanID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, ChanEncryptionLockResponse{settings.Locked})
+}
+
+func (p *Plugin) SetChanEncryptionLockHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+	locked, err := strconv.ParseBool(r.URL.Query().Get("locked"))
+	if err != nil {
+		http.Error(w, "invalid locked value", http.StatusBadRequest)
+		return
+	}
+
+	// Check user is in channel
+	_, appErr := p.API.GetChannelMember(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	appErr = p.SetChanEncryptionLock(chanID, c.UserID, locked)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
+
+// HandleChanEncryptionChangeAction is called by the Mattermost server when a
+// button of the approval post created by RequestChanEncryptionMethodChange is
+// clicked.
+func (p *Plugin) HandleChanEncryptionChangeAction(c *Context, w http.ResponseWriter, r *http.Request) {
+	req := model.PostActionIntegrationRequestFromJson(r.Body)
+	if req == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	chanID, _ := req.Context["chanID"].(string)
+	requestID, _ := req.Context["requestID"].(string)
+	action, _ := req.Context["action"].(string)
+
+	resolved, msg, appErr := p.ResolveChanEncryptionMethodChange(chanID, requestID, c.UserID, action == "approve")
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+
+	resp := &model.PostActionIntegrationResponse{EphemeralText: msg}
+	if resolved {
+		// Remove the buttons from the approval post
+		post, appErr := p.API.GetPost(req.PostId)
+		user, appErrU := p.API.GetUser(c.UserID)
+		if appErr == nil && appErrU == nil {
+			post.DelProp("attachments")
+			post.Message = fmt.Sprintf("%s (@%s)", msg, user.Username)
+			resp.Update = post
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, resp)
+}
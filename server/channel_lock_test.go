@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_plugin_ServeHTTP_SetChannelEncryptionMethodLocked(t *testing.T) {
+	const chanID = "chan1"
+	const userID = "user1"
+
+	mockAPI := plugintest.API{}
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	locked, _ := json.Marshal(ChanSettings{Locked: true})
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanSettingsKey(chanID)).Return(locked, nil)
+	mockAPI.On("KVSetWithOptions", PendingChanEncrMethodChangeKey(chanID), mock.AnythingOfType("[]uint8"), model.PluginKVSetOptions{Atomic: true, ExpireInSeconds: PendingChanEncrMethodChangeTTL}).Return(true, nil)
+	mockAPIUserInChan(&mockAPI, chanID, userID)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	apiURL := "/api/v1/channel/encryption_method"
+
+	tests := []TestDesc{
+		{
+			name: "success",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL + "?chanID=" + chanID + "&method=none",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+			},
+			userID: userID,
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+
+	// The method must not have been changed
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", ChanEncryptionMethodKey(chanID), mock.Anything, mock.Anything)
+}
+
+func Test_chanlock_onePendingRequest(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+
+	kv.data[ChanEncryptionMethodKey("chan1")], _ = json.Marshal(ChanEncryptionMethodP2P)
+	kv.data[ChanSettingsKey("chan1")], _ = json.Marshal(ChanSettings{Locked: true})
+	mockAPI.On("GetUser", mock.Anything).Return(&model.User{Username: "user"}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	_, pending, appErr := p.RequestOrSetChanEncryptionMethod("chan1", "user1", ChanEncryptionMethodNone)
+	tassert.Nil(appErr)
+	tassert.True(pending)
+	first, _ := p.GetPendingChanEncrMethodChange("chan1")
+
+	_, _, appErr = p.RequestOrSetChanEncryptionMethod("chan1", "user2", ChanEncryptionMethodNone)
+	tassert.NotNil(appErr)
+	tassert.Equal(http.StatusConflict, appErr.StatusCode)
+	second, _ := p.GetPendingChanEncrMethodChange("chan1")
+	tassert.Equal(first, second)
+	mockAPI.AssertNumberOfCalls(t, "CreatePost", 1)
+}
+
+func Test_chanlock_concurrentSettings(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	locker, _ := newTestNode(kv)
+	strict, _ := newTestNode(kv)
+
+	// Both servers read the settings before any of them writes them
+	kv.syncFirstReads(2)
+	var wg sync.WaitGroup
+	for _, update := range []func(){
+		func() {
+			_, appErr := locker.UpdateChanSettings("chan1", func(settings *ChanSettings) bool {
+				settings.Locked = true
+				return true
+			})
+			tassert.Nil(appErr)
+		},
+		func() {
+			_, appErr := strict.UpdateChanSettings("chan1", func(settings *ChanSettings) bool {
+				settings.Strict = true
+				return true
+			})
+			tassert.Nil(appErr)
+		},
+	} {
+		wg.Add(1)
+		go func(update func()) {
+			defer wg.Done()
+			update()
+		}(update)
+	}
+	wg.Wait()
+
+	settings, appErr := locker.GetChanSettings("chan1")
+	tassert.Nil(appErr)
+	tassert.Equal(&ChanSettings{Locked: true, Strict: true}, settings)
+}
+
+func Test_plugin_ServeHTTP_SetChannelEncryptionLockNotAdmin(t *testing.T) {
+	const chanID = "chan1"
+	const userID = "user1"
+
+	mockAPI := plugintest.API{}
+	mockAPI.On("GetChannelMember", chanID, userID).Return(&model.ChannelMember{}, nil)
+	mockAPI.On("HasPermissionTo", userID, model.PERMISSION_MANAGE_SYSTEM).Return(false)
+
+	apiURL := "/api/v1/channel/encryption_lock"
+
+	tests := []TestDesc{
+		{
+			name: "fail",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL + "?chanID=" + chanID + "&locked=true",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			userID: userID,
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
+
+func mockAPIPendingChange(mockAPI *plugintest.API, chanID string, pending *PendingChanEncrMethodChange) {
+	pendingJSON, _ := json.Marshal(pending)
+	mockAPI.On("KVGet", PendingChanEncrMethodChangeKey(chanID)).Return(pendingJSON, nil)
+	mockAPI.On("KVCompareAndDelete", PendingChanEncrMethodChangeKey(chanID), pendingJSON).Return(true, nil)
+}
+
+func Test_chanlock_approve_self(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	pending := &PendingChanEncrMethodChange{ID: "req1", RequesterID: "user1", Method: ChanEncryptionMethodNone}
+	mockAPIPendingChange(&mockAPI, chanID, pending)
+	mockAPI.On("GetChannelMember", chanID, "user1").Return(&model.ChannelMember{SchemeAdmin: true}, nil)
+
+	resolved, _, appErr := p.ResolveChanEncryptionMethodChange(chanID, "req1", "user1", true)
+	tassert.Nil(appErr)
+	tassert.False(resolved)
+	mockAPI.AssertNotCalled(t, "KVCompareAndDelete", mock.Anything, mock.Anything)
+}
+
+func Test_chanlock_approve_expired(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	mockAPI.On("KVGet", PendingChanEncrMethodChangeKey(chanID)).Return(nil, nil)
+
+	resolved, _, appErr := p.ResolveChanEncryptionMethodChange(chanID, "req1", "user2", true)
+	tassert.Nil(appErr)
+	tassert.False(resolved)
+}
+
+func Test_chanlock_approve(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	pending := &PendingChanEncrMethodChange{ID: "req1", RequesterID: "user1", Method: ChanEncryptionMethodNone}
+	mockAPIPendingChange(&mockAPI, chanID, pending)
+	mockAPI.On("GetChannelMember", chanID, "user2").Return(&model.ChannelMember{SchemeAdmin: true}, nil)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	none, _ := json.Marshal(ChanEncryptionMethodNone)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(p2p, nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(chanID), none, mock.Anything).Return(true, nil)
+	mockAPI.On("KVSet", ChanEncryptionChangeKey(chanID), mock.AnythingOfType("[]uint8")).Return(nil)
+	mockAPI.On("PublishWebSocketEvent", "channelStateChanged", mock.Anything, mock.Anything).Return()
+	mockAPI.On("GetUser", "user1").Return(&model.User{Username: "user1"}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	resolved, _, appErr := p.ResolveChanEncryptionMethodChange(chanID, "req1", "user2", true)
+	tassert.Nil(appErr)
+	tassert.True(resolved)
+	mockAPI.AssertCalled(t, "KVSetWithOptions", ChanEncryptionMethodKey(chanID), none, mock.Anything)
+}
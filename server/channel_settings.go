@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// ChanSettings holds the per-channel E2EE settings, aside from the encryption
+// method itself.
+type ChanSettings struct {
+	// Locked requires a second authorized member to approve disabling
+	// encryption.
+	Locked bool `json:"locked"`
+	// Strict removes members without a key from the channel while it is
+	// encrypted.
+	Strict bool `json:"strict"`
+	// VerifiedOnly rejects encrypted posts for keys that neither the sender
+	// nor a channel admin have verified.
+	VerifiedOnly bool `json:"verifiedOnly"`
+	// MuteKeyChanges stops posting a notice when the key of a member changes.
+	MuteKeyChanges bool `json:"muteKeyChanges"`
+}
+
+func ChanSettingsKey(chanID string) string {
+	return fmt.Sprintf("chanSettings:%s", chanID)
+}
+
+func (p *Plugin) GetChanSettings(chanID string) (*ChanSettings, *model.AppError) {
+	data, appErr := p.API.KVGet(ChanSettingsKey(chanID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &ChanSettings{}
+	if data == nil {
+		return ret, nil
+	}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, model.NewAppError("GetChanSettings", "mm-e2ee.invalid_chan_settings", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// UpdateChanSettings atomically applies update to the settings of chanID.
+// update returns whether it modified them, which is returned.
+func (p *Plugin) UpdateChanSettings(chanID string, update func(settings *ChanSettings) bool) (bool, *model.AppError) {
+	changed := false
+	appErr := p.kvAtomicUpdate(ChanSettingsKey(chanID), func(old []byte) ([]byte, *model.AppError) {
+		settings := &ChanSettings{}
+		if old != nil {
+			if err := json.Unmarshal(old, settings); err != nil {
+				return nil, model.NewAppError("UpdateChanSettings", "mm-e2ee.invalid_chan_settings", nil, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		changed = update(settings)
+		if !changed {
+			return nil, nil
+		}
+		data, err := json.Marshal(settings)
+		if err != nil {
+			return nil, model.NewAppError("UpdateChanSettings", "mm-e2ee.invalid_chan_settings", nil, err.Error(), http.StatusInternalServerError)
+		}
+		return data, nil
+	})
+	if appErr != nil {
+		return false, appErr
+	}
+	return changed, nil
+}
+
+// CanManageChanEncryption returns whether userID is allowed to change the
+// sensitive E2EE settings of a channel (like its lock). Channel admins and
+// system admins are.
+func (p *Plugin) CanManageChanEncryption(chanID string, userID string) (bool, *model.AppError) {
+	member, appErr := p.API.GetChannelMember(chanID, userID)
+	if appErr != nil {
+		return false, appErr
+	}
+	if member.SchemeAdmin {
+		return true, nil
+	}
+	return p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM), nil
+}
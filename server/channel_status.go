@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// SetChanEncryptionMethodOfUser sets the encryption method of chanID on behalf
+// of userID, who must be a member of the channel, like the webapp does. userID
+// is told by an ephemeral post if the channel already uses method.
+func (p *Plugin) SetChanEncryptionMethodOfUser(chanID string, userID string, method ChanEncryptionMethod) *model.AppError {
+	_, appErr := p.API.GetChannelMember(chanID, userID)
+	if appErr != nil {
+		return model.NewAppError("SetChanEncryptionMethodOfUser", "mm-e2ee.not_a_member", nil, appErr.Error(), http.StatusUnauthorized)
+	}
+
+	changed, pending, appErr := p.RequestOrSetChanEncryptionMethod(chanID, userID, method)
+	if appErr != nil {
+		return appErr
+	}
+	if !changed && !pending {
+		post := &model.Post{
+			Message:   fmt.Sprintf("Channel is already on encryption mode '%s'", ChanEncryptionMethodString(method)),
+			UserId:    p.BotUserID,
+			ChannelId: chanID,
+		}
+		_ = p.API.SendEphemeralPost(userID, post)
+	}
+	return nil
+}
+
+// ChanStatus sums up the E2EE state of a channel for one of its members.
+type ChanStatus struct {
+	Method ChanEncryptionMethod
+	Locked bool
+	// Members without an encryption key
+	WithoutKeys []string
+	// Fingerprint of the key of the member, nil if they have no key
+	Fingerprint *Fingerprint
+
+	report *ChannelMembersReport
+}
+
+func (p *Plugin) GetChanStatus(chanID string, userID string) (*ChanStatus, *model.AppError) {
+	settings, appErr := p.GetChanSettings(chanID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	report, appErr := p.GetChannelMembersReport(chanID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &ChanStatus{
+		Method:      p.ChanEncrMethods.get(chanID),
+		Locked:      settings.Locked,
+		WithoutKeys: report.WithoutKeys,
+		report:      report,
+	}
+
+	pubkey, err := p.GetUserPubKey(userID)
+	if err != nil {
+		return nil, model.NewAppError("GetChanStatus", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if pubkey != nil {
+		ret.Fingerprint = NewFingerprint(userID, pubkey.ID())
+	}
+	return ret, nil
+}
+
+func (s *ChanStatus) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Encryption mode of this channel: **%s**", ChanEncryptionMethodString(s.Method))
+	if s.Locked {
+		sb.WriteString(" (locked)")
+	}
+	sb.WriteString("\n")
+	if len(s.WithoutKeys) > 0 {
+		fmt.Fprintf(&sb, "Members without an encryption key: %s\n", s.report.Mentions(s.WithoutKeys))
+	} else {
+		sb.WriteString("All members have an encryption key.\n")
+	}
+	if s.Fingerprint != nil {
+		fmt.Fprintf(&sb, "Fingerprint of your key:\n%s", s.Fingerprint.String())
+	} else {
+		sb.WriteString("You don't have an encryption key. Run `/e2ee init` to setup one.")
+	}
+	return sb.String()
+}
+
+func (p *Plugin) ExecuteStatusCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	if len(cmdArgs) != 0 {
+		return &model.AppError{Message: "usage: /e2ee status"}
+	}
+	status, appErr := p.GetChanStatus(args.ChannelId, args.UserId)
+	if appErr != nil {
+		return appErr
+	}
+	p.postCommandResponse(args, status.String())
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_channelStatus_command(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	locked, _ := json.Marshal(ChanSettings{Locked: true})
+	pubkey := GenerateValidPubKey()
+	pubkeyJSON, _ := json.Marshal(pubkey)
+	mockAPI.On("GetChannelMember", "chan1", "user1").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan1")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanSettingsKey("chan1")).Return(locked, nil)
+	mockAPI.On("GetUsersInChannel", "chan1", model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{
+		{Id: "user1", Username: "alice"},
+		{Id: "user2", Username: "bob"},
+	}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(pubkeyJSON, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user2")).Return(nil, nil)
+	var msg string
+	mockAPI.On("SendEphemeralPost", "user1", mock.AnythingOfType("*model.Post")).Return(nil).Run(func(args mock.Arguments) {
+		msg = args.Get(1).(*model.Post).Message
+	})
+
+	_, appErr := p.ExecuteCommand(nil, &model.CommandArgs{Command: "/e2ee status", ChannelId: "chan1", UserId: "user1"})
+	tassert.Nil(appErr)
+	tassert.True(strings.HasPrefix(msg, "Encryption mode of this channel: **p2p** (locked)\n"))
+	tassert.Contains(msg, "Members without an encryption key: @bob\n")
+	tassert.Contains(msg, NewFingerprint("user1", pubkey.ID()).String())
+}
+
+func Test_channelStatus_stopCommand(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	mockAPI.On("GetChannelMember", "chan1", "user1").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("GetChannelMember", "chan2", "user1").Return(nil, &model.AppError{})
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan1")).Return(nil, nil)
+	mockAPI.On("SendEphemeralPost", "user1", mock.AnythingOfType("*model.Post")).Return(nil)
+
+	// Encryption is already disabled
+	_, appErr := p.ExecuteCommand(nil, &model.CommandArgs{Command: "/e2ee stop", ChannelId: "chan1", UserId: "user1"})
+	tassert.Nil(appErr)
+	mockAPI.AssertCalled(t, "SendEphemeralPost", "user1", mock.MatchedBy(func(post *model.Post) bool {
+		return post.Message == "Channel is already on encryption mode 'none'"
+	}))
+
+	_, appErr = p.ExecuteCommand(nil, &model.CommandArgs{Command: "/e2ee start", ChannelId: "chan2", UserId: "user1"})
+	tassert.NotNil(appErr)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testKVStore is an in-memory KV store shared by the servers of a simulated
+// cluster, with the semantics of the server one for atomic updates.
+type testKVStore struct {
+	lock sync.Mutex
+	data map[string][]byte
+
+	// The first syncReads reads wait for each other, so that concurrent
+	// updates all start from the same value
+	syncReads int
+	reads     int
+	readers   sync.WaitGroup
+}
+
+func newTestKVStore() *testKVStore {
+	return &testKVStore{data: make(map[string][]byte)}
+}
+
+// syncFirstReads makes the next n reads wait until all of them happened.
+func (s *testKVStore) syncFirstReads(n int) {
+	s.syncReads = n
+	s.reads = 0
+	s.readers.Add(n)
+}
+
+func (s *testKVStore) get(key string) []byte {
+	s.lock.Lock()
+	value := s.data[key]
+	s.reads++
+	wait := s.reads <= s.syncReads
+	s.lock.Unlock()
+	if wait {
+		s.readers.Done()
+		s.readers.Wait()
+	}
+	return value
+}
+
+func (s *testKVStore) setWithOptions(key string, value []byte, options model.PluginKVSetOptions) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if options.Atomic && !bytes.Equal(s.data[key], options.OldValue) {
+		return false
+	}
+	if value == nil {
+		delete(s.data, key)
+	} else {
+		s.data[key] = value
+	}
+	return true
+}
+
+func (s *testKVStore) set(key string, value []byte) *model.AppError {
+	s.setWithOptions(key, value, model.PluginKVSetOptions{})
+	return nil
+}
+
+func (s *testKVStore) delete(key string) *model.AppError {
+	return s.set(key, nil)
+}
+
+func (s *testKVStore) list(page int, perPage int) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	start, end := page*perPage, (page+1)*perPage
+	if start > len(keys) {
+		start = len(keys)
+	}
+	if end > len(keys) {
+		end = len(keys)
+	}
+	return keys[start:end]
+}
+
+// mock makes the KV calls of api use the store.
+func (s *testKVStore) mock(api *plugintest.API) {
+	api.On("KVGet", mock.AnythingOfType("string")).Return(s.get, nil)
+	api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(s.set)
+	api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(s.setWithOptions, nil)
+	api.On("KVDelete", mock.AnythingOfType("string")).Return(s.delete)
+	api.On("KVList", mock.AnythingOfType("int"), mock.AnythingOfType("int")).Return(s.list, nil)
+}
+
+// newTestNode returns a plugin acting as a server of a cluster whose KV store
+// is kv.
+func newTestNode(kv *testKVStore) (*Plugin, *plugintest.API) {
+	mockAPI := &plugintest.API{}
+	kv.mock(mockAPI)
+	p := &Plugin{BotUserID: "bot"}
+	p.SetAPI(mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{CacheTTLSeconds: 60, clusterEnabled: true})
+	return p, mockAPI
+}
+
+func Test_cluster_concurrentChanEncrMethod(t *testing.T) {
+	tassert := assert.New(t)
+	const nodes = 4
+	kv := newTestKVStore()
+	mockAPIs := make([]*plugintest.API, 0, nodes)
+	plugins := make([]*Plugin, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		p, mockAPI := newTestNode(kv)
+		mockAPI.On("PublishWebSocketEvent", "channelStateChanged", mock.Anything, mock.Anything).Return()
+		mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "user1"}, nil)
+		mockAPI.On("GetUsersInChannel", "chan1", model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{{Id: "user1", Username: "user1"}}, nil)
+		mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return([]byte("{}"), nil)
+		mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+		mockAPIs = append(mockAPIs, mockAPI)
+		plugins = append(plugins, p)
+	}
+
+	toggle := func(method ChanEncryptionMethod) int {
+		kv.syncFirstReads(nodes)
+		var wg sync.WaitGroup
+		changes := make(chan bool, nodes)
+		for _, p := range plugins {
+			wg.Add(1)
+			go func(p *Plugin) {
+				defer wg.Done()
+				changed, appErr := p.SetChanEncryptionMethodAndNotify("chan1", "user1", method)
+				tassert.Nil(appErr)
+				changes <- changed
+			}(p)
+		}
+		wg.Wait()
+		close(changes)
+		ret := 0
+		for changed := range changes {
+			if changed {
+				ret++
+			}
+		}
+		return ret
+	}
+
+	// The key doesn't exist yet
+	tassert.Equal(1, toggle(ChanEncryptionMethodP2P))
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	tassert.Equal(p2p, kv.data[ChanEncryptionMethodKey("chan1")])
+
+	tassert.Equal(1, toggle(ChanEncryptionMethodNone))
+	none, _ := json.Marshal(ChanEncryptionMethodNone)
+	tassert.Equal(none, kv.data[ChanEncryptionMethodKey("chan1")])
+
+	posts := 0
+	for _, mockAPI := range mockAPIs {
+		for _, call := range mockAPI.Calls {
+			if call.Method == "CreatePost" {
+				posts++
+			}
+		}
+	}
+	tassert.Equal(2, posts)
+}
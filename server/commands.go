@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// CommandPermission tells who can run a subcommand.
+type CommandPermission int
+
+const (
+	CommandPermissionAnyone CommandPermission = iota
+	// Members of the channel the command is run in
+	CommandPermissionChannelMember
+	// Admins of the channel the command is run in, and system admins
+	CommandPermissionChannelAdmin
+)
+
+// CommandArgKind is the type of a subcommand argument, which drives its
+// autocompletion.
+type CommandArgKind int
+
+const (
+	CommandArgText CommandArgKind = iota
+	// @username
+	CommandArgUser
+	// One of a list of values
+	CommandArgEnum
+)
+
+const (
+	autocompleteUsersURL = "/api/v1/autocomplete/users"
+	// Maximum number of suggestions returned by autocomplete endpoints
+	autocompleteMaxItems = 25
+)
+
+type CommandArg struct {
+	Kind CommandArgKind
+	// Name of text arguments
+	Name     string
+	HelpText string
+	// Values of enum arguments
+	Values   []string
+	Optional bool
+}
+
+// Usage returns how the argument is shown in help and usage messages.
+func (a *CommandArg) Usage() string {
+	var ret string
+	switch a.Kind {
+	case CommandArgUser:
+		ret = "@user"
+	case CommandArgEnum:
+		ret = strings.Join(a.Values, "|")
+	default:
+		ret = a.Name
+	}
+	if a.Optional {
+		ret = "[" + ret + "]"
+	}
+	return ret
+}
+
+// Subcommand is one of the /e2ee commands.
+type Subcommand struct {
+	Name        string
+	Description string
+	Args        []CommandArg
+	Permission  CommandPermission
+	// Execute runs the command with its arguments. It is nil for commands
+	// that are only implemented by the webapp, which must be loaded to run
+	// them.
+	Execute func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError
+}
+
+// Usage returns the syntax of the command.
+func (s *Subcommand) Usage() string {
+	parts := []string{"/" + slashCommandName, s.Name}
+	for i := range s.Args {
+		parts = append(parts, s.Args[i].Usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// checkArgs returns a usage error if the number of arguments is wrong.
+func (s *Subcommand) checkArgs(cmdArgs []string) *model.AppError {
+	required := 0
+	for _, arg := range s.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+	if len(cmdArgs) < required || len(cmdArgs) > len(s.Args) {
+		return &model.AppError{Message: "usage: " + s.Usage()}
+	}
+	return nil
+}
+
+// AutocompleteData returns the autocompletion of the command and of its
+// arguments.
+func (s *Subcommand) AutocompleteData() *model.AutocompleteData {
+	args := make([]string, 0, len(s.Args))
+	for i := range s.Args {
+		args = append(args, s.Args[i].Usage())
+	}
+	ret := model.NewAutocompleteData(s.Name, strings.Join(args, " "), s.Description)
+	for _, arg := range s.Args {
+		switch arg.Kind {
+		case CommandArgUser:
+			ret.AddDynamicListArgument(arg.HelpText, autocompleteUsersURL, !arg.Optional)
+		case CommandArgEnum:
+			items := make([]model.AutocompleteListItem, 0, len(arg.Values))
+			for _, value := range arg.Values {
+				items = append(items, model.AutocompleteListItem{Item: value, HelpText: arg.HelpText})
+			}
+			ret.AddStaticListArgument(arg.HelpText, !arg.Optional, items)
+		default:
+			// Positional text arguments can't be optional: the hint tells
+			// whether they are
+			ret.AddTextArgument(arg.HelpText, arg.Usage(), "")
+		}
+	}
+	return ret
+}
+
+var onOffArg = CommandArg{Kind: CommandArgEnum, Values: []string{"on", "off"}}
+
+func onOffCommand(set func(p *Plugin, chanID string, userID string, enabled bool) *model.AppError) func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	return func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+		enabled, err := parseOnOff(cmdArgs[0])
+		if err != nil {
+			return &model.AppError{Message: err.Error()}
+		}
+		return set(p, args.ChannelId, args.UserId, enabled)
+	}
+}
+
+func setChanEncryptionMethodCommand(method ChanEncryptionMethod) func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	return func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+		return p.SetChanEncryptionMethodOfUser(args.ChannelId, args.UserId, method)
+	}
+}
+
+// subcommands lists the /e2ee commands, in the order of the help message. It
+// is filled in init, as the help command uses it.
+var subcommands []*Subcommand
+
+func init() {
+	subcommands = []*Subcommand{
+		{
+			Name:        "help",
+			Description: "print this help message.",
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				p.postCommandResponse(args, helpTextHeader+HelpText())
+				return nil
+			},
+		},
+		{
+			Name:        "init",
+			Description: "initialize E2EE for your account. This will generate a new key for your session. Use --force to erase an existing key.",
+			Args: []CommandArg{
+				{Kind: CommandArgEnum, Values: []string{"--force"}, HelpText: "erase an existing key", Optional: true},
+				{Kind: CommandArgText, Name: "gpg key fingerprint", HelpText: "GPG key used to backup your private key", Optional: true},
+			},
+		},
+		{
+			Name:        "start",
+			Description: "encrypt the messages you send in this channel.",
+			Permission:  CommandPermissionChannelMember,
+			Execute:     setChanEncryptionMethodCommand(ChanEncryptionMethodP2P),
+		},
+		{
+			Name:        "stop",
+			Description: "do not encrypt the messages you send in this channel.",
+			Permission:  CommandPermissionChannelMember,
+			Execute:     setChanEncryptionMethodCommand(ChanEncryptionMethodNone),
+		},
+		{
+			Name:        "status",
+			Description: "show the encryption mode of this channel, its members without a key and the fingerprint of your key.",
+			Permission:  CommandPermissionChannelMember,
+			Execute:     (*Plugin).ExecuteStatusCommand,
+		},
+		{
+			Name:        "who",
+			Description: "list the members of this channel with the status of their encryption key, 20 at a time.",
+			Args:        []CommandArg{{Kind: CommandArgText, Name: "page", HelpText: "page to show", Optional: true}},
+			Permission:  CommandPermissionChannelMember,
+			Execute:     (*Plugin).ExecuteWhoCommand,
+		},
+		{
+			Name:        "import",
+			Description: "import your private key into this device.",
+		},
+		{
+			Name:        "show_backup",
+			Description: "show saved encrypted GPG backup.",
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				return p.ShowGPGBackup(args)
+			},
+		},
+		{
+			Name:        "lock",
+			Description: "require the approval of another channel admin to disable encryption in this channel.",
+			Permission:  CommandPermissionChannelAdmin,
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				return p.SetChanEncryptionLock(args.ChannelId, args.UserId, true)
+			},
+		},
+		{
+			Name:        "unlock",
+			Description: "allow disabling encryption in this channel without approval.",
+			Permission:  CommandPermissionChannelAdmin,
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				return p.SetChanEncryptionLock(args.ChannelId, args.UserId, false)
+			},
+		},
+		{
+			Name:        "strict",
+			Description: "remove people without an encryption key when they join this channel while it is encrypted.",
+			Args:        []CommandArg{onOffArg},
+			Permission:  CommandPermissionChannelAdmin,
+			Execute:     onOffCommand((*Plugin).SetChanStrict),
+		},
+		{
+			Name:        "verified_only",
+			Description: "reject encrypted messages in this channel if the key of a recipient hasn't been verified by the sender or a channel admin.",
+			Args:        []CommandArg{onOffArg},
+			Permission:  CommandPermissionChannelAdmin,
+			Execute:     onOffCommand((*Plugin).SetChanVerifiedOnly),
+		},
+		{
+			Name:        "fingerprint",
+			Description: "show the fingerprint of your key, or of the key of another user.",
+			Args:        []CommandArg{{Kind: CommandArgUser, HelpText: "user whose key to show", Optional: true}},
+			Execute:     (*Plugin).ExecuteFingerprintCommand,
+		},
+		{
+			Name:        "safety",
+			Description: "show the safety number of your key and the one of another user. It must be the same on both sides.",
+			Args:        []CommandArg{{Kind: CommandArgUser, HelpText: "user to compare keys with"}},
+			Execute:     (*Plugin).ExecuteSafetyNumberCommand,
+		},
+		{
+			Name:        "key_notices",
+			Description: "post (or not) a notice in this channel when the key of one of its members changes.",
+			Args:        []CommandArg{onOffArg},
+			Permission:  CommandPermissionChannelMember,
+			Execute:     (*Plugin).ExecuteKeyNoticesCommand,
+		},
+		{
+			Name:        "revoke",
+			Description: "revoke your public key. Nobody will be able to encrypt messages for you until you setup a new key.",
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				appErr := p.RevokeUserPubKey(args.UserId)
+				if appErr != nil {
+					return appErr
+				}
+				p.postCommandResponse(args, "Your public key has been revoked. Run `/e2ee init --force` to setup a new one.")
+				return nil
+			},
+		},
+		{
+			Name:        "prefs",
+			Description: "show or change your E2EE preferences. With auto_encrypt_dm, your direct messages with users who turned it on too are encrypted as soon as both participants have a key.",
+			Args: []CommandArg{
+				{Kind: CommandArgEnum, Values: []string{"auto_encrypt_dm"}, HelpText: "preference to change", Optional: true},
+				{Kind: CommandArgEnum, Values: []string{"on", "off"}, HelpText: "new value", Optional: true},
+			},
+			Execute: (*Plugin).ExecutePrefsCommand,
+		},
+		{
+			Name:        "monitor",
+			Description: "let unencrypted messages through in this channel, but record the ones that would be rejected if it was encrypted.",
+			Permission:  CommandPermissionChannelMember,
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				changed, pending, appErr := p.RequestOrSetChanEncryptionMethod(args.ChannelId, args.UserId, ChanEncryptionMethodMonitor)
+				if appErr != nil {
+					return appErr
+				}
+				if !changed && !pending {
+					p.postCommandResponse(args, "This channel is already in monitor mode.")
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "monitor_report",
+			Description: "show the messages that would have been rejected in this channel since it is in monitor mode.",
+			Permission:  CommandPermissionChannelAdmin,
+			Execute: func(p *Plugin, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+				return p.ExecuteMonitorReportCommand(args)
+			},
+		},
+		{
+			Name:        "default",
+			Description: "show or set the encryption mode applied to new private channels of this team (or to new direct and group messages with --direct).",
+			Args: []CommandArg{
+				{Kind: CommandArgEnum, Values: []string{"--direct"}, HelpText: "apply to direct and group messages", Optional: true},
+				{Kind: CommandArgEnum, Values: []string{"p2p", "none"}, HelpText: "encryption mode", Optional: true},
+			},
+			Execute: (*Plugin).ExecuteDefaultEncrMethodCommand,
+		},
+	}
+}
+
+func getSubcommand(name string) *Subcommand {
+	for _, sub := range subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// HelpText returns the list of commands and what they do.
+func HelpText() string {
+	var sb strings.Builder
+	sb.WriteString("\n")
+	for _, sub := range subcommands {
+		fmt.Fprintf(&sb, "* |%s| - %s\n", sub.Usage(), sub.Description)
+	}
+	return sb.String()
+}
+
+// GetAutocompleteData returns the autocompletion of all the commands.
+func GetAutocompleteData() *model.AutocompleteData {
+	ret := model.NewAutocompleteData(slashCommandName, autoCompleteHint, pluginDescription)
+	for _, sub := range subcommands {
+		ret.AddCommand(sub.AutocompleteData())
+	}
+	return ret
+}
+
+func (p *Plugin) checkCommandPermission(sub *Subcommand, args *model.CommandArgs) *model.AppError {
+	switch sub.Permission {
+	case CommandPermissionChannelMember:
+		if _, appErr := p.API.GetChannelMember(args.ChannelId, args.UserId); appErr != nil {
+			return &model.AppError{Message: fmt.Sprintf("only members of this channel can use /%s %s", slashCommandName, sub.Name)}
+		}
+	case CommandPermissionChannelAdmin:
+		allowed, appErr := p.CanManageChanEncryption(args.ChannelId, args.UserId)
+		if appErr != nil {
+			return appErr
+		}
+		if !allowed {
+			return &model.AppError{Message: fmt.Sprintf("only channel and system admins can use /%s %s", slashCommandName, sub.Name)}
+		}
+	}
+	return nil
+}
+
+// commandError turns errors created with model.NewAppError, whose message is
+// an untranslated ID, into errors that make sense to users.
+func commandError(appErr *model.AppError) *model.AppError {
+	if appErr == nil || !strings.HasPrefix(appErr.Message, "mm-e2ee.") || appErr.DetailedError == "" {
+		return appErr
+	}
+	return &model.AppError{Message: appErr.DetailedError, StatusCode: appErr.StatusCode}
+}
+
+// RunSubcommand checks that the user can run sub with cmdArgs, and runs it.
+func (p *Plugin) RunSubcommand(sub *Subcommand, args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	if sub.Execute == nil {
+		return &model.AppError{Message: fmt.Sprintf("/%s %s is only available in the Mattermost webapp and desktop app", slashCommandName, sub.Name)}
+	}
+	if appErr := sub.checkArgs(cmdArgs); appErr != nil {
+		return appErr
+	}
+	if appErr := p.checkCommandPermission(sub, args); appErr != nil {
+		return appErr
+	}
+	return commandError(sub.Execute(p, args, cmdArgs))
+}
+
+// currentWord returns the word the user is typing in an autocomplete request.
+func currentWord(r *http.Request) string {
+	input := r.URL.Query().Get("user_input")
+	if input == "" || strings.HasSuffix(input, " ") {
+		return ""
+	}
+	words := strings.Fields(input)
+	return words[len(words)-1]
+}
+
+// AutocompleteUsers suggests users for @user command arguments. Only users
+// whose public key the caller can see are suggested.
+func (p *Plugin) AutocompleteUsers(c *Context, w http.ResponseWriter, r *http.Request) {
+	term := strings.TrimPrefix(currentWord(r), "@")
+	items := make([]model.AutocompleteListItem, 0)
+	users, appErr := p.API.SearchUsers(&model.UserSearch{
+		Term:   term,
+		TeamId: r.URL.Query().Get("team_id"),
+		Limit:  autocompleteMaxItems,
+	})
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	viewer, appErr := p.newPubKeyViewer(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, user := range users {
+		if user.IsBot {
+			continue
+		}
+		visible, appErr := viewer.CanSee(user.Id)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			continue
+		}
+		items = append(items, model.AutocompleteListItem{
+			Item:     "@" + user.Username,
+			HelpText: user.GetDisplayName(model.SHOW_FULLNAME),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, items)
+}
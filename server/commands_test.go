@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_commands_autocomplete(t *testing.T) {
+	tassert := assert.New(t)
+	data := GetAutocompleteData()
+	tassert.Nil(data.IsValid())
+	tassert.Len(data.SubCommands, len(subcommands))
+
+	safety := getSubcommand("safety").AutocompleteData()
+	tassert.Equal("@user", safety.Hint)
+	tassert.Equal(model.AutocompleteArgTypeDynamicList, safety.Arguments[0].Type)
+	tassert.True(safety.Arguments[0].Required)
+	def := getSubcommand("default").AutocompleteData()
+	tassert.Equal("[--direct] [p2p|none]", def.Hint)
+	tassert.Equal(model.AutocompleteArgTypeStaticList, def.Arguments[1].Type)
+	tassert.False(def.Arguments[1].Required)
+}
+
+func Test_commands_help(t *testing.T) {
+	tassert := assert.New(t)
+	help := HelpText()
+	tassert.Contains(help, "* |/e2ee strict on|off| - remove people without an encryption key")
+	tassert.Contains(help, "* |/e2ee fingerprint [@user]| - show the fingerprint")
+}
+
+func Test_commands_run(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	mockAPI.On("GetChannelMember", "chan1", "user1").Return(&model.ChannelMember{SchemeAdmin: false}, nil)
+	mockAPI.On("HasPermissionTo", "user1", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+	mockAPI.On("SendEphemeralPost", "user1", mock.AnythingOfType("*model.Post")).Return(nil)
+
+	run := func(command string) *model.AppError {
+		_, appErr := p.ExecuteCommand(nil, &model.CommandArgs{Command: command, ChannelId: "chan1", UserId: "user1"})
+		return appErr
+	}
+
+	tassert.Nil(run("/e2ee"))
+	mockAPI.AssertNumberOfCalls(t, "SendEphemeralPost", 1)
+	tassert.Equal("usage: /e2ee strict on|off", run("/e2ee strict").Message)
+	tassert.Equal("usage: /e2ee safety @user", run("/e2ee safety @a @b").Message)
+	tassert.Equal("only channel and system admins can use /e2ee lock", run("/e2ee lock").Message)
+	tassert.Equal("/e2ee init is only available in the Mattermost webapp and desktop app", run("/e2ee init").Message)
+	tassert.Equal("unknown command foo, run /e2ee help to list the available commands", run("/e2ee foo").Message)
+}
+
+func Test_commands_error(t *testing.T) {
+	tassert := assert.New(t)
+	appErr := commandError(model.NewAppError("f", "mm-e2ee.not_allowed", nil, "you can't", 403))
+	tassert.Equal("you can't", appErr.Message)
+	tassert.Equal(403, appErr.StatusCode)
+	usage := &model.AppError{Message: "usage: /e2ee x"}
+	tassert.Equal(usage, commandError(usage))
+}
+
+func Test_commands_autocompleteUsers(t *testing.T) {
+	tassert := assert.New(t)
+	p, mockAPI := newPubKeyAccessTestPlugin()
+	mockAPI.On("SearchUsers", mock.AnythingOfType("*model.UserSearch")).Return([]*model.User{
+		{Id: "teammate", Username: "teammate"},
+		{Id: "stranger", Username: "stranger"},
+		{Id: "bot", Username: "bot", IsBot: true},
+		{Id: "dm_partner", Username: "dm_partner"},
+	}, nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/autocomplete/users?user_input="+url.QueryEscape("/e2ee safety @"), nil)
+	rr := httptest.NewRecorder()
+	p.AutocompleteUsers(&Context{UserID: "user"}, rr, req)
+	tassert.Equal(http.StatusOK, rr.Code)
+	var items []model.AutocompleteListItem
+	tassert.Nil(json.Unmarshal(rr.Body.Bytes(), &items))
+	tassert.Len(items, 2)
+	tassert.Equal("@teammate", items[0].Item)
+	tassert.Equal("@dm_partner", items[1].Item)
+}
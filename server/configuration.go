@@ -2,7 +2,6 @@ package main
 
 import (
 	"reflect"
-	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -19,9 +18,23 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	GPGKeyServer        string
-	BotCanAlwaysPost    bool
-	AlwaysAllowMsgTypes string
+	GPGKeyServer           string
+	BotCanAlwaysPost       bool
+	AlwaysAllowMsgTypes    string
+	AutoEncryptDM          string
+	GuestPolicy            string
+	TeamGuestPolicies      string
+	MaxKeyAgeDays          int
+	KeyExpiryGraceDays     int
+	RefuseExpiredKeys      bool
+	RejectStaleMembership  bool
+	PubKeyVisibility       string
+	AdminsSeeAllPubKeys    bool
+	PubKeyLookupsPerMinute int
+	CacheTTLSeconds        int
+
+	// Whether the server is part of a high availability cluster
+	clusterEnabled bool
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -71,16 +84,7 @@ func (p *Plugin) setConfiguration(configuration *configuration) {
 
 	p.configuration = configuration
 
-	// Compute the set of whitelisted message types
-	MsgTypes := strings.Split(strings.TrimSpace(configuration.AlwaysAllowMsgTypes), ",")
-	p.AlwaysAllowMsgTypes = make(map[string]bool)
-	for _, v := range MsgTypes {
-		v = strings.TrimSpace(v)
-		if len(v) == 0 {
-			continue
-		}
-		p.AlwaysAllowMsgTypes[v] = true
-	}
+	p.TeamGuestPolicies = parseTeamGuestPolicies(configuration.TeamGuestPolicies)
 }
 
 // OnConfigurationChange is invoked when configuration changes may have been made.
@@ -91,6 +95,10 @@ func (p *Plugin) OnConfigurationChange() error {
 	if err := p.API.LoadPluginConfiguration(configuration); err != nil {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
+	serverConfig := p.API.GetConfig()
+	if serverConfig != nil && serverConfig.ClusterSettings.Enable != nil {
+		configuration.clusterEnabled = *serverConfig.ClusterSettings.Enable
+	}
 
 	p.setConfiguration(configuration)
 
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// Number of words in a fingerprint, shown in groups of
+	// fingerprintWordsPerGroup
+	fingerprintWords         = 8
+	fingerprintWordsPerGroup = 4
+	// Number of groups of 5 digits in the fingerprint of a key
+	fingerprintDigitGroups = 6
+	// Number of hash iterations used to compute safety numbers, like Signal
+	safetyNumberIterations = 5200
+	safetyNumberVersion    = 0
+)
+
+// fingerprintWordList maps bytes to words. These are the two-syllable words of
+// the PGP word list.
+var fingerprintWordList = [256]string{
+	"aardvark", "absurd", "accrue", "acme", "adrift", "adult", "afflict", "ahead", "aimless", "algol",
+	"allow", "alone", "ammo", "ancient", "apple", "artist", "assume", "athens", "atlas", "aztec",
+	"baboon", "backfield", "backward", "banjo", "beaming", "bedlamp", "beehive", "beeswax",
+	"befriend", "belfast", "berserk", "billiard", "bison", "blackjack", "blockade", "blowtorch",
+	"bluebird", "bombast", "bookshelf", "brackish", "breadline", "breakup", "brickyard", "briefcase",
+	"burbank", "button", "buzzard", "cement", "chairlift", "chatter", "checkup", "chisel", "choking",
+	"chopper", "christmas", "clamshell", "classic", "classroom", "cleanup", "clockwork", "cobra",
+	"commence", "concert", "cowbell", "crackdown", "cranky", "crowfoot", "crucial", "crumpled",
+	"crusade", "cubic", "dashboard", "deadbolt", "deckhand", "dogsled", "dragnet", "drainage",
+	"dreadful", "drifter", "dropper", "drumbeat", "drunken", "dupont", "dwelling", "eating", "edict",
+	"egghead", "eightball", "endorse", "endow", "enlist", "erase", "escape", "exceed", "eyeglass",
+	"eyetooth", "facial", "fallout", "flagpole", "flatfoot", "flytrap", "fracture", "framework",
+	"freedom", "frighten", "gazelle", "geiger", "glitter", "glucose", "goggles", "goldfish",
+	"gremlin", "guidance", "hamlet", "highchair", "hockey", "indoors", "indulge", "inverse",
+	"involve", "island", "jawbone", "keyboard", "kickoff", "kiwi", "klaxon", "locale", "lockup",
+	"merit", "minnow", "miser", "mohawk", "mural", "music", "necklace", "neptune", "newborn",
+	"nightbird", "oakland", "obtuse", "offload", "optic", "orca", "payday", "peachy", "pheasant",
+	"physique", "playhouse", "pluto", "preclude", "prefer", "preshrunk", "printer", "prowler",
+	"pupil", "puppy", "python", "quadrant", "quiver", "quota", "ragtime", "ratchet", "rebirth",
+	"reform", "regain", "reindeer", "rematch", "repay", "retouch", "revenge", "reward", "rhythm",
+	"ribcage", "ringbolt", "robust", "rocker", "ruffled", "sailboat", "sawdust", "scallion", "scenic",
+	"scorecard", "scotland", "seabird", "select", "sentence", "shadow", "shamrock", "showgirl",
+	"skullcap", "skydive", "slingshot", "slowdown", "snapline", "snapshot", "snowcap", "snowslide",
+	"solo", "southward", "soybean", "spaniel", "spearhead", "spellbind", "spheroid", "spigot",
+	"spindle", "spyglass", "stagehand", "stagnate", "stairway", "standard", "stapler", "steamship",
+	"sterling", "stockman", "stopwatch", "stormy", "sugar", "surmount", "suspense", "sweatband",
+	"swelter", "tactics", "talon", "tapeworm", "tempest", "tiger", "tissue", "tonic", "topmost",
+	"tracker", "transit", "trauma", "treadmill", "trojan", "trouble", "tumor", "tunnel", "tycoon",
+	"uncut", "unearth", "unwind", "uproot", "upset", "upshot", "vapor", "village", "virus", "vulcan",
+	"waffle", "wallet", "watchword", "wayside", "willow", "woodlark", "zulu",
+}
+
+// Fingerprint is a human-readable representation of a key ID.
+type Fingerprint struct {
+	UserID string `json:"userID"`
+	// Base64 encoded key ID
+	KeyID  string   `json:"keyID"`
+	Words  []string `json:"words"`
+	Digits []string `json:"digits"`
+}
+
+// digitGroups converts each 5 bytes of data into a group of 5 digits.
+func digitGroups(data []byte, groups int) []string {
+	ret := make([]string, 0, groups)
+	for i := 0; i < groups; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], data[i*5:(i+1)*5])
+		ret = append(ret, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+	return ret
+}
+
+// NewFingerprint computes the fingerprint of the key keyID of userID.
+func NewFingerprint(userID string, keyID []byte) *Fingerprint {
+	ret := &Fingerprint{
+		UserID: userID,
+		KeyID:  KeyIDString(keyID),
+		Words:  make([]string, 0, fingerprintWords/fingerprintWordsPerGroup),
+		Digits: digitGroups(keyID, fingerprintDigitGroups),
+	}
+	for i := 0; i < fingerprintWords; i += fingerprintWordsPerGroup {
+		group := make([]string, 0, fingerprintWordsPerGroup)
+		for _, b := range keyID[i : i+fingerprintWordsPerGroup] {
+			group = append(group, fingerprintWordList[b])
+		}
+		ret.Words = append(ret.Words, strings.Join(group, " "))
+	}
+	return ret
+}
+
+// String formats the fingerprint in markdown.
+func (f *Fingerprint) String() string {
+	return fmt.Sprintf("**%s**\n`%s`", strings.Join(f.Words, " · "), strings.Join(f.Digits, " "))
+}
+
+// safetyNumberHalf computes the 30 digits contributed by a user to a safety
+// number, like Signal does.
+func safetyNumberHalf(userID string, keyID []byte) string {
+	data := make([]byte, 2, 2+len(keyID)+len(userID))
+	binary.BigEndian.PutUint16(data, safetyNumberVersion)
+	data = append(data, keyID...)
+	data = append(data, userID...)
+	hash := sha512.Sum512(data)
+	for i := 1; i < safetyNumberIterations; i++ {
+		hash = sha512.Sum512(append(hash[:], keyID...))
+	}
+	return strings.Join(digitGroups(hash[:], 6), " ")
+}
+
+// SafetyNumber is a number that two users can compare to check that they
+// see the same keys for each other. It is the same for both of them.
+type SafetyNumber struct {
+	UserIDs []string `json:"userIDs"`
+	Number  string   `json:"number"`
+}
+
+func NewSafetyNumber(userA string, keyA []byte, userB string, keyB []byte) *SafetyNumber {
+	halves := []string{safetyNumberHalf(userA, keyA), safetyNumberHalf(userB, keyB)}
+	userIDs := []string{userA, userB}
+	if halves[0] > halves[1] {
+		halves[0], halves[1] = halves[1], halves[0]
+		userIDs[0], userIDs[1] = userIDs[1], userIDs[0]
+	}
+	return &SafetyNumber{UserIDs: userIDs, Number: halves[0] + " " + halves[1]}
+}
+
+func (p *Plugin) getUserKeyID(userID string) ([]byte, *model.AppError) {
+	pubkey, err := p.GetUserPubKey(userID)
+	if err != nil {
+		return nil, model.NewAppError("getUserKeyID", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if pubkey == nil {
+		return nil, model.NewAppError("getUserKeyID", "mm-e2ee.no_pubkey", nil, "this user has no public key", http.StatusNotFound)
+	}
+	return pubkey.ID(), nil
+}
+
+func (p *Plugin) GetFingerprint(userID string) (*Fingerprint, *model.AppError) {
+	keyID, appErr := p.getUserKeyID(userID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return NewFingerprint(userID, keyID), nil
+}
+
+func (p *Plugin) GetSafetyNumber(userA string, userB string) (*SafetyNumber, *model.AppError) {
+	keyA, appErr := p.getUserKeyID(userA)
+	if appErr != nil {
+		return nil, appErr
+	}
+	keyB, appErr := p.getUserKeyID(userB)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return NewSafetyNumber(userA, keyA, userB, keyB), nil
+}
+
+// getCommandUser returns the user designated by an optional @username command
+// argument, or the user who ran the command.
+func (p *Plugin) getCommandUser(args *model.CommandArgs, cmdArgs []string) (*model.User, *model.AppError) {
+	if len(cmdArgs) == 0 {
+		return p.API.GetUser(args.UserId)
+	}
+	return p.API.GetUserByUsername(strings.TrimPrefix(cmdArgs[0], "@"))
+}
+
+func (p *Plugin) ExecuteFingerprintCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	if len(cmdArgs) > 1 {
+		return &model.AppError{Message: "usage: /e2ee fingerprint [@user]"}
+	}
+	user, appErr := p.getCommandUser(args, cmdArgs)
+	if appErr != nil {
+		return appErr
+	}
+	if user.Id != args.UserId {
+		appErr = p.checkCanSeePubKey(args.UserId, user.Id)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	fingerprint, appErr := p.GetFingerprint(user.Id)
+	if appErr != nil {
+		return appErr
+	}
+	p.postCommandResponse(args, fmt.Sprintf("Fingerprint of the key of @%s:\n%s", user.Username, fingerprint.String()))
+	return nil
+}
+
+func (p *Plugin) ExecuteSafetyNumberCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	if len(cmdArgs) != 1 {
+		return &model.AppError{Message: "usage: /e2ee safety @user"}
+	}
+	user, appErr := p.getCommandUser(args, cmdArgs)
+	if appErr != nil {
+		return appErr
+	}
+	appErr = p.checkCanSeePubKey(args.UserId, user.Id)
+	if appErr != nil {
+		return appErr
+	}
+	safety, appErr := p.GetSafetyNumber(args.UserId, user.Id)
+	if appErr != nil {
+		return appErr
+	}
+	p.postCommandResponse(args, fmt.Sprintf("Safety number with @%s:\n`%s`\nCompare it with the one @%s sees: if they differ, one of your keys isn't the one you think.",
+		user.Username, safety.Number, user.Username))
+	return nil
+}
+
+func (p *Plugin) GetFingerprintHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		userID = c.UserID
+	}
+	if userID != c.UserID {
+		appErr := p.checkCanSeePubKey(c.UserID, userID)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), appErr.StatusCode)
+			return
+		}
+	}
+	fingerprint, appErr := p.GetFingerprint(userID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, fingerprint)
+}
+
+func (p *Plugin) GetSafetyNumberHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("userID")
+	if userID == "" {
+		http.Error(w, "missing userID", http.StatusBadRequest)
+		return
+	}
+	appErr := p.checkCanSeePubKey(c.UserID, userID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	safety, appErr := p.GetSafetyNumber(c.UserID, userID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, safety)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_fingerprint_format(t *testing.T) {
+	tassert := assert.New(t)
+	keyID := make([]byte, 32)
+	for i := range keyID {
+		keyID[i] = byte(i)
+	}
+	fingerprint := NewFingerprint("user1", keyID)
+	tassert.Equal([]string{"aardvark absurd accrue acme", "adrift adult afflict ahead"}, fingerprint.Words)
+	tassert.Len(fingerprint.Digits, 6)
+	// 0x0001020304 % 100000
+	tassert.Equal("09060", fingerprint.Digits[0])
+}
+
+func Test_fingerprint_safetyNumberSymmetric(t *testing.T) {
+	tassert := assert.New(t)
+	keyA := GenerateValidPubKey()
+	keyB := GenerateValidPubKey()
+
+	ab := NewSafetyNumber("userA", keyA.ID(), "userB", keyB.ID())
+	ba := NewSafetyNumber("userB", keyB.ID(), "userA", keyA.ID())
+	tassert.Equal(ab, ba)
+	tassert.Len(ab.Number, 12*5+11)
+
+	keyC := GenerateValidPubKey()
+	ac := NewSafetyNumber("userA", keyA.ID(), "userB", keyC.ID())
+	tassert.NotEqual(ab.Number, ac.Number)
+}
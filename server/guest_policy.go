@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Behaviours of the plugin regarding encrypted channels with guest members
+const (
+	// Guests are treated like other members
+	GuestPolicyAllow = "allow"
+	// Guests are listed when encryption is turned on
+	GuestPolicyWarn = "warn"
+	// Encryption can't be turned on if guests are members of the channel
+	GuestPolicyRefuse = "refuse"
+)
+
+func isValidGuestPolicy(policy string) bool {
+	return policy == GuestPolicyAllow || policy == GuestPolicyWarn || policy == GuestPolicyRefuse
+}
+
+// parseTeamGuestPolicies parses a comma separated list of team_name=policy.
+// Invalid entries are ignored.
+func parseTeamGuestPolicies(v string) map[string]string {
+	ret := make(map[string]string)
+	for _, entry := range strings.Split(v, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		team := strings.TrimSpace(kv[0])
+		policy := strings.TrimSpace(kv[1])
+		if len(team) == 0 || !isValidGuestPolicy(policy) {
+			continue
+		}
+		ret[team] = policy
+	}
+	return ret
+}
+
+// GetGuestPolicy returns the guest policy that applies to chanID.
+func (p *Plugin) GetGuestPolicy(chanID string) (string, *model.AppError) {
+	policy := p.getConfiguration().GuestPolicy
+	if !isValidGuestPolicy(policy) {
+		policy = GuestPolicyAllow
+	}
+	if len(p.TeamGuestPolicies) == 0 {
+		return policy, nil
+	}
+
+	channel, appErr := p.API.GetChannel(chanID)
+	if appErr != nil {
+		return policy, appErr
+	}
+	if channel.TeamId == "" {
+		return policy, nil
+	}
+	team, appErr := p.API.GetTeam(channel.TeamId)
+	if appErr != nil {
+		return policy, appErr
+	}
+	if teamPolicy, has := p.TeamGuestPolicies[team.Name]; has {
+		return teamPolicy, nil
+	}
+	return policy, nil
+}
+
+// checkGuestPolicy returns an error if the guest policy of a channel forbids
+// to encrypt it. report must be the one of this channel.
+func checkGuestPolicy(policy string, report *ChannelMembersReport) *model.AppError {
+	if policy != GuestPolicyRefuse || len(report.Guests) == 0 {
+		return nil
+	}
+	return model.NewAppError("checkGuestPolicy", "mm-e2ee.guests_refused", nil,
+		fmt.Sprintf("encryption can't be enabled on channels with guest members: %s", report.Mentions(report.Guests)),
+		http.StatusForbidden)
+}
+
+// AlertGuestJoinedLockedChannel posts an alert on an encrypted and locked
+// channel if userID, who just joined it, is a guest.
+func (p *Plugin) AlertGuestJoinedLockedChannel(chanID string, userID string) *model.AppError {
+	if !p.ChanEncrMethods.get(chanID).IsEncrypted() {
+		return nil
+	}
+	settings, appErr := p.GetChanSettings(chanID)
+	if appErr != nil || !settings.Locked {
+		return appErr
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil || !user.IsGuest() {
+		return appErr
+	}
+	_, appErr = p.API.CreatePost(&model.Post{
+		Message:   fmt.Sprintf("**ALERT**: guest account @%s has joined this locked encrypted channel.", user.Username),
+		UserId:    p.BotUserID,
+		ChannelId: chanID,
+	})
+	return appErr
+}
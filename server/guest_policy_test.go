@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_guestpolicy_parse(t *testing.T) {
+	tassert := assert.New(t)
+	tassert.Equal(map[string]string{
+		"security": GuestPolicyRefuse,
+		"support":  GuestPolicyWarn,
+	}, parseTeamGuestPolicies(" security=refuse, support = warn,bad=whatever,,noeq"))
+	tassert.Equal(map[string]string{}, parseTeamGuestPolicies(""))
+}
+
+func Test_guestpolicy_refuse(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{GuestPolicy: GuestPolicyWarn, TeamGuestPolicies: "security=refuse"})
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	mockAPI.On("GetChannel", chanID).Return(&model.Channel{Id: chanID, TeamId: "team1"}, nil)
+	mockAPI.On("GetTeam", "team1").Return(&model.Team{Name: "security"}, nil)
+	mockAPI.On("GetUsersInChannel", chanID, model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{
+		{Id: "user1", Username: "user1", Roles: model.SYSTEM_USER_ROLE_ID},
+		{Id: "guest", Username: "guest", Roles: model.SYSTEM_GUEST_ROLE_ID},
+	}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return([]byte("{}"), nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("guest")).Return([]byte("{}"), nil)
+
+	changed, appErr := p.SetChanEncryptionMethodAndNotify(chanID, "user1", ChanEncryptionMethodP2P)
+	tassert.False(changed)
+	tassert.NotNil(appErr)
+	tassert.Equal(http.StatusForbidden, appErr.StatusCode)
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_guestpolicy_alertLockedChannel(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	locked, _ := json.Marshal(ChanSettings{Locked: true})
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanSettingsKey(chanID)).Return(locked, nil)
+	mockAPI.On("GetUser", "guest").Return(&model.User{Username: "guest", Roles: model.SYSTEM_GUEST_ROLE_ID}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	tassert.Nil(p.AlertGuestJoinedLockedChannel(chanID, "guest"))
+	mockAPI.AssertNumberOfCalls(t, "CreatePost", 1)
+}
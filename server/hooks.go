@@ -7,6 +7,43 @@ import (
 	"github.com/mattermost/mattermost-server/v5/plugin"
 )
 
+func (p *Plugin) ChannelHasBeenCreated(c *plugin.Context, channel *model.Channel) {
+	appErr := p.ApplyDefaultEncrMethod(channel)
+	if appErr != nil {
+		p.API.LogError("unable to apply the default encryption method", "channel_id", channel.Id, "error", appErr.Error())
+		return
+	}
+	appErr = p.MaybeAutoEncryptDM(channel)
+	if appErr != nil {
+		p.API.LogError("unable to automatically encrypt direct channel", "channel_id", channel.Id, "error", appErr.Error())
+	}
+}
+
+func (p *Plugin) UserHasJoinedChannel(c *plugin.Context, channelMember *model.ChannelMember, actor *model.User) {
+	appErr := p.BumpChanMembershipVersion(channelMember.ChannelId)
+	if appErr != nil {
+		p.API.LogError("unable to update membership version", "channel_id", channelMember.ChannelId, "error", appErr.Error())
+	}
+	removed, appErr := p.EnforceStrictMembership(channelMember.ChannelId, channelMember.UserId, "no encryption key")
+	if appErr != nil {
+		p.API.LogError("unable to enforce strict membership", "channel_id", channelMember.ChannelId, "error", appErr.Error())
+	}
+	if removed {
+		return
+	}
+	appErr = p.AlertGuestJoinedLockedChannel(channelMember.ChannelId, channelMember.UserId)
+	if appErr != nil {
+		p.API.LogError("unable to check guest joining channel", "channel_id", channelMember.ChannelId, "error", appErr.Error())
+	}
+}
+
+func (p *Plugin) UserHasLeftChannel(c *plugin.Context, channelMember *model.ChannelMember, actor *model.User) {
+	appErr := p.BumpChanMembershipVersion(channelMember.ChannelId)
+	if appErr != nil {
+		p.API.LogError("unable to update membership version", "channel_id", channelMember.ChannelId, "error", appErr.Error())
+	}
+}
+
 func (p *Plugin) MessageWillBePosted(c *plugin.Context, post *model.Post) (*model.Post, string) {
 	// Bypass for our bot
 	if post.UserId == p.BotUserID {
@@ -19,26 +56,61 @@ func (p *Plugin) MessageWillBePosted(c *plugin.Context, post *model.Post) (*mode
 		return nil, ""
 	}
 
-	// If configured to do so, bypass for all bots
-	if p.getConfiguration().BotCanAlwaysPost {
-		user, appErr := p.API.GetUser(post.UserId)
+	if post.Type == "custom_e2ee" {
+		if !encrMeth.IsEncrypted() {
+			return nil, ""
+		}
+		if p.getConfiguration().RefuseExpiredKeys {
+			expired, appErr := p.IsUserPubKeyExpired(post.UserId)
+			if appErr != nil {
+				return nil, fmt.Sprintf("unable to check key expiry: %s", appErr.Error())
+			}
+			if expired {
+				return nil, "Your encryption key has expired. Run `/e2ee init --force` to setup a new one."
+			}
+		}
+		reason, appErr := p.CheckMembershipVersion(post)
 		if appErr != nil {
-			return nil, fmt.Sprintf("unable to check if user is a bot: %s", appErr.Error())
+			return nil, fmt.Sprintf("unable to check membership version: %s", appErr.Error())
 		}
-		if user.IsBot {
-			return nil, ""
+		if reason != "" {
+			return nil, reason
 		}
+		reason, appErr = p.CheckVerifiedOnly(post)
+		if appErr != nil {
+			return nil, fmt.Sprintf("unable to check recipient keys: %s", appErr.Error())
+		}
+		return nil, reason
 	}
 
-	// Check if the type of the message is whitelisted
-	if _, has := p.AlwaysAllowMsgTypes[post.Type]; has {
+	// The message is not encrypted, check if a rule allows it
+	rules, appErr := p.GetEffectivePostingRules()
+	if appErr != nil {
+		return nil, fmt.Sprintf("unable to get posting rules: %s", appErr.Error())
+	}
+	decision, appErr := p.EvaluatePostingRules(rules, post)
+	if appErr != nil {
+		return nil, fmt.Sprintf("unable to evaluate posting rules: %s", appErr.Error())
+	}
+	if encrMeth == ChanEncryptionMethodMonitor {
+		// Let everything through, but remember what would have been rejected
+		if decision.Action == PostingRuleDeny {
+			p.RecordWouldBeRejection(post, decision.RuleID)
+		}
 		return nil, ""
 	}
-
-	// If the message is not encrypted, rejects it!
-	if post.Type != "custom_e2ee" {
+	switch decision.Action {
+	case PostingRuleAllow:
+		return nil, ""
+	case PostingRuleWarn:
+		p.API.LogWarn("unencrypted message sent on an encrypted channel", "channel_id", post.ChannelId, "user_id", post.UserId, "rule_id", decision.RuleID)
+		_ = p.API.SendEphemeralPost(post.UserId, &model.Post{
+			UserId:    p.BotUserID,
+			ChannelId: post.ChannelId,
+			Message:   "**Warning**: your message has been sent **unencrypted** on this encrypted channel.",
+		})
+		return nil, ""
+	default:
 		return nil, "Unencrypted messages can't be sent on an encrypted channel."
 	}
-
-	return nil, ""
 }
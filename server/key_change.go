@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// getChannelsOfUser returns all the channels userID is a member of, including
+// direct and group messages.
+func (p *Plugin) getChannelsOfUser(userID string) ([]*model.Channel, *model.AppError) {
+	teams, appErr := p.API.GetTeamsForUser(userID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	// An empty team ID gives us direct and group channels, which are also
+	// returned for every team
+	teamIDs := []string{""}
+	for _, team := range teams {
+		teamIDs = append(teamIDs, team.Id)
+	}
+
+	ret := make([]*model.Channel, 0)
+	seen := make(map[string]bool)
+	for _, teamID := range teamIDs {
+		channels, appErr := p.API.GetChannelsForTeamForUser(teamID, userID, false)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, channel := range channels {
+			if seen[channel.Id] {
+				continue
+			}
+			seen[channel.Id] = true
+			ret = append(ret, channel)
+		}
+	}
+	return ret, nil
+}
+
+// Kinds of key changes
+const (
+	// First key of a user
+	KeyChangeRegistration = "registration"
+	// A key replaced by another one
+	KeyChangeRotation = "rotation"
+	// New key of a user who revoked their previous one, or key removed by a
+	// system admin
+	KeyChangeReset = "reset"
+	// Key removed by its owner
+	KeyChangeRevocation = "revocation"
+)
+
+// sharesKeysWith returns whether the members of channel need the key of
+// userID, one of its members: this is the case in encrypted channels, and in
+// direct and group messages with other people.
+func (p *Plugin) sharesKeysWith(channel *model.Channel, userID string) bool {
+	if channel.Type == model.CHANNEL_DIRECT {
+		otherID := channel.GetOtherUserIdForDM(userID)
+		return otherID != "" && otherID != userID && otherID != p.BotUserID
+	}
+	return channel.IsGroupOrDirect() || p.ChanEncrMethods.get(channel.Id).IsEncrypted()
+}
+
+// keyChangeNotice returns the message posted in channels when the key of
+// userID changes, or an empty string if no notice is needed.
+func keyChangeNotice(userID string, username string, kind string, oldKeyID []byte, newKeyID []byte) string {
+	switch kind {
+	case KeyChangeRotation:
+		return fmt.Sprintf("The encryption key of @%s has **changed**.\nOld fingerprint: %s\nNew fingerprint: %s",
+			username, NewFingerprint(userID, oldKeyID).String(), NewFingerprint(userID, newKeyID).String())
+	case KeyChangeRevocation:
+		return fmt.Sprintf("@%s has **revoked** their encryption key.\nOld fingerprint: %s",
+			username, NewFingerprint(userID, oldKeyID).String())
+	case KeyChangeReset:
+		// Resets by the user only bring a new key, which is announced when
+		// the previous one is revoked
+		if oldKeyID == nil {
+			return ""
+		}
+		return fmt.Sprintf("A system admin has **reset** the encryption key of @%s.\nOld fingerprint: %s",
+			username, NewFingerprint(userID, oldKeyID).String())
+	default:
+		return ""
+	}
+}
+
+// PublishKeyChange records the change in the change feed, and tells the users
+// who share an encrypted channel, a direct or a group message with userID that
+// their key changed from oldKeyID to newKeyID (which are nil if there is no
+// such key), on behalf of the system admin adminID if not empty. The
+// newPubkey websocket event is broadcast once per shared channel, so that the
+// server does the fan out, leaving out the members who already got it through
+// another channel. Rotations and revocations are also announced by a notice
+// in the encrypted ones, unless muted.
+func (p *Plugin) PublishKeyChange(userID string, kind string, adminID string, oldKeyID []byte, newKeyID []byte) *model.AppError {
+	appErr := p.RecordPubKeyChange(userID, kind, adminID, newKeyID)
+	if appErr != nil {
+		return appErr
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+	notice := keyChangeNotice(userID, user.Username, kind, oldKeyID, newKeyID)
+	keyID := ""
+	if newKeyID != nil {
+		keyID = KeyIDString(newKeyID)
+	}
+
+	channels, appErr := p.getChannelsOfUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+	notified := map[string]bool{userID: true}
+	for _, channel := range channels {
+		if !p.sharesKeysWith(channel, userID) {
+			continue
+		}
+		appErr = p.BumpChanMembershipVersion(channel.Id)
+		if appErr != nil {
+			p.API.LogError("unable to bump channel membership version", "channel_id", channel.Id, "error", appErr.Error())
+		}
+		omitted, appErr := p.omitNotifiedMembers(channel.Id, notified)
+		if appErr != nil {
+			return appErr
+		}
+		if omitted != nil {
+			p.API.PublishWebSocketEvent("newPubkey",
+				map[string]interface{}{
+					"userID": userID,
+					"keyID":  keyID,
+					"kind":   kind,
+				},
+				&model.WebsocketBroadcast{ChannelId: channel.Id, OmitUsers: omitted})
+		}
+
+		// Unencrypted direct and group messages only get the event
+		if notice == "" || !p.ChanEncrMethods.get(channel.Id).IsEncrypted() {
+			continue
+		}
+		settings, appErr := p.GetChanSettings(channel.Id)
+		if appErr != nil {
+			p.API.LogError("unable to get channel settings", "channel_id", channel.Id, "error", appErr.Error())
+			continue
+		}
+		if settings.MuteKeyChanges {
+			continue
+		}
+		_, appErr = p.API.CreatePost(&model.Post{
+			Message:   notice,
+			UserId:    p.BotUserID,
+			ChannelId: channel.Id,
+		})
+		if appErr != nil {
+			p.API.LogError("unable to post key change notice", "channel_id", channel.Id, "error", appErr.Error())
+		}
+	}
+	return nil
+}
+
+// omitNotifiedMembers returns the members of chanID that are in notified,
+// and adds the other ones to notified. It returns nil if all the members were
+// already notified.
+func (p *Plugin) omitNotifiedMembers(chanID string, notified map[string]bool) (map[string]bool, *model.AppError) {
+	omitted := make(map[string]bool)
+	added := false
+	for page := 0; ; page++ {
+		members, appErr := p.API.GetChannelMembers(chanID, page, channelMembersPageSize)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, member := range *members {
+			if notified[member.UserId] {
+				omitted[member.UserId] = true
+			} else {
+				notified[member.UserId] = true
+				added = true
+			}
+		}
+		if len(*members) < channelMembersPageSize {
+			break
+		}
+	}
+	if !added {
+		return nil, nil
+	}
+	return omitted, nil
+}
+
+// PublishNewUserPubKey publishes the replacement of oldPubkey (nil if the user
+// had no key) by pubkey.
+func (p *Plugin) PublishNewUserPubKey(userID string, oldPubkey *PubKey, pubkey *PubKey) *model.AppError {
+	if oldPubkey != nil {
+		if bytes.Equal(oldPubkey.ID(), pubkey.ID()) {
+			return nil
+		}
+		return p.PublishKeyChange(userID, KeyChangeRotation, "", oldPubkey.ID(), pubkey.ID())
+	}
+	revoked, appErr := p.API.KVGet(StoreKeyPubKeyRevoked(userID))
+	if appErr != nil {
+		return appErr
+	}
+	if revoked != nil {
+		return p.PublishKeyChange(userID, KeyChangeReset, "", nil, pubkey.ID())
+	}
+	return p.PublishKeyChange(userID, KeyChangeRegistration, "", nil, pubkey.ID())
+}
+
+// SetChanKeyChangeNotices mutes or unmutes key change notices in a channel.
+// Members of direct and group messages can do it, and channel admins
+// elsewhere.
+func (p *Plugin) SetChanKeyChangeNotices(chanID string, userID string, enabled bool) *model.AppError {
+	channel, appErr := p.API.GetChannel(chanID)
+	if appErr != nil {
+		return appErr
+	}
+	var allowed bool
+	if channel.IsGroupOrDirect() {
+		_, appErr = p.API.GetChannelMember(chanID, userID)
+		allowed = appErr == nil
+	} else {
+		allowed, appErr = p.CanManageChanEncryption(chanID, userID)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	if !allowed {
+		return model.NewAppError("SetChanKeyChangeNotices", "mm-e2ee.not_allowed", nil, "only channel and system admins can mute key change notices", http.StatusForbidden)
+	}
+
+	_, appErr = p.UpdateChanSettings(chanID, func(settings *ChanSettings) bool {
+		if settings.MuteKeyChanges == !enabled {
+			return false
+		}
+		settings.MuteKeyChanges = !enabled
+		return true
+	})
+	return appErr
+}
+
+func (p *Plugin) ExecuteKeyNoticesCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	if len(cmdArgs) != 1 {
+		return &model.AppError{Message: "usage: /e2ee key_notices on|off"}
+	}
+	enabled, err := parseOnOff(cmdArgs[0])
+	if err != nil {
+		return &model.AppError{Message: err.Error()}
+	}
+	appErr := p.SetChanKeyChangeNotices(args.ChannelId, args.UserId, enabled)
+	if appErr != nil {
+		return appErr
+	}
+	if enabled {
+		p.postCommandResponse(args, "Key change notices are now posted in this channel.")
+	} else {
+		p.postCommandResponse(args, "Key change notices are now muted in this channel.")
+	}
+	return nil
+}
+
+func (p *Plugin) SetChanKeyChangeNoticesHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "invalid enabled value", http.StatusBadRequest)
+		return
+	}
+
+	appErr := p.SetChanKeyChangeNotices(chanID, c.UserID, enabled)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
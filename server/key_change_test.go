@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_keyChange_publish(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	muted, _ := json.Marshal(ChanSettings{MuteKeyChanges: true})
+	encrypted := &model.Channel{Id: "encrypted", Type: model.CHANNEL_PRIVATE}
+	encryptedMuted := &model.Channel{Id: "encrypted_muted", Type: model.CHANNEL_PRIVATE}
+	unencrypted := &model.Channel{Id: "clear", Type: model.CHANNEL_OPEN}
+	dm := &model.Channel{Id: "dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "user2")}
+	clearDM := &model.Channel{Id: "clear_dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "user3")}
+	botDM := &model.Channel{Id: "bot_dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "bot")}
+
+	mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "user1"}, nil)
+	mockAPI.On("GetTeamsForUser", "user1").Return([]*model.Team{{Id: "team1"}}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "user1", false).Return([]*model.Channel{dm, clearDM, botDM}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "team1", "user1", false).Return([]*model.Channel{encrypted, encryptedMuted, unencrypted, dm, clearDM, botDM}, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("encrypted")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("encrypted_muted")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("clear")).Return(nil, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("dm")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("clear_dm")).Return(nil, nil)
+	mockAPI.On("KVGet", ChanSettingsKey("encrypted")).Return(nil, nil)
+	mockAPI.On("KVGet", ChanSettingsKey("encrypted_muted")).Return(muted, nil)
+	mockAPI.On("KVGet", ChanSettingsKey("dm")).Return(nil, nil)
+	// A failing post doesn't prevent the next ones
+	mockAPI.On("CreatePost", mock.MatchedBy(func(post *model.Post) bool { return post.ChannelId == "encrypted" })).Return(nil, &model.AppError{Message: "failed"})
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+	mockAPI.On("LogError", "unable to post key change notice", "channel_id", "encrypted", "error", mock.Anything).Return()
+	mockAPI.On("PublishWebSocketEvent", "newPubkey", mock.Anything, mock.Anything).Return()
+	mockEmptyPubKeyChanges(&mockAPI)
+	mockAPI.On("KVGet", StoreKeyPubKeyHistory("user1")).Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", StoreKeyPubKeyHistory("user1"), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+	for _, chanID := range []string{"encrypted", "dm"} {
+		mockAPI.On("KVGet", ChanMembershipVersionKey(chanID)).Return(nil, nil)
+		mockAPI.On("KVSetWithOptions", ChanMembershipVersionKey(chanID), []byte("1"), mock.Anything).Return(true, nil)
+	}
+	// A failing bump doesn't prevent the next ones
+	mockAPI.On("KVGet", ChanMembershipVersionKey("encrypted_muted")).Return(nil, &model.AppError{Message: "failed"})
+	mockAPI.On("LogError", "unable to bump channel membership version", "channel_id", "encrypted_muted", "error", mock.Anything).Return()
+	members := map[string][]string{
+		"encrypted":       {"user1", "user2", "user4"},
+		"encrypted_muted": {"user1", "user4"},
+		"dm":              {"user1", "user2"},
+		"clear_dm":        {"user1", "user3"},
+	}
+	for chanID, userIDs := range members {
+		chanMembers := make(model.ChannelMembers, 0, len(userIDs))
+		for _, memberID := range userIDs {
+			chanMembers = append(chanMembers, model.ChannelMember{ChannelId: chanID, UserId: memberID})
+		}
+		mockAPI.On("GetChannelMembers", chanID, 0, channelMembersPageSize).Return(&chanMembers, nil)
+	}
+	mockAPI.On("PublishWebSocketEvent", "channelMembershipChanged", mock.Anything, mock.Anything).Return()
+
+	oldKey := GenerateValidPubKey()
+	newKey := GenerateValidPubKey()
+	tassert.Nil(p.PublishKeyChange("user1", KeyChangeRotation, "", oldKey.ID(), newKey.ID()))
+
+	// Muted channels and unencrypted DMs still get the event, but each member
+	// only gets it once, and the membership version of encrypted channels
+	// changed
+	mockAPI.AssertNumberOfCalls(t, "PublishWebSocketEvent", 3+2)
+	event := map[string]interface{}{"userID": "user1", "keyID": KeyIDString(newKey.ID()), "kind": KeyChangeRotation}
+	mockAPI.AssertCalled(t, "PublishWebSocketEvent", "newPubkey", event,
+		&model.WebsocketBroadcast{ChannelId: "dm", OmitUsers: map[string]bool{"user1": true}})
+	mockAPI.AssertCalled(t, "PublishWebSocketEvent", "newPubkey", event,
+		&model.WebsocketBroadcast{ChannelId: "clear_dm", OmitUsers: map[string]bool{"user1": true}})
+	mockAPI.AssertCalled(t, "PublishWebSocketEvent", "newPubkey", event,
+		&model.WebsocketBroadcast{ChannelId: "encrypted", OmitUsers: map[string]bool{"user1": true, "user2": true}})
+	mockAPI.AssertNumberOfCalls(t, "CreatePost", 2)
+	for _, chanID := range []string{"encrypted", "dm"} {
+		chanID := chanID
+		mockAPI.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+			return post.ChannelId == chanID && post.UserId == "bot"
+		}))
+	}
+}
+
+func Test_keyChange_resetNotice(t *testing.T) {
+	tassert := assert.New(t)
+	key := GenerateValidPubKey()
+
+	// A new key after a revocation was already announced by the revocation
+	tassert.Empty(keyChangeNotice("user1", "alice", KeyChangeReset, nil, key.ID()))
+	notice := keyChangeNotice("user1", "alice", KeyChangeReset, key.ID(), nil)
+	tassert.Contains(notice, "A system admin has **reset** the encryption key of @alice.")
+	tassert.Contains(notice, NewFingerprint("user1", key.ID()).String())
+}
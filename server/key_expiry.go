@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// How often the key expiry job runs, cluster wide
+	keyExpiryJobInterval = time.Hour
+	// Minimum delay between two reminders sent to a user
+	keyExpiryReminderInterval = 24 * time.Hour
+	// KVList page size used by the key expiry job
+	keyExpiryJobPageSize = 200
+
+	KeyExpiryJobLockKey = "keyExpiryJobLock"
+)
+
+// PubKeyMetadata holds what the server knows about a public key, aside from
+// the key itself.
+type PubKeyMetadata struct {
+	CreateAt int64 `json:"createAt"`
+	// Last time the owner of the key was reminded to rotate it
+	LastReminderAt int64 `json:"lastReminderAt"`
+}
+
+func StoreKeyPubKeyMeta(userID string) string {
+	return fmt.Sprintf("pubkey_meta:%s", userID)
+}
+
+func (p *Plugin) GetPubKeyMetadata(userID string) (*PubKeyMetadata, *model.AppError) {
+	data, appErr := p.API.KVGet(StoreKeyPubKeyMeta(userID))
+	if appErr != nil || data == nil {
+		return nil, appErr
+	}
+	var ret PubKeyMetadata
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, model.NewAppError("GetPubKeyMetadata", "mm-e2ee.invalid_pubkey_meta", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return &ret, nil
+}
+
+func (p *Plugin) SetPubKeyMetadata(userID string, meta *PubKeyMetadata) *model.AppError {
+	data, _ := json.Marshal(meta)
+	return p.API.KVSet(StoreKeyPubKeyMeta(userID), data)
+}
+
+// KeyExpiryPolicy tells when keys must be rotated.
+type KeyExpiryPolicy struct {
+	// Age after which owners are asked to rotate their key. Zero disables
+	// the policy.
+	MaxAge time.Duration
+	// Delay given to rotate a key once it reached MaxAge, after which it is
+	// considered expired
+	Grace time.Duration
+}
+
+func (c *configuration) keyExpiryPolicy() KeyExpiryPolicy {
+	ret := KeyExpiryPolicy{}
+	if c.MaxKeyAgeDays > 0 {
+		ret.MaxAge = time.Duration(c.MaxKeyAgeDays) * 24 * time.Hour
+	}
+	if c.KeyExpiryGraceDays > 0 {
+		ret.Grace = time.Duration(c.KeyExpiryGraceDays) * 24 * time.Hour
+	}
+	return ret
+}
+
+func (e KeyExpiryPolicy) Enabled() bool {
+	return e.MaxAge > 0
+}
+
+// ExpireAt returns when a key created at createAt expires, in milliseconds.
+func (e KeyExpiryPolicy) ExpireAt(createAt int64) int64 {
+	return createAt + (e.MaxAge + e.Grace).Milliseconds()
+}
+
+// IsExpiring returns whether a key created at createAt must be rotated.
+func (e KeyExpiryPolicy) IsExpiring(createAt int64, now int64) bool {
+	return e.Enabled() && now >= createAt+e.MaxAge.Milliseconds()
+}
+
+// IsExpired returns whether a key created at createAt is past its grace
+// period.
+func (e KeyExpiryPolicy) IsExpired(createAt int64, now int64) bool {
+	return e.Enabled() && now >= e.ExpireAt(createAt)
+}
+
+// IsUserPubKeyExpired returns whether the key of userID has expired. Keys
+// pushed before the policy was enabled are considered created when the
+// expiry job first saw them.
+func (p *Plugin) IsUserPubKeyExpired(userID string) (bool, *model.AppError) {
+	policy := p.getConfiguration().keyExpiryPolicy()
+	if !policy.Enabled() {
+		return false, nil
+	}
+	meta, appErr := p.GetPubKeyMetadata(userID)
+	if appErr != nil || meta == nil {
+		return false, appErr
+	}
+	return policy.IsExpired(meta.CreateAt, model.GetMillis()), nil
+}
+
+// StartKeyExpiryJob periodically runs RunKeyExpiryJob until
+// StopKeyExpiryJob is called.
+func (p *Plugin) StartKeyExpiryJob() {
+	p.keyExpiryJobStop = make(chan struct{})
+	p.keyExpiryJobDone = make(chan struct{})
+	go func() {
+		defer close(p.keyExpiryJobDone)
+		ticker := time.NewTicker(keyExpiryJobInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if appErr := p.RunKeyExpiryJob(); appErr != nil {
+					p.API.LogError("key expiry job failed", "error", appErr.Error())
+				}
+			case <-p.keyExpiryJobStop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Plugin) StopKeyExpiryJob() {
+	if p.keyExpiryJobStop == nil {
+		return
+	}
+	close(p.keyExpiryJobStop)
+	<-p.keyExpiryJobDone
+	p.keyExpiryJobStop = nil
+}
+
+// jobLock is a job lock held by this server.
+type jobLock struct {
+	key      string
+	value    []byte
+	interval time.Duration
+}
+
+// acquireJobLock returns the lock protected by key if this server got the
+// right to run the job for the next interval, nil otherwise. The lock is
+// never released: it expires, so that a job runs at most once per interval in
+// a cluster.
+func (p *Plugin) acquireJobLock(key string, interval time.Duration) (*jobLock, *model.AppError) {
+	lock := &jobLock{key: key, interval: interval}
+	acquired, appErr := p.setJobLock(lock, nil)
+	if appErr != nil || !acquired {
+		return nil, appErr
+	}
+	return lock, nil
+}
+
+// refreshJobLock extends lock for another interval, for jobs that may run
+// longer than that. It returns false if the lock expired and was acquired by
+// another server meanwhile.
+func (p *Plugin) refreshJobLock(lock *jobLock) (bool, *model.AppError) {
+	return p.setJobLock(lock, lock.value)
+}
+
+func (p *Plugin) setJobLock(lock *jobLock, old []byte) (bool, *model.AppError) {
+	data, _ := json.Marshal(model.GetMillis())
+	ok, appErr := p.API.KVSetWithOptions(lock.key, data, model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        old,
+		ExpireInSeconds: int64(lock.interval.Seconds()),
+	})
+	if appErr != nil || !ok {
+		return false, appErr
+	}
+	lock.value = data
+	return true, nil
+}
+
+// RunKeyExpiryJob reminds the users whose keys must be rotated to do so. It
+// does nothing if another server of the cluster already ran it recently.
+func (p *Plugin) RunKeyExpiryJob() *model.AppError {
+	policy := p.getConfiguration().keyExpiryPolicy()
+	if !policy.Enabled() {
+		return nil
+	}
+	lock, appErr := p.acquireJobLock(KeyExpiryJobLockKey, keyExpiryJobInterval)
+	if appErr != nil || lock == nil {
+		return appErr
+	}
+
+	now := model.GetMillis()
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, keyExpiryJobPageSize)
+		if appErr != nil {
+			return appErr
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, StoreKeyPubKeyPrefix) {
+				continue
+			}
+			appErr = p.checkUserKeyExpiry(strings.TrimPrefix(key, StoreKeyPubKeyPrefix), policy, now)
+			if appErr != nil {
+				return appErr
+			}
+		}
+		if len(keys) < keyExpiryJobPageSize {
+			return nil
+		}
+	}
+}
+
+func (p *Plugin) checkUserKeyExpiry(userID string, policy KeyExpiryPolicy, now int64) *model.AppError {
+	meta, appErr := p.GetPubKeyMetadata(userID)
+	if appErr != nil {
+		return appErr
+	}
+	if meta == nil {
+		// Key pushed before we started tracking their creation
+		return p.SetPubKeyMetadata(userID, &PubKeyMetadata{CreateAt: now})
+	}
+	if !policy.IsExpiring(meta.CreateAt, now) || now-meta.LastReminderAt < keyExpiryReminderInterval.Milliseconds() {
+		return nil
+	}
+
+	var msg string
+	expireAt := time.Unix(0, policy.ExpireAt(meta.CreateAt)*int64(time.Millisecond)).UTC()
+	if policy.IsExpired(meta.CreateAt, now) {
+		msg = "Your encryption key has **expired**. Please run `/e2ee init --force` to setup a new one."
+	} else {
+		msg = fmt.Sprintf("Your encryption key expires on %s. Please run `/e2ee init --force` to setup a new one before then.", expireAt.Format("January 2, 2006"))
+	}
+	appErr = p.SendBotDM(userID, msg)
+	if appErr != nil {
+		p.API.LogError("unable to send key expiry reminder", "user_id", userID, "error", appErr.Error())
+	}
+	meta.LastReminderAt = now
+	return p.SetPubKeyMetadata(userID, meta)
+}
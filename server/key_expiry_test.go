@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_keyExpiry_policy(t *testing.T) {
+	tassert := assert.New(t)
+	policy := (&configuration{MaxKeyAgeDays: 10, KeyExpiryGraceDays: 5}).keyExpiryPolicy()
+	day := (24 * time.Hour).Milliseconds()
+
+	tassert.False(policy.IsExpiring(0, 9*day))
+	tassert.True(policy.IsExpiring(0, 10*day))
+	tassert.False(policy.IsExpired(0, 14*day))
+	tassert.True(policy.IsExpired(0, 15*day))
+
+	disabled := (&configuration{KeyExpiryGraceDays: 5}).keyExpiryPolicy()
+	tassert.False(disabled.IsExpired(0, 100*day))
+}
+
+func Test_keyExpiry_job(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{MaxKeyAgeDays: 10, KeyExpiryGraceDays: 5})
+	tassert := assert.New(t)
+
+	now := model.GetMillis()
+	day := (24 * time.Hour).Milliseconds()
+	oldMeta, _ := json.Marshal(PubKeyMetadata{CreateAt: now - 11*day})
+	recentMeta, _ := json.Marshal(PubKeyMetadata{CreateAt: now - 11*day, LastReminderAt: now - day/2})
+	freshMeta, _ := json.Marshal(PubKeyMetadata{CreateAt: now - day})
+
+	mockAPI.On("KVSetWithOptions", KeyExpiryJobLockKey, mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil).Once()
+	mockAPI.On("KVList", 0, keyExpiryJobPageSize).Return([]string{
+		"pubkey:old", "pubkey:recent", "pubkey:fresh", "pubkey:unknown", "pubkey_meta:old", "chanEncrMethod:chan1",
+	}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyMeta("old")).Return(oldMeta, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyMeta("recent")).Return(recentMeta, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyMeta("fresh")).Return(freshMeta, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyMeta("unknown")).Return(nil, nil)
+	mockAPI.On("KVSet", StoreKeyPubKeyMeta("old"), mock.AnythingOfType("[]uint8")).Return(nil)
+	mockAPI.On("KVSet", StoreKeyPubKeyMeta("unknown"), mock.AnythingOfType("[]uint8")).Return(nil)
+	mockAPI.On("GetDirectChannel", "bot", "old").Return(&model.Channel{Id: "dm_old"}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	tassert.Nil(p.RunKeyExpiryJob())
+	mockAPI.AssertNumberOfCalls(t, "CreatePost", 1)
+	mockAPI.AssertCalled(t, "KVSet", StoreKeyPubKeyMeta("unknown"), mock.AnythingOfType("[]uint8"))
+	mockAPI.AssertNotCalled(t, "GetDirectChannel", "bot", "recent")
+
+	// Another server already ran the job
+	mockAPI.On("KVSetWithOptions", KeyExpiryJobLockKey, mock.AnythingOfType("[]uint8"), mock.Anything).Return(false, nil)
+	tassert.Nil(p.RunKeyExpiryJob())
+	mockAPI.AssertNumberOfCalls(t, "KVList", 1)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// Number of times GetChanKeyring retries if the membership of the channel
+	// changes while it is read
+	chanKeyringRetries = 3
+	// Number of channel members fetched at once
+	channelMembersPageSize = 200
+)
+
+func ChanMembershipVersionKey(chanID string) string {
+	return fmt.Sprintf("chanMembershipVersion:%s", chanID)
+}
+
+// GetChanMembershipVersion returns the version of the membership of an
+// encrypted channel. It is incremented every time a member joins or leaves
+// the channel, or changes their key.
+func (p *Plugin) GetChanMembershipVersion(chanID string) (int64, *model.AppError) {
+	data, appErr := p.API.KVGet(ChanMembershipVersionKey(chanID))
+	if appErr != nil || data == nil {
+		return 0, appErr
+	}
+	var ret int64
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return 0, model.NewAppError("GetChanMembershipVersion", "mm-e2ee.invalid_membership_version", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// BumpChanMembershipVersion increments the membership version of an encrypted
+// channel, and tells its members about it. Nothing is done for unencrypted
+// channels.
+func (p *Plugin) BumpChanMembershipVersion(chanID string) *model.AppError {
+	if !p.ChanEncrMethods.get(chanID).IsEncrypted() {
+		return nil
+	}
+	var version int64
+	appErr := p.kvAtomicUpdate(ChanMembershipVersionKey(chanID), func(old []byte) ([]byte, *model.AppError) {
+		version = 0
+		if old != nil {
+			_ = json.Unmarshal(old, &version)
+		}
+		version++
+		data, _ := json.Marshal(version)
+		return data, nil
+	})
+	if appErr != nil {
+		return appErr
+	}
+	p.API.PublishWebSocketEvent("channelMembershipChanged",
+		map[string]interface{}{
+			"chanID":  chanID,
+			"version": version,
+		},
+		&model.WebsocketBroadcast{ChannelId: chanID})
+	return nil
+}
+
+// ChanKeyring holds the keys of all the members of a channel, at a given
+// membership version.
+type ChanKeyring struct {
+	ChanID  string `json:"chanID"`
+	Version int64  `json:"version"`
+	// Keys by user ID, nil for members without a key
+	PubKeys map[string]*PubKey `json:"pubKeys"`
+}
+
+func (p *Plugin) getChanKeyring(chanID string, version int64) (*ChanKeyring, *model.AppError) {
+	ret := &ChanKeyring{ChanID: chanID, Version: version, PubKeys: make(map[string]*PubKey)}
+	for page := 0; ; page++ {
+		users, appErr := p.API.GetUsersInChannel(chanID, model.CHANNEL_SORT_BY_USERNAME, page, channelMembersPageSize)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, user := range users {
+			pubkey, err := p.GetUserPubKey(user.Id)
+			if err != nil {
+				return nil, model.NewAppError("getChanKeyring", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+			}
+			ret.PubKeys[user.Id] = pubkey
+		}
+		if len(users) < channelMembersPageSize {
+			return ret, nil
+		}
+	}
+}
+
+// GetChanKeyring returns the keys of all the members of chanID, along with
+// the membership version they correspond to.
+func (p *Plugin) GetChanKeyring(chanID string) (*ChanKeyring, *model.AppError) {
+	version, appErr := p.GetChanMembershipVersion(chanID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	for i := 0; i < chanKeyringRetries; i++ {
+		keyring, appErr := p.getChanKeyring(chanID, version)
+		if appErr != nil {
+			return nil, appErr
+		}
+		newVersion, appErr := p.GetChanMembershipVersion(chanID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if newVersion == version {
+			return keyring, nil
+		}
+		version = newVersion
+	}
+	return nil, model.NewAppError("GetChanKeyring", "mm-e2ee.concurrent_update", nil, "the members of this channel are changing too fast", http.StatusConflict)
+}
+
+// encryptedPostMembership is the part of the e2ee property of encrypted posts
+// that tells which membership version the sender used.
+type encryptedPostMembership struct {
+	MembershipVersion *int64 `json:"membershipVersion"`
+}
+
+// CheckMembershipVersion returns why post must be rejected if it has been
+// encrypted for an out-of-date membership of its channel, or an empty string.
+// Posts that don't tell their membership version are accepted.
+func (p *Plugin) CheckMembershipVersion(post *model.Post) (string, *model.AppError) {
+	if !p.getConfiguration().RejectStaleMembership {
+		return "", nil
+	}
+	data, err := json.Marshal(post.GetProp("e2ee"))
+	if err != nil {
+		return "", model.NewAppError("CheckMembershipVersion", "mm-e2ee.invalid_post", nil, err.Error(), http.StatusBadRequest)
+	}
+	var membership encryptedPostMembership
+	if err := json.Unmarshal(data, &membership); err != nil {
+		return "", model.NewAppError("CheckMembershipVersion", "mm-e2ee.invalid_post", nil, err.Error(), http.StatusBadRequest)
+	}
+	if membership.MembershipVersion == nil {
+		return "", nil
+	}
+	version, appErr := p.GetChanMembershipVersion(post.ChannelId)
+	if appErr != nil {
+		return "", appErr
+	}
+	if *membership.MembershipVersion < version {
+		return "The members of this channel (or their keys) changed while you were writing your message. Please send it again.", nil
+	}
+	return "", nil
+}
+
+func (p *Plugin) GetChanKeyringHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+
+	// Check user is in channel
+	_, appErr := p.API.GetChannelMember(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	keyring, appErr := p.GetChanKeyring(chanID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	if appErr := p.checkAllPubKeyLookupsRate(c.UserID, len(keyring.PubKeys)); appErr != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, keyring)
+}
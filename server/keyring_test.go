@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_plugin_ServeHTTP_GetChanKeyring(t *testing.T) {
+	mockAPI := plugintest.API{}
+	user1Key := GenerateValidPubKey()
+	user1KeyJSON, _ := json.Marshal(user1Key)
+
+	mockAPI.On("GetChannelMember", "chan1", "user1").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("GetChannelMember", "chan1", "other").Return(nil, &model.AppError{})
+	mockAPI.On("KVGet", ChanMembershipVersionKey("chan1")).Return([]byte("4"), nil)
+	mockAPI.On("GetUsersInChannel", "chan1", model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{{Id: "user1"}, {Id: "user2"}}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(user1KeyJSON, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user2")).Return(nil, nil)
+
+	apiURL := "/api/v1/channel/keyring?chanID=chan1"
+	tests := []TestDesc{
+		{
+			name: "member",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL,
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body: ChanKeyring{
+					ChanID:  "chan1",
+					Version: 4,
+					PubKeys: map[string]*PubKey{"user1": &user1Key, "user2": nil},
+				},
+			},
+			userID: "user1",
+		},
+		{
+			name: "not member",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL,
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusUnauthorized,
+			},
+			userID: "other",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
+
+func Test_keyring_rejectStaleMembership(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{RejectStaleMembership: true})
+	tassert := assert.New(t)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan1")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanSettingsKey("chan1")).Return(nil, nil)
+	mockAPI.On("KVGet", ChanMembershipVersionKey("chan1")).Return([]byte("4"), nil)
+
+	post := func(version interface{}) *model.Post {
+		ret := &model.Post{UserId: "user1", ChannelId: "chan1", Type: "custom_e2ee"}
+		e2ee := map[string]interface{}{}
+		if version != nil {
+			e2ee["membershipVersion"] = version
+		}
+		ret.AddProp("e2ee", e2ee)
+		return ret
+	}
+
+	_, reason := p.MessageWillBePosted(nil, post(3))
+	tassert.NotEqual("", reason)
+	_, reason = p.MessageWillBePosted(nil, post(4))
+	tassert.Equal("", reason)
+	_, reason = p.MessageWillBePosted(nil, post(nil))
+	tassert.Equal("", reason)
+}
+
+func Test_keyring_bumpMembershipVersion(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan1")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey("chan2")).Return(nil, nil)
+	mockAPI.On("KVGet", ChanMembershipVersionKey("chan1")).Return([]byte("4"), nil)
+	mockAPI.On("KVSetWithOptions", ChanMembershipVersionKey("chan1"), []byte("5"), mock.Anything).Return(true, nil)
+	mockAPI.On("PublishWebSocketEvent", "channelMembershipChanged", map[string]interface{}{"chanID": "chan1", "version": int64(5)},
+		&model.WebsocketBroadcast{ChannelId: "chan1"}).Return()
+
+	tassert.Nil(p.BumpChanMembershipVersion("chan1"))
+	mockAPI.AssertCalled(t, "PublishWebSocketEvent", "channelMembershipChanged", mock.Anything, mock.Anything)
+
+	// Unencrypted channels are left alone
+	tassert.Nil(p.BumpChanMembershipVersion("chan2"))
+	mockAPI.AssertNumberOfCalls(t, "KVSetWithOptions", 1)
+}
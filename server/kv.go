@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin"
+)
+
+// kvAtomicUpdateRetries is the number of times kvAtomicUpdate tries to update
+// a value that is concurrently modified.
+const kvAtomicUpdateRetries = 5
+
+// kvAtomicUpdate atomically replaces the value of key by update(old value).
+// old is nil if the key doesn't exist. If update returns nil, the value isn't
+// modified.
+func (p *Plugin) kvAtomicUpdate(key string, update func(old []byte) ([]byte, *model.AppError)) *model.AppError {
+	return kvAtomicUpdateWithAPI(p.API, key, update)
+}
+
+// kvAtomicUpdateWithAPI is kvAtomicUpdate, for code that only has access to
+// the plugin API.
+func kvAtomicUpdateWithAPI(api plugin.API, key string, update func(old []byte) ([]byte, *model.AppError)) *model.AppError {
+	for i := 0; i < kvAtomicUpdateRetries; i++ {
+		old, appErr := api.KVGet(key)
+		if appErr != nil {
+			return appErr
+		}
+		data, appErr := update(old)
+		if appErr != nil || data == nil {
+			return appErr
+		}
+		ok, appErr := api.KVSetWithOptions(key, data, model.PluginKVSetOptions{Atomic: true, OldValue: old})
+		if appErr != nil {
+			return appErr
+		}
+		if ok {
+			return nil
+		}
+	}
+	return model.NewAppError("kvAtomicUpdate", "mm-e2ee.concurrent_update", nil, "too many concurrent updates of "+key, http.StatusConflict)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// MaxMonitorReportEntries is the maximum number of distinct (user, post type,
+// rule) entries recorded in a monitor report.
+const MaxMonitorReportEntries = 500
+
+// MonitorReportEntry counts the unencrypted posts of a given type sent by a
+// user, that a rule would have rejected if encryption was enforced.
+type MonitorReportEntry struct {
+	UserID   string `json:"userID"`
+	PostType string `json:"postType"`
+	// Empty if no rule matched
+	RuleID string `json:"ruleID"`
+	Count  int    `json:"count"`
+	LastAt int64  `json:"lastAt"`
+}
+
+// MonitorReport summarizes the would-be rejections of a channel in monitor
+// mode.
+type MonitorReport struct {
+	Since   int64                `json:"since"`
+	Entries []MonitorReportEntry `json:"entries"`
+}
+
+func MonitorReportKey(chanID string) string {
+	return fmt.Sprintf("monitorReport:%s", chanID)
+}
+
+// monitorFlushInterval is how often the would-be rejections counted in
+// memory are added to the monitor reports.
+const monitorFlushInterval = 10 * time.Second
+
+type monitorEntryKey struct {
+	userID   string
+	postType string
+	ruleID   string
+}
+
+type pendingMonitorEntry struct {
+	count   int
+	firstAt int64
+	lastAt  int64
+}
+
+// monitorCounts aggregates in memory the would-be rejections seen by this
+// server until they are flushed. Updating the report of a busy channel on
+// every post would make the servers of a cluster conflict on it.
+type monitorCounts struct {
+	lock sync.Mutex
+	// Pending entries by channel ID
+	channels map[string]map[monitorEntryKey]*pendingMonitorEntry
+}
+
+func (c *monitorCounts) add(chanID string, key monitorEntryKey, entry pendingMonitorEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.channels == nil {
+		c.channels = make(map[string]map[monitorEntryKey]*pendingMonitorEntry)
+	}
+	entries := c.channels[chanID]
+	if entries == nil {
+		entries = make(map[monitorEntryKey]*pendingMonitorEntry)
+		c.channels[chanID] = entries
+	}
+	e := entries[key]
+	if e == nil {
+		if len(entries) >= MaxMonitorReportEntries {
+			return
+		}
+		entries[key] = &entry
+		return
+	}
+	e.count += entry.count
+	if entry.firstAt < e.firstAt {
+		e.firstAt = entry.firstAt
+	}
+	if entry.lastAt > e.lastAt {
+		e.lastAt = entry.lastAt
+	}
+}
+
+// take returns the pending entries of all channels and forgets them.
+func (c *monitorCounts) take() map[string]map[monitorEntryKey]*pendingMonitorEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := c.channels
+	c.channels = nil
+	return ret
+}
+
+// get returns a copy of the pending entries of chanID.
+func (c *monitorCounts) get(chanID string) map[monitorEntryKey]*pendingMonitorEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := make(map[monitorEntryKey]*pendingMonitorEntry, len(c.channels[chanID]))
+	for key, e := range c.channels[chanID] {
+		entry := *e
+		ret[key] = &entry
+	}
+	return ret
+}
+
+func (c *monitorCounts) reset(chanID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.channels, chanID)
+}
+
+// countSince returns how many of the posts of e were seen at or after since.
+// Only the first and last ones are timestamped, so the posts of an entry that
+// straddles since are split in proportion of the time before and after it.
+func (e *pendingMonitorEntry) countSince(since int64) int {
+	if e.firstAt >= since {
+		return e.count
+	}
+	if e.lastAt < since {
+		return 0
+	}
+	// The last post was seen after since
+	count := int(int64(e.count-1)*(e.lastAt-since)/(e.lastAt-e.firstAt)) + 1
+	if count > e.count {
+		count = e.count
+	}
+	return count
+}
+
+// mergeMonitorEntries adds pending entries to report. Posts seen before the
+// report started belong to a previous one and are left out.
+func mergeMonitorEntries(report *MonitorReport, pending map[monitorEntryKey]*pendingMonitorEntry) {
+	for key, pe := range pending {
+		count := pe.countSince(report.Since)
+		if count == 0 {
+			continue
+		}
+		found := false
+		for i := range report.Entries {
+			e := &report.Entries[i]
+			if e.UserID == key.userID && e.PostType == key.postType && e.RuleID == key.ruleID {
+				e.Count += count
+				if pe.lastAt > e.LastAt {
+					e.LastAt = pe.lastAt
+				}
+				found = true
+				break
+			}
+		}
+		// Don't grow forever, but keep counting the known entries
+		if !found && len(report.Entries) < MaxMonitorReportEntries {
+			report.Entries = append(report.Entries, MonitorReportEntry{
+				UserID:   key.userID,
+				PostType: key.postType,
+				RuleID:   key.ruleID,
+				Count:    count,
+				LastAt:   pe.lastAt,
+			})
+		}
+	}
+}
+
+// GetMonitorReport returns the report of chanID, including the would-be
+// rejections this server hasn't flushed yet.
+func (p *Plugin) GetMonitorReport(chanID string) (*MonitorReport, *model.AppError) {
+	data, appErr := p.API.KVGet(MonitorReportKey(chanID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &MonitorReport{Entries: make([]MonitorReportEntry, 0)}
+	if data != nil {
+		if err := json.Unmarshal(data, ret); err != nil {
+			return nil, model.NewAppError("GetMonitorReport", "mm-e2ee.invalid_monitor_report", nil, err.Error(), http.StatusInternalServerError)
+		}
+	}
+	pending := p.monitorCounts.get(chanID)
+	if data == nil {
+		ret.Since = oldestPendingMonitorEntry(pending)
+	}
+	mergeMonitorEntries(ret, pending)
+	return ret, nil
+}
+
+func oldestPendingMonitorEntry(pending map[monitorEntryKey]*pendingMonitorEntry) int64 {
+	var ret int64
+	for _, e := range pending {
+		if ret == 0 || e.firstAt < ret {
+			ret = e.firstAt
+		}
+	}
+	return ret
+}
+
+// RecordWouldBeRejection records that post would have been rejected by
+// ruleID if encryption was enforced on its channel. It is only counted in
+// memory until FlushMonitorCounts runs.
+func (p *Plugin) RecordWouldBeRejection(post *model.Post, ruleID string) {
+	now := model.GetMillis()
+	p.monitorCounts.add(post.ChannelId,
+		monitorEntryKey{userID: post.UserId, postType: post.Type, ruleID: ruleID},
+		pendingMonitorEntry{count: 1, firstAt: now, lastAt: now})
+}
+
+// ResetMonitorReport starts a new monitor report for chanID. Would-be
+// rejections other servers haven't flushed yet only count in the new report
+// if they were seen after it started.
+func (p *Plugin) ResetMonitorReport(chanID string) *model.AppError {
+	p.monitorCounts.reset(chanID)
+	data, _ := json.Marshal(MonitorReport{Since: model.GetMillis(), Entries: make([]MonitorReportEntry, 0)})
+	return p.API.KVSet(MonitorReportKey(chanID), data)
+}
+
+// FlushMonitorCounts adds the would-be rejections counted in memory to the
+// monitor reports. Counts that couldn't be saved are kept for the next
+// flush.
+func (p *Plugin) FlushMonitorCounts() {
+	for chanID, pending := range p.monitorCounts.take() {
+		appErr := p.kvAtomicUpdate(MonitorReportKey(chanID), func(old []byte) ([]byte, *model.AppError) {
+			report := MonitorReport{Since: oldestPendingMonitorEntry(pending), Entries: make([]MonitorReportEntry, 0)}
+			if old != nil {
+				_ = json.Unmarshal(old, &report)
+			}
+			mergeMonitorEntries(&report, pending)
+			data, _ := json.Marshal(report)
+			return data, nil
+		})
+		if appErr != nil {
+			p.API.LogError("unable to save monitor report", "channel_id", chanID, "error", appErr.Error())
+			for key, e := range pending {
+				p.monitorCounts.add(chanID, key, *e)
+			}
+		}
+	}
+}
+
+// StartMonitorFlushJob periodically runs FlushMonitorCounts until
+// StopMonitorFlushJob is called.
+func (p *Plugin) StartMonitorFlushJob() {
+	p.monitorFlushJobStop = make(chan struct{})
+	p.monitorFlushJobDone = make(chan struct{})
+	go func() {
+		defer close(p.monitorFlushJobDone)
+		ticker := time.NewTicker(monitorFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.FlushMonitorCounts()
+			case <-p.monitorFlushJobStop:
+				p.FlushMonitorCounts()
+				return
+			}
+		}
+	}()
+}
+
+func (p *Plugin) StopMonitorFlushJob() {
+	if p.monitorFlushJobStop == nil {
+		return
+	}
+	close(p.monitorFlushJobStop)
+	<-p.monitorFlushJobDone
+	p.monitorFlushJobStop = nil
+}
+
+// FormatMonitorReport returns a human readable summary of report.
+func (p *Plugin) FormatMonitorReport(report *MonitorReport) (string, *model.AppError) {
+	if len(report.Entries) == 0 {
+		return "No message would have been rejected so far.", nil
+	}
+
+	entries := make([]MonitorReportEntry, len(report.Entries))
+	copy(entries, report.Entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Count > entries[j].Count })
+
+	total := 0
+	msg := "| User | Post type | Rule | Messages |\n|---|---|---|---|\n"
+	for _, e := range entries {
+		user, appErr := p.API.GetUser(e.UserID)
+		if appErr != nil {
+			return "", appErr
+		}
+		postType := e.PostType
+		if postType == "" {
+			postType = "(regular message)"
+		}
+		rule := e.RuleID
+		if rule == "" {
+			rule = "(no rule matched)"
+		}
+		msg += fmt.Sprintf("| @%s | %s | %s | %d |\n", user.Username, postType, rule, e.Count)
+		total += e.Count
+	}
+	return fmt.Sprintf("%d messages would have been rejected:\n\n", total) + msg, nil
+}
+
+func (p *Plugin) checkCanSeeMonitorReport(chanID string, userID string) *model.AppError {
+	allowed, appErr := p.CanManageChanEncryption(chanID, userID)
+	if appErr != nil {
+		return appErr
+	}
+	if !allowed {
+		return model.NewAppError("checkCanSeeMonitorReport", "mm-e2ee.not_allowed", nil, "only channel and system admins can see the monitor report", http.StatusForbidden)
+	}
+	return nil
+}
+
+func (p *Plugin) GetMonitorReportHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+	appErr := p.checkCanSeeMonitorReport(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	report, appErr := p.GetMonitorReport(chanID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, report)
+}
+
+func (p *Plugin) ExecuteMonitorReportCommand(args *model.CommandArgs) *model.AppError {
+	appErr := p.checkCanSeeMonitorReport(args.ChannelId, args.UserId)
+	if appErr != nil {
+		return appErr
+	}
+	report, appErr := p.GetMonitorReport(args.ChannelId)
+	if appErr != nil {
+		return appErr
+	}
+	msg, appErr := p.FormatMonitorReport(report)
+	if appErr != nil {
+		return appErr
+	}
+	if p.ChanEncrMethods.get(args.ChannelId) != ChanEncryptionMethodMonitor {
+		msg = "**Note**: this channel is not in monitor mode anymore.\n" + msg
+	}
+	p.postCommandResponse(args, msg)
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_monitor_recordWouldBeRejection(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	monitor, _ := json.Marshal(ChanEncryptionMethodMonitor)
+	rules, _ := json.Marshal([]PostingRule{
+		{ID: "jitsi", PostType: "custom_jitsi", Action: PostingRuleAllow},
+		{ID: "deny-user", UserID: "baduser", Action: PostingRuleDeny},
+	})
+	report, _ := json.Marshal(MonitorReport{Since: 1, Entries: []MonitorReportEntry{
+		{UserID: "user1", PostType: "", RuleID: "", Count: 2, LastAt: 1},
+	}})
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(monitor, nil)
+	mockAPI.On("KVGet", PostingRulesKey).Return(rules, nil)
+	mockAPI.On("KVGet", MonitorReportKey(chanID)).Return(report, nil)
+
+	var stored []byte
+	mockAPI.On("KVSetWithOptions", MonitorReportKey(chanID), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil).Run(func(args mock.Arguments) {
+		stored = args.Get(1).([]byte)
+	})
+
+	// Allowed by a rule, nothing is recorded
+	post, reason := p.MessageWillBePosted(nil, &model.Post{UserId: "user1", ChannelId: chanID, Type: "custom_jitsi"})
+	tassert.Nil(post)
+	tassert.Equal("", reason)
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+
+	// Would have been rejected, but is let through
+	for i := 0; i < 3; i++ {
+		post, reason = p.MessageWillBePosted(nil, &model.Post{UserId: "user1", ChannelId: chanID})
+		tassert.Nil(post)
+		tassert.Equal("", reason)
+	}
+	post, reason = p.MessageWillBePosted(nil, &model.Post{UserId: "baduser", ChannelId: chanID})
+	tassert.Nil(post)
+	tassert.Equal("", reason)
+
+	// Counts are seen by this server before they are flushed
+	current, appErr := p.GetMonitorReport(chanID)
+	tassert.Nil(appErr)
+	tassert.Len(current.Entries, 2)
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+
+	// and saved at once
+	p.FlushMonitorCounts()
+	mockAPI.AssertNumberOfCalls(t, "KVSetWithOptions", 1)
+	var newReport MonitorReport
+	tassert.Nil(json.Unmarshal(stored, &newReport))
+	tassert.Equal(int64(1), newReport.Since)
+	tassert.Len(newReport.Entries, 2)
+	tassert.Equal(5, newReport.Entries[0].Count)
+	tassert.Equal("deny-user", newReport.Entries[1].RuleID)
+
+	p.FlushMonitorCounts()
+	mockAPI.AssertNumberOfCalls(t, "KVSetWithOptions", 1)
+}
+
+func Test_monitor_flushConflicts(t *testing.T) {
+	tassert := assert.New(t)
+	const nodes = 4
+	kv := newTestKVStore()
+	plugins := make([]*Plugin, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		p, _ := newTestNode(kv)
+		plugins = append(plugins, p)
+	}
+	tassert.Nil(plugins[0].ResetMonitorReport("chan1"))
+
+	for _, p := range plugins {
+		for i := 0; i < 100; i++ {
+			p.RecordWouldBeRejection(&model.Post{UserId: "user1", ChannelId: "chan1"}, "")
+		}
+	}
+	kv.syncFirstReads(nodes)
+	var wg sync.WaitGroup
+	for _, p := range plugins {
+		wg.Add(1)
+		go func(p *Plugin) {
+			defer wg.Done()
+			p.FlushMonitorCounts()
+		}(p)
+	}
+	wg.Wait()
+
+	report, appErr := plugins[0].GetMonitorReport("chan1")
+	tassert.Nil(appErr)
+	tassert.Len(report.Entries, 1)
+	tassert.Equal(nodes*100, report.Entries[0].Count)
+
+	// Counts seen before the report was reset belong to the previous one
+	plugins[1].monitorCounts.add("chan1", monitorEntryKey{userID: "user1"}, pendingMonitorEntry{count: 1, firstAt: 1, lastAt: 1})
+	plugins[1].FlushMonitorCounts()
+	report, appErr = plugins[0].GetMonitorReport("chan1")
+	tassert.Nil(appErr)
+	tassert.Equal(nodes*100, report.Entries[0].Count)
+
+	// Counts straddling the reset are split
+	since := report.Since
+	plugins[1].monitorCounts.add("chan1", monitorEntryKey{userID: "user2"}, pendingMonitorEntry{count: 11, firstAt: since - 1000, lastAt: since + 1000})
+	plugins[1].FlushMonitorCounts()
+	report, appErr = plugins[0].GetMonitorReport("chan1")
+	tassert.Nil(appErr)
+	tassert.Len(report.Entries, 2)
+	tassert.Equal(6, report.Entries[1].Count)
+}
+
+func Test_monitor_countSince(t *testing.T) {
+	tassert := assert.New(t)
+	e := pendingMonitorEntry{count: 5, firstAt: 100, lastAt: 200}
+	tassert.Equal(5, e.countSince(100))
+	tassert.Equal(0, e.countSince(201))
+	tassert.Equal(1, e.countSince(200))
+	tassert.Equal(3, e.countSince(150))
+}
+
+func Test_plugin_ServeHTTP_GetMonitorReport(t *testing.T) {
+	mockAPI := plugintest.API{}
+	report := MonitorReport{Since: 1, Entries: []MonitorReportEntry{
+		{UserID: "user1", PostType: "custom_jitsi", RuleID: "", Count: 4, LastAt: 2},
+	}}
+	reportJSON, _ := json.Marshal(report)
+	mockAPI.On("KVGet", MonitorReportKey("chan1")).Return(reportJSON, nil)
+	mockAPI.On("GetChannelMember", "chan1", "admin").Return(&model.ChannelMember{SchemeAdmin: true}, nil)
+	mockAPI.On("GetChannelMember", "chan1", "user1").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("HasPermissionTo", "user1", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+
+	apiURL := "/api/v1/channel/monitor_report?chanID=chan1"
+	tests := []TestDesc{
+		{
+			name: "not admin",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL,
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			userID: "user1",
+		},
+		{
+			name: "channel admin",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL,
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body:       report,
+			},
+			userID: "admin",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
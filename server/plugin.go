@@ -13,19 +13,10 @@ import (
 )
 
 const (
-	helpTextHeader = "###### Mattermost E2EE Plugin - Slash command help\n"
-	helpText       = `
-* |/e2ee help| - print this help message.
-* |/e2ee init [--force] [gpg key fingerprint]| - initialize E2EE for your account. This will generate a new key for your session. Use --force to erase an existing key.
-* |/e2ee start| - encrypt the messages you send in this channel.
-* |/e2ee stop| - do not encrypt the messages you send in this channel.
-* |/e2ee import| - import your private key into this device.
-* |/e2ee show_backup| - show saved encrypted GPG backup.
-`
-	autoCompleteDescription = "Available commands: init import help"
-	autoCompleteHint        = "[command][subcommands]"
-	pluginDescription       = "End to end message encryption"
-	slashCommandName        = "e2ee"
+	helpTextHeader    = "###### Mattermost E2EE Plugin - Slash command help\n"
+	autoCompleteHint  = "[command][subcommands]"
+	pluginDescription = "End to end message encryption"
+	slashCommandName  = "e2ee"
 )
 
 // Plugin implements the interface expected by the Mattermost server to communicate between the server and plugin processes.
@@ -43,7 +34,23 @@ type Plugin struct {
 	// setConfiguration for usage.
 	configuration *configuration
 
-	AlwaysAllowMsgTypes map[string]bool
+	// TeamGuestPolicies maps team names to the guest policy of their encrypted
+	// channels
+	TeamGuestPolicies map[string]string
+
+	keyExpiryJobStop chan struct{}
+	keyExpiryJobDone chan struct{}
+
+	monitorCounts       monitorCounts
+	monitorFlushJobStop chan struct{}
+	monitorFlushJobDone chan struct{}
+
+	pubKeyLookups pubKeyLookupLimiter
+
+	chanMethodCache   *ttlCache
+	pubKeyCache       *ttlCache
+	botCache          *ttlCache
+	postingRulesCache *ttlCache
 
 	router *mux.Router
 }
@@ -56,8 +63,9 @@ func GetSlashCommand() *model.Command {
 		DisplayName:      slashCommandName,
 		Description:      pluginDescription,
 		AutoComplete:     true,
-		AutoCompleteDesc: autoCompleteDescription,
+		AutoCompleteDesc: pluginDescription,
 		AutoCompleteHint: autoCompleteHint,
+		AutocompleteData: GetAutocompleteData(),
 	}
 }
 
@@ -79,6 +87,22 @@ func (p *Plugin) OnActivate() error {
 	}
 	p.BotUserID = botID
 
+	p.StartKeyExpiryJob()
+	p.StartMonitorFlushJob()
+
+	// Data not migrated yet is still handled while migrations run
+	go func() {
+		if appErr := p.RunMigrations(); appErr != nil {
+			p.API.LogError("unable to migrate stored data", "error", appErr.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (p *Plugin) OnDeactivate() error {
+	p.StopKeyExpiryJob()
+	p.StopMonitorFlushJob()
 	return nil
 }
 
@@ -91,6 +115,20 @@ func (p *Plugin) postCommandResponse(args *model.CommandArgs, text string) {
 	_ = p.API.SendEphemeralPost(args.UserId, post)
 }
 
+// SendBotDM sends msg to userID as a direct message from our bot.
+func (p *Plugin) SendBotDM(userID string, msg string) *model.AppError {
+	channel, appErr := p.API.GetDirectChannel(p.BotUserID, userID)
+	if appErr != nil {
+		return appErr
+	}
+	_, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.BotUserID,
+		ChannelId: channel.Id,
+		Message:   msg,
+	})
+	return appErr
+}
+
 func (p *Plugin) ShowGPGBackup(args *model.CommandArgs) *model.AppError {
 	backupGPG, appErr := p.API.KVGet(StoreBackupGPGKey(args.UserId))
 	if appErr != nil {
@@ -115,20 +153,15 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return &model.CommandResponse{}, nil
 	}
 
-	if action == "help" {
-		p.postCommandResponse(args, helpTextHeader+helpText)
-		return &model.CommandResponse{}, nil
+	sub := getSubcommand(action)
+	if sub == nil {
+		return &model.CommandResponse{}, &model.AppError{Message: fmt.Sprintf("unknown command %v, run /e2ee help to list the available commands", action)}
 	}
-
-	if action == "show_backup" {
-		appErr := p.ShowGPGBackup(args)
-		if appErr != nil {
-			return &model.CommandResponse{}, appErr
-		}
-		return &model.CommandResponse{}, nil
+	var cmdArgs []string
+	if len(split) > 2 {
+		cmdArgs = split[2:]
 	}
-
-	return &model.CommandResponse{}, &model.AppError{Message: fmt.Sprintf("unknown command %v", action)}
+	return &model.CommandResponse{}, p.RunSubcommand(sub, args, cmdArgs)
 }
 
 // See https://developers.mattermost.com/extend/plugins/server/reference/
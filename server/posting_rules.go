@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// PostingRulesKey is where the ordered list of posting rules is stored.
+const PostingRulesKey = "postingRules"
+
+// AnyBot matches every bot in PostingRule.BotUsername.
+const AnyBot = "*"
+
+// Outcomes of a posting rule
+const (
+	PostingRuleAllow = "allow"
+	PostingRuleDeny  = "deny"
+	// Allow the post, but warn its author that it wasn't encrypted
+	PostingRuleWarn = "warn"
+)
+
+// PostingRule tells what to do with an unencrypted post sent to an encrypted
+// channel. Empty criteria match everything, and a rule applies if all its
+// criteria match.
+type PostingRule struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	UserID      string `json:"userID,omitempty"`
+	// Username of a bot, or AnyBot
+	BotUsername string `json:"botUsername,omitempty"`
+	PostType    string `json:"postType,omitempty"`
+	ChannelID   string `json:"channelID,omitempty"`
+	TeamID      string `json:"teamID,omitempty"`
+	FromWebhook *bool  `json:"fromWebhook,omitempty"`
+	Action      string `json:"action"`
+}
+
+func (r *PostingRule) IsValid() error {
+	switch r.Action {
+	case PostingRuleAllow, PostingRuleDeny, PostingRuleWarn:
+		return nil
+	default:
+		return fmt.Errorf("rule %s: invalid action '%s'", r.ID, r.Action)
+	}
+}
+
+// postingRuleSubject gives the properties of a post matched by posting rules.
+// The author and channel of the post are only fetched if a rule needs them.
+type postingRuleSubject struct {
+	p    *Plugin
+	post *model.Post
+
+	bot     *botFlag
+	channel *model.Channel
+}
+
+// botFlag tells whether a user is a bot, and its username if so.
+type botFlag struct {
+	isBot    bool
+	username string
+}
+
+// getBotFlag tells whether userID is a bot. It is cached, as it is needed
+// for most posts when bots are allowed to post unencrypted messages.
+func (p *Plugin) getBotFlag(userID string) (botFlag, *model.AppError) {
+	if cached, ok := p.botCache.get(userID); ok {
+		return cached.(botFlag), nil
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return botFlag{}, appErr
+	}
+	ret := botFlag{isBot: user.IsBot}
+	if user.IsBot {
+		ret.username = user.Username
+	}
+	p.botCache.set(userID, ret)
+	return ret, nil
+}
+
+func (s *postingRuleSubject) getBotFlag() (botFlag, *model.AppError) {
+	if s.bot == nil {
+		bot, appErr := s.p.getBotFlag(s.post.UserId)
+		if appErr != nil {
+			return botFlag{}, appErr
+		}
+		s.bot = &bot
+	}
+	return *s.bot, nil
+}
+
+func (s *postingRuleSubject) getChannel() (*model.Channel, *model.AppError) {
+	if s.channel == nil {
+		channel, appErr := s.p.API.GetChannel(s.post.ChannelId)
+		if appErr != nil {
+			return nil, appErr
+		}
+		s.channel = channel
+	}
+	return s.channel, nil
+}
+
+func (s *postingRuleSubject) fromWebhook() bool {
+	v, _ := s.post.GetProp("from_webhook").(string)
+	return v == "true"
+}
+
+func (r *PostingRule) matches(s *postingRuleSubject) (bool, *model.AppError) {
+	if r.UserID != "" && r.UserID != s.post.UserId {
+		return false, nil
+	}
+	if r.PostType != "" && r.PostType != s.post.Type {
+		return false, nil
+	}
+	if r.ChannelID != "" && r.ChannelID != s.post.ChannelId {
+		return false, nil
+	}
+	if r.FromWebhook != nil && *r.FromWebhook != s.fromWebhook() {
+		return false, nil
+	}
+	if r.BotUsername != "" {
+		bot, appErr := s.getBotFlag()
+		if appErr != nil {
+			return false, appErr
+		}
+		if !bot.isBot || (r.BotUsername != AnyBot && r.BotUsername != bot.username) {
+			return false, nil
+		}
+	}
+	if r.TeamID != "" {
+		channel, appErr := s.getChannel()
+		if appErr != nil {
+			return false, appErr
+		}
+		if r.TeamID != channel.TeamId {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// PostingDecision is the result of the evaluation of the posting rules
+// against a post.
+type PostingDecision struct {
+	Action string `json:"action"`
+	// ID of the rule that decided, empty if none matched
+	RuleID string `json:"ruleID"`
+}
+
+// EvaluatePostingRules returns what to do with post, which is an unencrypted
+// post sent to an encrypted channel. The first matching rule wins, and posts
+// are denied if none matches.
+func (p *Plugin) EvaluatePostingRules(rules []PostingRule, post *model.Post) (PostingDecision, *model.AppError) {
+	subject := &postingRuleSubject{p: p, post: post}
+	for _, rule := range rules {
+		match, appErr := rule.matches(subject)
+		if appErr != nil {
+			return PostingDecision{Action: PostingRuleDeny}, appErr
+		}
+		if match {
+			return PostingDecision{Action: rule.Action, RuleID: rule.ID}, nil
+		}
+	}
+	return PostingDecision{Action: PostingRuleDeny}, nil
+}
+
+// PostingRulesFromConfiguration converts the legacy BotCanAlwaysPost and
+// AlwaysAllowMsgTypes settings into equivalent posting rules.
+func PostingRulesFromConfiguration(c *configuration) []PostingRule {
+	ret := make([]PostingRule, 0)
+	if c.BotCanAlwaysPost {
+		ret = append(ret, PostingRule{
+			ID:          "legacy-bots",
+			Description: "Bots can always post (from the BotCanAlwaysPost setting)",
+			BotUsername: AnyBot,
+			Action:      PostingRuleAllow,
+		})
+	}
+	for _, v := range strings.Split(c.AlwaysAllowMsgTypes, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		ret = append(ret, PostingRule{
+			ID:          "legacy-type-" + v,
+			Description: "From the AlwaysAllowMsgTypes setting",
+			PostType:    v,
+			Action:      PostingRuleAllow,
+		})
+	}
+	return ret
+}
+
+// GetPostingRules returns the stored posting rules. They must not be
+// modified, as they may be cached.
+func (p *Plugin) GetPostingRules() ([]PostingRule, *model.AppError) {
+	if cached, ok := p.postingRulesCache.get(PostingRulesKey); ok {
+		return cached.([]PostingRule), nil
+	}
+	data, appErr := p.API.KVGet(PostingRulesKey)
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := make([]PostingRule, 0)
+	if data != nil {
+		if err := json.Unmarshal(data, &ret); err != nil {
+			return nil, model.NewAppError("GetPostingRules", "mm-e2ee.invalid_posting_rules", nil, err.Error(), http.StatusInternalServerError)
+		}
+	}
+	p.postingRulesCache.set(PostingRulesKey, ret)
+	return ret, nil
+}
+
+// GetEffectivePostingRules returns the stored posting rules, followed by the
+// ones equivalent to the legacy settings.
+func (p *Plugin) GetEffectivePostingRules() ([]PostingRule, *model.AppError) {
+	stored, appErr := p.GetPostingRules()
+	if appErr != nil {
+		return nil, appErr
+	}
+	legacy := PostingRulesFromConfiguration(p.getConfiguration())
+	ret := make([]PostingRule, 0, len(stored)+len(legacy))
+	ret = append(ret, stored...)
+	return append(ret, legacy...), nil
+}
+
+func (p *Plugin) SetPostingRules(rules []PostingRule) *model.AppError {
+	ids := make(map[string]bool, len(rules))
+	for i := range rules {
+		if rules[i].ID == "" {
+			rules[i].ID = model.NewId()
+		}
+		if err := rules[i].IsValid(); err != nil {
+			return model.NewAppError("SetPostingRules", "mm-e2ee.invalid_posting_rules", nil, err.Error(), http.StatusBadRequest)
+		}
+		if ids[rules[i].ID] {
+			return model.NewAppError("SetPostingRules", "mm-e2ee.invalid_posting_rules", nil, fmt.Sprintf("duplicate rule ID %s", rules[i].ID), http.StatusBadRequest)
+		}
+		ids[rules[i].ID] = true
+	}
+	data, _ := json.Marshal(rules)
+	appErr := p.API.KVSet(PostingRulesKey, data)
+	p.postingRulesCache.invalidate(PostingRulesKey)
+	return appErr
+}
+
+func (p *Plugin) GetPostingRulesHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	rules, appErr := p.GetPostingRules()
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, rules)
+}
+
+func (p *Plugin) SetPostingRulesHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	var rules []PostingRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appErr := p.SetPostingRules(rules)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, rules)
+}
+
+type PostingRulesDryRunRequest struct {
+	UserID      string `json:"userID"`
+	ChannelID   string `json:"channelID"`
+	PostType    string `json:"postType"`
+	FromWebhook bool   `json:"fromWebhook"`
+}
+
+// PostingRulesDryRun tells what the posting rules would decide for an
+// unencrypted post sent to an encrypted channel.
+func (p *Plugin) PostingRulesDryRun(c *Context, w http.ResponseWriter, r *http.Request) {
+	var req PostingRulesDryRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	post := &model.Post{
+		UserId:    req.UserID,
+		ChannelId: req.ChannelID,
+		Type:      req.PostType,
+	}
+	if req.FromWebhook {
+		post.AddProp("from_webhook", "true")
+	}
+
+	rules, appErr := p.GetEffectivePostingRules()
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	decision, appErr := p.EvaluatePostingRules(rules, post)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, decision)
+}
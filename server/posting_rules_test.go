@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_postingrules_fromConfiguration(t *testing.T) {
+	rules := PostingRulesFromConfiguration(&configuration{
+		BotCanAlwaysPost:    true,
+		AlwaysAllowMsgTypes: " custom_jitsi, ,custom_poll",
+	})
+	tassert := assert.New(t)
+	tassert.Len(rules, 3)
+	tassert.Equal(AnyBot, rules[0].BotUsername)
+	tassert.Equal("custom_jitsi", rules[1].PostType)
+	tassert.Equal("custom_poll", rules[2].PostType)
+	for _, rule := range rules {
+		tassert.Equal(PostingRuleAllow, rule.Action)
+	}
+}
+
+func Test_plugin_ServeHTTP_PostingRulesDryRun(t *testing.T) {
+	const adminID = "admin"
+
+	yes := true
+	rules := []PostingRule{
+		{ID: "deny-user", UserID: "baduser", Action: PostingRuleDeny},
+		{ID: "webhooks", FromWebhook: &yes, Action: PostingRuleWarn},
+		{ID: "jitsi", PostType: "custom_jitsi", Action: PostingRuleAllow},
+		{ID: "bot", BotUsername: "github", Action: PostingRuleAllow},
+		{ID: "team", TeamID: "team1", Action: PostingRuleWarn},
+	}
+	rulesJSON, _ := json.Marshal(rules)
+
+	mockAPI := plugintest.API{}
+	mockAPI.On("HasPermissionTo", adminID, model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	mockAPI.On("HasPermissionTo", "user1", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+	mockAPI.On("KVGet", PostingRulesKey).Return(rulesJSON, nil)
+	mockAPI.On("GetUser", "baduser").Return(&model.User{Username: "baduser"}, nil)
+	mockAPI.On("GetUser", "user1").Return(&model.User{Username: "user1"}, nil)
+	mockAPI.On("GetUser", "githubbot").Return(&model.User{Username: "github", IsBot: true}, nil)
+	mockAPI.On("GetUser", "otherbot").Return(&model.User{Username: "other", IsBot: true}, nil)
+	mockAPI.On("GetChannel", "chan1").Return(&model.Channel{Id: "chan1", TeamId: "team1"}, nil)
+	mockAPI.On("GetChannel", "chan2").Return(&model.Channel{Id: "chan2", TeamId: "team2"}, nil)
+
+	apiURL := "/api/v1/admin/posting_rules/dry_run"
+	dryRun := func(name string, req PostingRulesDryRunRequest, expected PostingDecision) TestDesc {
+		return TestDesc{
+			name: name,
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL,
+				Body:   req,
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body:       expected,
+			},
+			userID: adminID,
+		}
+	}
+
+	tests := []TestDesc{
+		{
+			name: "not admin",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    apiURL,
+				Body:   PostingRulesDryRunRequest{UserID: "user1", ChannelID: "chan1"},
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusForbidden,
+			},
+			userID: "user1",
+		},
+		dryRun("denied user", PostingRulesDryRunRequest{UserID: "baduser", ChannelID: "chan1", PostType: "custom_jitsi"},
+			PostingDecision{Action: PostingRuleDeny, RuleID: "deny-user"}),
+		dryRun("webhook", PostingRulesDryRunRequest{UserID: "user1", ChannelID: "chan2", FromWebhook: true},
+			PostingDecision{Action: PostingRuleWarn, RuleID: "webhooks"}),
+		dryRun("post type", PostingRulesDryRunRequest{UserID: "user1", ChannelID: "chan2", PostType: "custom_jitsi"},
+			PostingDecision{Action: PostingRuleAllow, RuleID: "jitsi"}),
+		dryRun("bot", PostingRulesDryRunRequest{UserID: "githubbot", ChannelID: "chan2"},
+			PostingDecision{Action: PostingRuleAllow, RuleID: "bot"}),
+		dryRun("team", PostingRulesDryRunRequest{UserID: "otherbot", ChannelID: "chan1"},
+			PostingDecision{Action: PostingRuleWarn, RuleID: "team"}),
+		dryRun("no match", PostingRulesDryRunRequest{UserID: "user1", ChannelID: "chan2"},
+			PostingDecision{Action: PostingRuleDeny}),
+	}
+	RunTests(&tests, t, &mockAPI)
+}
+
+func Test_postingrules_store(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+	p.setConfiguration(&configuration{CacheTTLSeconds: 60, BotCanAlwaysPost: true})
+
+	rules, appErr := p.GetEffectivePostingRules()
+	tassert.Nil(appErr)
+	tassert.Equal([]string{"legacy-bots"}, postingRuleIDs(rules))
+
+	appErr = p.SetPostingRules([]PostingRule{{ID: "a", Action: PostingRuleDeny}, {ID: "a", Action: PostingRuleAllow}})
+	tassert.NotNil(appErr)
+	tassert.Equal(http.StatusBadRequest, appErr.StatusCode)
+
+	// Rules are cached until they are set again, and the legacy settings
+	// still apply after them
+	tassert.Nil(p.SetPostingRules([]PostingRule{{ID: "a", Action: PostingRuleDeny}}))
+	for i := 0; i < 3; i++ {
+		rules, appErr = p.GetEffectivePostingRules()
+		tassert.Nil(appErr)
+		tassert.Equal([]string{"a", "legacy-bots"}, postingRuleIDs(rules))
+	}
+	mockAPI.AssertNumberOfCalls(t, "KVGet", 2)
+}
+
+func postingRuleIDs(rules []PostingRule) []string {
+	ret := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		ret = append(ret, rule.ID)
+	}
+	return ret
+}
@@ -1,19 +1,32 @@
 package main
 
 import (
+	"context"
 	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
+	"net/http"
+	"strings"
 
 	"github.com/mattermost/mattermost-server/v5/model"
 )
 
 var ECCurve = elliptic.P256()
 
+// StoreKeyPubKeyPrefix starts the KV keys of public keys, which end with the
+// user ID.
+const StoreKeyPubKeyPrefix = "pubkey:"
+
 func StoreKeyPubKey(userID string) string {
-	return fmt.Sprintf("pubkey:%s", userID)
+	return StoreKeyPubKeyPrefix + userID
+}
+
+func StoreKeyPubKeyRevoked(userID string) string {
+	return fmt.Sprintf("pubkey_revoked:%s", userID)
 }
 
 func StoreBackupGPGKey(userID string) string {
@@ -25,6 +38,87 @@ type PubKey struct {
 	Sign []byte `json:"encr"`
 }
 
+const (
+	// PubKeyRecordVersion is the version of the format of public keys in the
+	// KV store. Keys stored before it existed are plain PubKey objects.
+	PubKeyRecordVersion = 1
+	// DefaultDeviceID is the device of the key of a user. Users have a single
+	// key, shared by their devices.
+	DefaultDeviceID = "default"
+)
+
+// StoredPubKey is a public key as stored in the KV store.
+type StoredPubKey struct {
+	// Uncompressed ECDH point, to encrypt messages for the owner of the key
+	ECDH []byte `json:"ecdh"`
+	// Uncompressed ECDSA point, to check the signature of their messages
+	ECDSA []byte `json:"ecdsa"`
+}
+
+// PubKeyRecord holds the public keys of a user, by device.
+type PubKeyRecord struct {
+	// 0 for keys stored before versioning
+	Version int                      `json:"version"`
+	Devices map[string]*StoredPubKey `json:"devices"`
+}
+
+func NewPubKeyRecord(pk *PubKey) *PubKeyRecord {
+	return &PubKeyRecord{
+		Version: PubKeyRecordVersion,
+		Devices: map[string]*StoredPubKey{
+			// JSON tags of PubKey are swapped: Sign holds the ECDH point
+			DefaultDeviceID: {ECDH: pk.Sign, ECDSA: pk.Encr},
+		},
+	}
+}
+
+// PubKey returns the key of the default device, nil if there is none.
+func (r *PubKeyRecord) PubKey() *PubKey {
+	stored := r.Devices[DefaultDeviceID]
+	if stored == nil {
+		return nil
+	}
+	return &PubKey{Encr: stored.ECDSA, Sign: stored.ECDH}
+}
+
+// ParsePubKeyRecord decodes public keys stored in the current format, or in
+// the one used before versioning.
+func ParsePubKeyRecord(data []byte) (*PubKeyRecord, error) {
+	var record PubKeyRecord
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	if record.Version > PubKeyRecordVersion {
+		return nil, fmt.Errorf("unsupported public key format version %d", record.Version)
+	}
+	if record.Version == 0 {
+		var pubkey PubKey
+		err = json.Unmarshal(data, &pubkey)
+		if err != nil {
+			return nil, err
+		}
+		record = *NewPubKeyRecord(&pubkey)
+		record.Version = 0
+	}
+	return &record, nil
+}
+
+// ID returns the identifier of a public key, which is the SHA256 of its ECDH
+// and ECDSA points, like computed by the webapp.
+func (pubkey *PubKey) ID() []byte {
+	h := sha256.New()
+	// JSON tags are swapped: Sign holds the ECDH point
+	h.Write(pubkey.Sign)
+	h.Write(pubkey.Encr)
+	return h.Sum(nil)
+}
+
+// KeyIDString encodes a key ID like in encrypted posts.
+func KeyIDString(keyID []byte) string {
+	return base64.StdEncoding.EncodeToString(keyID)
+}
+
 type ECPoint struct {
 	x big.Int
 	y big.Int
@@ -92,19 +186,42 @@ func (pubkey *PubKey) Validate() bool {
 }
 
 func (p *Plugin) SetUserPubKey(userID string, pk *PubKey) error {
-	pubkeyData, err := json.Marshal(pk)
+	pubkeyData, err := json.Marshal(NewPubKeyRecord(pk))
 	if err != nil {
 		return err
 	}
 
 	appErr := p.API.KVSet(StoreKeyPubKey(userID), pubkeyData)
+	p.pubKeyCache.invalidate(StoreKeyPubKey(userID))
 	if appErr != nil {
 		return errors.New(appErr.Error())
 	}
 	return nil
 }
 
+// GetUserPubKey returns the public key of userID, or nil if they have none.
+// The returned key must not be modified, as it may be cached.
 func (p *Plugin) GetUserPubKey(userID string) (*PubKey, error) {
+	key := StoreKeyPubKey(userID)
+	if cached, ok := p.pubKeyCache.get(key); ok {
+		return cached.(*PubKey), nil
+	}
+	record, err := p.GetUserPubKeyRecord(userID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		p.pubKeyCache.set(key, (*PubKey)(nil))
+		return nil, nil
+	}
+	pubkey := record.PubKey()
+	p.pubKeyCache.set(key, pubkey)
+	return pubkey, nil
+}
+
+// GetUserPubKeyRecord returns the public keys of all the devices of userID,
+// nil if they have none. It isn't cached.
+func (p *Plugin) GetUserPubKeyRecord(userID string) (*PubKeyRecord, error) {
 	pubkeyJSON, appErr := p.API.KVGet(StoreKeyPubKey(userID))
 	if appErr != nil {
 		return nil, errors.New(appErr.Error())
@@ -112,12 +229,91 @@ func (p *Plugin) GetUserPubKey(userID string) (*PubKey, error) {
 	if pubkeyJSON == nil {
 		return nil, nil
 	}
-	var pubkey PubKey
-	err := json.Unmarshal(pubkeyJSON, &pubkey)
+	return ParsePubKeyRecord(pubkeyJSON)
+}
+
+// PubKeyRevocation records that a user revoked their key. It stays after the
+// user registers a new key.
+type PubKeyRevocation struct {
+	RevokeAt int64 `json:"revokeAt"`
+}
+
+// RevokeUserPubKey removes the public key of userID, so that nobody encrypts
+// messages for it anymore.
+func (p *Plugin) RevokeUserPubKey(userID string) *model.AppError {
+	return p.removeUserPubKey(userID, KeyChangeRevocation, "")
+}
+
+// ResetUserPubKey removes the public key of userID like RevokeUserPubKey, on
+// behalf of the system admin adminID.
+func (p *Plugin) ResetUserPubKey(userID string, adminID string) *model.AppError {
+	return p.removeUserPubKey(userID, KeyChangeReset, adminID)
+}
+
+func (p *Plugin) removeUserPubKey(userID string, kind string, adminID string) *model.AppError {
+	pubkey, err := p.GetUserPubKey(userID)
 	if err != nil {
-		return nil, err
+		return model.NewAppError("RevokeUserPubKey", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if pubkey == nil {
+		return model.NewAppError("RevokeUserPubKey", "mm-e2ee.no_pubkey", nil, "no public key to revoke", http.StatusNotFound)
+	}
+	data, _ := json.Marshal(PubKeyRevocation{RevokeAt: model.GetMillis()})
+	appErr := p.API.KVSet(StoreKeyPubKeyRevoked(userID), data)
+	if appErr != nil {
+		return appErr
+	}
+	appErr = p.API.KVDelete(StoreKeyPubKey(userID))
+	p.pubKeyCache.invalidate(StoreKeyPubKey(userID))
+	if appErr != nil {
+		return appErr
+	}
+
+	if appErr := p.IndexUserPubKey(userID, pubkey, nil); appErr != nil {
+		p.API.LogError("unable to unindex public key", "user_id", userID, "error", appErr.Error())
+	}
+
+	if appErr := p.PublishKeyChange(userID, kind, adminID, pubkey.ID(), nil); appErr != nil {
+		p.API.LogError("unable to notify key revocation", "user_id", userID, "error", appErr.Error())
+	}
+
+	// Going through all the channels of the user can take a while
+	go func() {
+		if appErr := p.EnforceStrictMembershipOfUser(userID); appErr != nil {
+			p.API.LogError("unable to enforce strict membership", "user_id", userID, "error", appErr.Error())
+		}
+	}()
+	return nil
+}
+
+// migratePubKeyRecords rewrites the public keys stored in keys in the
+// current format.
+func (p *Plugin) migratePubKeyRecords(keys []string) *model.AppError {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, StoreKeyPubKeyPrefix) {
+			continue
+		}
+		appErr := p.kvAtomicUpdate(key, func(old []byte) ([]byte, *model.AppError) {
+			if old == nil {
+				return nil, nil
+			}
+			record, err := ParsePubKeyRecord(old)
+			if err != nil {
+				p.API.LogError("unable to migrate public key", "key", key, "error", err.Error())
+				return nil, nil
+			}
+			if record.Version == PubKeyRecordVersion {
+				return nil, nil
+			}
+			record.Version = PubKeyRecordVersion
+			data, _ := json.Marshal(record)
+			return data, nil
+		})
+		if appErr != nil {
+			return appErr
+		}
 	}
-	return &pubkey, nil
+	return nil
 }
 
 func (p *Plugin) HasUserPubKey(userID string) (bool, *model.AppError) {
@@ -128,33 +324,77 @@ func (p *Plugin) HasUserPubKey(userID string) (bool, *model.AppError) {
 	return pk != nil, nil
 }
 
-func (p *Plugin) GetChannelMembersWithoutKeys(chanID string) ([]string, *model.AppError) {
-	ret := make([]string, 0)
+// ChannelMembersReport sorts the active members of a channel according to
+// what matters for E2EE.
+type ChannelMembersReport struct {
+	// IDs of members without an encryption key
+	WithoutKeys []string
+	// IDs of guest accounts
+	Guests []string
+	// Users by ID
+	Users map[string]*model.User
+	// Only some members have been checked, because the deadline passed
+	Incomplete bool
+}
 
-	cfg := p.API.GetConfig()
-	maxUsersPerTeam := *cfg.TeamSettings.MaxUsersPerTeam
-	members, appErr := p.API.GetChannelMembers(chanID, 0, maxUsersPerTeam)
-	if appErr != nil {
-		return ret, appErr
+// Mentions returns the mentions of userIDs, separated by spaces.
+func (r *ChannelMembersReport) Mentions(userIDs []string) string {
+	ret := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		ret = append(ret, "@"+r.Users[userID].Username)
 	}
+	return strings.Join(ret, " ")
+}
 
-	for _, member := range *members {
-		userID := member.UserId
-		hasKey, appErr := p.HasUserPubKey(userID)
-		if appErr != nil {
-			return ret, appErr
-		}
-		if hasKey {
-			continue
+func (p *Plugin) GetChannelMembersReport(chanID string) (*ChannelMembersReport, *model.AppError) {
+	return p.GetChannelMembersReportWithin(context.Background(), chanID)
+}
+
+// GetChannelMembersReportWithin reports on the members of chanID, fetched
+// page by page. If ctx is done before all of them have been fetched, the
+// report only covers the members seen so far, and is flagged as incomplete.
+func (p *Plugin) GetChannelMembersReportWithin(ctx context.Context, chanID string) (*ChannelMembersReport, *model.AppError) {
+	ret := &ChannelMembersReport{
+		WithoutKeys: make([]string, 0),
+		Guests:      make([]string, 0),
+		Users:       make(map[string]*model.User),
+	}
+
+	for page := 0; ; page++ {
+		if ctx.Err() != nil {
+			ret.Incomplete = true
+			return ret, nil
 		}
-		user, appErr := p.API.GetUser(userID)
+		users, appErr := p.API.GetUsersInChannel(chanID, model.CHANNEL_SORT_BY_USERNAME, page, channelMembersPageSize)
 		if appErr != nil {
 			return ret, appErr
 		}
-		if user.DeleteAt != 0 {
-			continue
+		for _, user := range users {
+			if user.DeleteAt != 0 {
+				continue
+			}
+			hasKey, appErr := p.HasUserPubKey(user.Id)
+			if appErr != nil {
+				return ret, appErr
+			}
+			ret.Users[user.Id] = user
+			if !hasKey {
+				ret.WithoutKeys = append(ret.WithoutKeys, user.Id)
+			}
+			if user.IsGuest() {
+				ret.Guests = append(ret.Guests, user.Id)
+			}
+		}
+		if len(users) < channelMembersPageSize {
+			return ret, nil
 		}
-		ret = append(ret, userID)
 	}
-	return ret, nil
+}
+
+func (p *Plugin) GetChannelMembersWithoutKeys(chanID string) ([]string, *model.AppError) {
+	report, appErr := p.GetChannelMembersReport(chanID)
+	if appErr != nil {
+		return make([]string, 0), appErr
+	}
+	return report.WithoutKeys, nil
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Who users can get the public keys of
+const (
+	// Every user
+	PubKeyVisibilityAll = "all"
+	// Users who share a team, a direct or a group message with them
+	PubKeyVisibilityTeam = "team"
+	// Users who share a channel with them, including direct and group
+	// messages
+	PubKeyVisibilityChannel = "channel"
+)
+
+func (c *configuration) pubKeyVisibility() string {
+	switch c.PubKeyVisibility {
+	case PubKeyVisibilityTeam, PubKeyVisibilityChannel:
+		return c.PubKeyVisibility
+	default:
+		return PubKeyVisibilityAll
+	}
+}
+
+// pubKeyViewer tells which public keys a user can see, according to the
+// configured visibility policy.
+type pubKeyViewer struct {
+	p      *Plugin
+	userID string
+	policy string
+	// Teams and channels of the user, according to the policy
+	memberships *userMemberships
+	// Whether the user can see the key of each user checked so far
+	visible map[string]bool
+}
+
+func (p *Plugin) newPubKeyViewer(userID string) (*pubKeyViewer, *model.AppError) {
+	config := p.getConfiguration()
+	ret := &pubKeyViewer{p: p, userID: userID, policy: config.pubKeyVisibility(), visible: make(map[string]bool)}
+	if ret.policy == PubKeyVisibilityAll {
+		return ret, nil
+	}
+	if config.AdminsSeeAllPubKeys && p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM) {
+		ret.policy = PubKeyVisibilityAll
+		return ret, nil
+	}
+
+	var appErr *model.AppError
+	ret.memberships, appErr = p.getUserMemberships(userID, ret.policy)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return ret, nil
+}
+
+// userMemberships are the teams and channels of a user that matter for a
+// visibility policy.
+type userMemberships struct {
+	teamIDs map[string]bool
+	// All the channels of the user if channels must be shared, direct and
+	// group messages otherwise
+	channelIDs map[string]bool
+}
+
+// getUserMemberships returns the memberships of userID for policy.
+func (p *Plugin) getUserMemberships(userID string, policy string) (*userMemberships, *model.AppError) {
+	ret := new(userMemberships)
+	var appErr *model.AppError
+	ret.teamIDs, appErr = p.getTeamIDsOfUser(userID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	// An empty team ID gives us direct and group channels, which are also
+	// returned for every team
+	teamIDs := []string{""}
+	if policy == PubKeyVisibilityChannel {
+		for teamID := range ret.teamIDs {
+			teamIDs = append(teamIDs, teamID)
+		}
+	}
+	ret.channelIDs = make(map[string]bool)
+	for _, teamID := range teamIDs {
+		channels, appErr := p.API.GetChannelsForTeamForUser(teamID, userID, false)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, channel := range channels {
+			ret.channelIDs[channel.Id] = true
+		}
+	}
+	return ret, nil
+}
+
+func (p *Plugin) getTeamIDsOfUser(userID string) (map[string]bool, *model.AppError) {
+	teams, appErr := p.API.GetTeamsForUser(userID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := make(map[string]bool, len(teams))
+	for _, team := range teams {
+		ret[team.Id] = true
+	}
+	return ret, nil
+}
+
+func sharesOne(a map[string]bool, b map[string]bool) bool {
+	for id := range b {
+		if a[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSee returns whether the viewer can get the public key of userID.
+func (v *pubKeyViewer) CanSee(userID string) (bool, *model.AppError) {
+	if v.policy == PubKeyVisibilityAll || userID == v.userID {
+		return true, nil
+	}
+	if visible, ok := v.visible[userID]; ok {
+		return visible, nil
+	}
+	visible, appErr := v.sharesWith(userID)
+	if appErr != nil {
+		return false, appErr
+	}
+	v.visible[userID] = visible
+	return visible, nil
+}
+
+// sharesWith returns whether userID shares what the policy requires with the
+// viewer. Only the channels of userID in teams the viewer is also in are
+// listed, as no other channel can be shared.
+func (v *pubKeyViewer) sharesWith(userID string) (bool, *model.AppError) {
+	teamIDs, appErr := v.p.getTeamIDsOfUser(userID)
+	if appErr != nil {
+		return false, appErr
+	}
+	candidates := []string{""}
+	if v.policy == PubKeyVisibilityTeam {
+		if sharesOne(v.memberships.teamIDs, teamIDs) {
+			return true, nil
+		}
+	} else {
+		for teamID := range teamIDs {
+			if v.memberships.teamIDs[teamID] {
+				candidates = append(candidates, teamID)
+			}
+		}
+	}
+	for _, teamID := range candidates {
+		channels, appErr := v.p.API.GetChannelsForTeamForUser(teamID, userID, false)
+		if appErr != nil {
+			return false, appErr
+		}
+		for _, channel := range channels {
+			if v.memberships.channelIDs[channel.Id] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkCanSeePubKey returns the error given to users without a key if viewerID
+// can't see the key of userID, so that this doesn't tell whether they have
+// one.
+func (p *Plugin) checkCanSeePubKey(viewerID string, userID string) *model.AppError {
+	viewer, appErr := p.newPubKeyViewer(viewerID)
+	if appErr != nil {
+		return appErr
+	}
+	visible, appErr := viewer.CanSee(userID)
+	if appErr != nil {
+		return appErr
+	}
+	if !visible {
+		return model.NewAppError("checkCanSeePubKey", "mm-e2ee.no_pubkey", nil, "this user has no public key", http.StatusNotFound)
+	}
+	return nil
+}
+
+// pubKeyLookupLimiter counts the public keys looked up by each user during the
+// current minute. Counts are local to each server of a cluster.
+type pubKeyLookupLimiter struct {
+	lock   sync.Mutex
+	minute int64
+	counts map[string]int
+}
+
+// Allow returns how many of n more keys userID can look up, and counts them.
+// limit is the number of keys allowed per minute, 0 meaning no limit.
+func (l *pubKeyLookupLimiter) Allow(userID string, n int, limit int, now time.Time) int {
+	return l.allow(userID, n, limit, now, false)
+}
+
+// AllowAll counts n more keys looked up by userID and returns true if they
+// can all be looked up, and counts none of them otherwise.
+func (l *pubKeyLookupLimiter) AllowAll(userID string, n int, limit int, now time.Time) bool {
+	return l.allow(userID, n, limit, now, true) == n
+}
+
+func (l *pubKeyLookupLimiter) allow(userID string, n int, limit int, now time.Time, all bool) int {
+	if limit <= 0 {
+		return n
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	minute := now.Unix() / 60
+	if l.counts == nil || l.minute != minute {
+		l.minute = minute
+		l.counts = make(map[string]int)
+	}
+	allowed := limit - l.counts[userID]
+	if allowed >= n {
+		allowed = n
+	} else if all || allowed < 0 {
+		allowed = 0
+	}
+	l.counts[userID] += allowed
+	return allowed
+}
+
+func errPubKeyLookupRate(where string) *model.AppError {
+	return model.NewAppError(where, "mm-e2ee.rate_limited", nil, "too many public keys requested, please retry later", http.StatusTooManyRequests)
+}
+
+// checkPubKeyLookupRate returns how many of n keys userID can look up, or an
+// error if they can't look up any more for now.
+func (p *Plugin) checkPubKeyLookupRate(userID string, n int) (int, *model.AppError) {
+	allowed := p.pubKeyLookups.Allow(userID, n, p.getConfiguration().PubKeyLookupsPerMinute, time.Now())
+	if allowed > 0 || n == 0 {
+		return allowed, nil
+	}
+	return 0, errPubKeyLookupRate("checkPubKeyLookupRate")
+}
+
+// checkAllPubKeyLookupsRate returns an error if userID can't look up all of n
+// keys for now, for responses that can't be partial.
+func (p *Plugin) checkAllPubKeyLookupsRate(userID string, n int) *model.AppError {
+	if p.pubKeyLookups.AllowAll(userID, n, p.getConfiguration().PubKeyLookupsPerMinute, time.Now()) {
+		return nil
+	}
+	return errPubKeyLookupRate("checkAllPubKeyLookupsRate")
+}
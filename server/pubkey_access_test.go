@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPubKeyAccessTestPlugin returns a plugin where user shares a team with
+// teammate, a direct message with dm_partner, and nothing with stranger.
+func newPubKeyAccessTestPlugin() (*Plugin, *plugintest.API) {
+	mockAPI := &plugintest.API{}
+	p := &Plugin{}
+	p.SetAPI(mockAPI)
+	p.InitializeAPI()
+
+	key := GenerateValidPubKey()
+	keyJSON, _ := json.Marshal(key)
+	for _, userID := range []string{"user", "teammate", "dm_partner", "stranger"} {
+		mockAPI.On("KVGet", StoreKeyPubKey(userID)).Return(keyJSON, nil)
+	}
+	mockAPI.On("HasPermissionTo", "user", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+	mockAPI.On("HasPermissionTo", "admin", model.PERMISSION_MANAGE_SYSTEM).Return(true)
+	mockAPI.On("GetTeamsForUser", "user").Return([]*model.Team{{Id: "team1"}}, nil)
+	mockAPI.On("GetTeamsForUser", "teammate").Return([]*model.Team{{Id: "team1"}, {Id: "team2"}}, nil)
+	mockAPI.On("GetTeamsForUser", "dm_partner").Return([]*model.Team{{Id: "team2"}}, nil)
+	mockAPI.On("GetTeamsForUser", "stranger").Return([]*model.Team{{Id: "team2"}}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "user", false).Return([]*model.Channel{{Id: "dm"}}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "teammate", false).Return([]*model.Channel{}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "dm_partner", false).Return([]*model.Channel{{Id: "dm"}}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "stranger", false).Return([]*model.Channel{}, nil)
+	p.setConfiguration(&configuration{PubKeyVisibility: PubKeyVisibilityTeam})
+	return p, mockAPI
+}
+
+func Test_pubkeyAccess_getPubKeys(t *testing.T) {
+	p, mockAPI := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+
+	get := func(userID string) *GetPubKeysResponse {
+		body, _ := json.Marshal(GetPubKeysRequest{UserIds: []string{"user", "teammate", "dm_partner", "stranger"}})
+		req := httptest.NewRequest("POST", "/api/v1/pubkey/get", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		p.GetPubKeys(&Context{UserID: userID}, rr, req)
+		tassert.Equal(http.StatusOK, rr.Code)
+		var res GetPubKeysResponse
+		tassert.Nil(json.Unmarshal(rr.Body.Bytes(), &res))
+		return &res
+	}
+
+	p.setConfiguration(&configuration{PubKeyVisibility: PubKeyVisibilityTeam, AdminsSeeAllPubKeys: true})
+	res := get("user")
+	tassert.Equal(map[string]bool{"stranger": true}, res.NotVisible)
+	tassert.Len(res.PubKeys, 3)
+	tassert.NotContains(res.PubKeys, "stranger")
+
+	res = get("admin")
+	tassert.Nil(res.NotVisible)
+	tassert.Len(res.PubKeys, 4)
+
+	p.setConfiguration(&configuration{PubKeyVisibility: PubKeyVisibilityTeam, AdminsSeeAllPubKeys: false, PubKeyLookupsPerMinute: 6})
+	mockAPI.On("GetTeamsForUser", "admin").Return([]*model.Team{{Id: "team2"}}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "", "admin", false).Return([]*model.Channel{}, nil)
+	res = get("admin")
+	tassert.Equal(map[string]bool{"user": true}, res.NotVisible)
+
+	// Only 2 keys are left for the second request of 4 keys, and none for
+	// the third one
+	res = get("admin")
+	tassert.Equal(map[string]bool{"user": true}, res.NotVisible)
+	tassert.Len(res.PubKeys, 1)
+	tassert.Contains(res.PubKeys, "teammate")
+	tassert.Equal(map[string]bool{"dm_partner": true, "stranger": true}, res.RateLimited)
+
+	body, _ := json.Marshal(GetPubKeysRequest{UserIds: []string{"user", "teammate", "dm_partner", "stranger"}})
+	req := httptest.NewRequest("POST", "/api/v1/pubkey/get", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	p.GetPubKeys(&Context{UserID: "admin"}, rr, req)
+	tassert.Equal(http.StatusTooManyRequests, rr.Code)
+}
+
+func Test_pubkeyAccess_canSee(t *testing.T) {
+	p, mockAPI := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+
+	viewer, appErr := p.newPubKeyViewer("user")
+	tassert.Nil(appErr)
+	for userID, expected := range map[string]bool{"teammate": true, "dm_partner": true, "stranger": false} {
+		visible, appErr := viewer.CanSee(userID)
+		tassert.Nil(appErr)
+		tassert.Equal(expected, visible, userID)
+	}
+	// Sharing a team is enough
+	mockAPI.AssertNotCalled(t, "GetChannelsForTeamForUser", "", "teammate", false)
+
+	// Only the channels in teams shared with the viewer are listed
+	p.setConfiguration(&configuration{PubKeyVisibility: PubKeyVisibilityChannel})
+	mockAPI.On("GetChannelsForTeamForUser", "team1", "user", false).Return([]*model.Channel{{Id: "chan1"}}, nil)
+	mockAPI.On("GetChannelsForTeamForUser", "team1", "teammate", false).Return([]*model.Channel{{Id: "chan1"}}, nil)
+	viewer, appErr = p.newPubKeyViewer("user")
+	tassert.Nil(appErr)
+	for userID, expected := range map[string]bool{"teammate": true, "dm_partner": true, "stranger": false} {
+		visible, appErr := viewer.CanSee(userID)
+		tassert.Nil(appErr)
+		tassert.Equal(expected, visible, userID)
+	}
+	mockAPI.AssertNotCalled(t, "GetChannelsForTeamForUser", "team2", "teammate", false)
+	mockAPI.AssertNotCalled(t, "GetChannelsForTeamForUser", "team2", "stranger", false)
+}
+
+func Test_pubkeyAccess_keyringRateLimit(t *testing.T) {
+	p, mockAPI := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+	p.setConfiguration(&configuration{PubKeyLookupsPerMinute: 5})
+
+	mockAPI.On("GetChannelMember", "chan1", "user").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("KVGet", ChanMembershipVersionKey("chan1")).Return([]byte("4"), nil)
+	mockAPI.On("GetUsersInChannel", "chan1", model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{{Id: "user"}, {Id: "teammate"}, {Id: "dm_partner"}}, nil)
+
+	get := func() int {
+		req := httptest.NewRequest("GET", "/api/v1/channel/keyring?chanID=chan1", nil)
+		rr := httptest.NewRecorder()
+		p.GetChanKeyringHandler(&Context{UserID: "user"}, rr, req)
+		return rr.Code
+	}
+	tassert.Equal(http.StatusOK, get())
+	// The second keyring doesn't fit in the 2 keys left, which stay
+	// available
+	tassert.Equal(http.StatusTooManyRequests, get())
+	tassert.Equal(2, p.pubKeyLookups.Allow("user", 3, 5, time.Now()))
+}
+
+func Test_pubkeyAccess_fingerprint(t *testing.T) {
+	p, _ := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+
+	for userID, status := range map[string]int{"teammate": http.StatusOK, "dm_partner": http.StatusOK, "stranger": http.StatusNotFound} {
+		req := httptest.NewRequest("GET", "/api/v1/pubkey/fingerprint?userID="+userID, nil)
+		rr := httptest.NewRecorder()
+		p.GetFingerprintHandler(&Context{UserID: "user"}, rr, req)
+		tassert.Equal(status, rr.Code, userID)
+	}
+}
+
+func Test_pubkeyAccess_safetyNumber(t *testing.T) {
+	p, _ := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+
+	for userID, status := range map[string]int{"teammate": http.StatusOK, "dm_partner": http.StatusOK, "stranger": http.StatusNotFound} {
+		req := httptest.NewRequest("GET", "/api/v1/pubkey/safety_number?userID="+userID, nil)
+		rr := httptest.NewRecorder()
+		p.GetSafetyNumberHandler(&Context{UserID: "user"}, rr, req)
+		tassert.Equal(status, rr.Code, userID)
+	}
+}
+
+func Test_pubkeyAccess_changes(t *testing.T) {
+	p, mockAPI := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+
+	events := []*PubKeyChange{
+		{Seq: 1, UserID: "teammate", Kind: KeyChangeRotation},
+		{Seq: 2, UserID: "stranger", Kind: KeyChangeRotation},
+		{Seq: 3, UserID: "dm_partner", Kind: KeyChangeRevocation},
+		{Seq: 4, UserID: "stranger", Kind: KeyChangeRevocation},
+	}
+	mockAPI.On("KVGet", PubKeyChangesFirstKey).Return(nil, nil)
+	for _, event := range events {
+		data, _ := json.Marshal(event)
+		mockAPI.On("KVGet", PubKeyChangeKey(event.Seq)).Return(data, nil)
+	}
+	mockAPI.On("KVGet", PubKeyChangeKey(5)).Return(nil, nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/pubkey/changes?since=0", nil)
+	rr := httptest.NewRecorder()
+	p.GetPubKeyChangesHandler(&Context{UserID: "user"}, rr, req)
+	tassert.Equal(http.StatusOK, rr.Code)
+	var res PubKeyChangesResponse
+	tassert.Nil(json.Unmarshal(rr.Body.Bytes(), &res))
+	tassert.Equal([]*PubKeyChange{events[0], events[2]}, res.Events)
+	tassert.EqualValues(4, res.Seq)
+}
+
+func Test_pubkeyAccess_attestationGraph(t *testing.T) {
+	p, mockAPI := newPubKeyAccessTestPlugin()
+	tassert := assert.New(t)
+
+	key := GenerateValidPubKey()
+	keyB := GenerateValidPubKey()
+	keyC := GenerateValidPubKey()
+	keyID := key.ID()
+	atts := []*KeyAttestation{
+		{AttesterID: "dm_partner", AttesterKeyID: KeyIDString(keyB.ID()), TargetUserID: "teammate", KeyID: KeyIDString(keyID)},
+		{AttesterID: "stranger", AttesterKeyID: KeyIDString(keyC.ID()), TargetUserID: "teammate", KeyID: KeyIDString(keyID)},
+	}
+	data, _ := json.Marshal(atts)
+	mockAPI.On("KVGet", StoreKeyAttestationsOfKey(keyID)).Return(data, nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/attestations/graph?depth=1&keyID="+url.QueryEscape(KeyIDString(keyID)), nil)
+	rr := httptest.NewRecorder()
+	p.GetAttestationGraphHandler(&Context{UserID: "user"}, rr, req)
+	tassert.Equal(http.StatusOK, rr.Code)
+	var res AttestationGraph
+	tassert.Nil(json.Unmarshal(rr.Body.Bytes(), &res))
+	tassert.Equal(atts[:1], res.Attestations)
+}
+
+func Test_pubkeyAccess_limiter(t *testing.T) {
+	tassert := assert.New(t)
+	var limiter pubKeyLookupLimiter
+	now := time.Unix(6000, 0)
+
+	tassert.Equal(1000, limiter.Allow("user1", 1000, 0, now))
+	tassert.Equal(8, limiter.Allow("user1", 8, 10, now))
+	tassert.Equal(2, limiter.Allow("user1", 3, 10, now))
+	tassert.Equal(0, limiter.Allow("user1", 2, 10, now.Add(59*time.Second)))
+	tassert.Equal(10, limiter.Allow("user2", 10, 10, now))
+	tassert.Equal(10, limiter.Allow("user1", 10, 10, now.Add(time.Minute)))
+
+	tassert.True(limiter.AllowAll("user3", 6, 10, now))
+	tassert.False(limiter.AllowAll("user3", 5, 10, now))
+	tassert.True(limiter.AllowAll("user3", 4, 10, now))
+	tassert.False(limiter.AllowAll("user3", 1, 10, now))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// PubKeyChangesHeadKey holds the number of the last event of the change
+	// feed, or a slightly lower one: it is only a hint of where to append.
+	PubKeyChangesHeadKey = "pubkeyChangesHead"
+	// PubKeyChangesFirstKey holds the number of the oldest event kept in the
+	// change feed.
+	PubKeyChangesFirstKey = "pubkeyChangesFirst"
+	// Number of events kept in the change feed. Clients that are further
+	// behind have to resync all the keys they know.
+	MaxPubKeyChanges = 1000
+	// Old events are dropped every pubKeyChangesTrimInterval events
+	pubKeyChangesTrimInterval = 100
+	// Number of event numbers tried after the head when appending an event
+	pubKeyChangesAppendTries = 100
+	// Maximum number of events returned at once
+	pubKeyChangesPageSize = 200
+	// Number of events kept in the key history of a user
+	MaxPubKeyHistory = 100
+)
+
+// PubKeyChangeKey is where the event number seq of the change feed is
+// stored.
+func PubKeyChangeKey(seq int64) string {
+	return fmt.Sprintf("pubkeyChange:%d", seq)
+}
+
+// StoreKeyPubKeyHistory is where the key changes of a user are stored, for
+// system admins.
+func StoreKeyPubKeyHistory(userID string) string {
+	return "pubkey_history:" + userID
+}
+
+// PubKeyChange is an event of the public key change feed.
+type PubKeyChange struct {
+	Seq    int64  `json:"seq"`
+	UserID string `json:"userID"`
+	// New key ID, empty on revocation
+	KeyID string `json:"keyID"`
+	Kind  string `json:"kind"`
+	At    int64  `json:"at"`
+	// System admin who reset the key, for resets by an admin
+	AdminID string `json:"adminID,omitempty"`
+}
+
+func (p *Plugin) getPubKeyChangesSeq(key string, defaultSeq int64) (int64, *model.AppError) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil || data == nil {
+		return defaultSeq, appErr
+	}
+	var ret int64
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return 0, model.NewAppError("getPubKeyChangesSeq", "mm-e2ee.invalid_pubkey_changes", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// getPubKeyChangesHead returns the hint of the number of the last event.
+func (p *Plugin) getPubKeyChangesHead() (int64, *model.AppError) {
+	return p.getPubKeyChangesSeq(PubKeyChangesHeadKey, 0)
+}
+
+// raisePubKeyChangesSeq sets the number stored in key to seq, unless it is
+// already greater.
+func (p *Plugin) raisePubKeyChangesSeq(key string, seq int64) *model.AppError {
+	return p.kvAtomicUpdate(key, func(old []byte) ([]byte, *model.AppError) {
+		var current int64
+		if old != nil {
+			_ = json.Unmarshal(old, &current)
+		}
+		if current >= seq {
+			return nil, nil
+		}
+		data, _ := json.Marshal(seq)
+		return data, nil
+	})
+}
+
+// appendPubKeyChange stores event under the first free number after the
+// head. Each event has its own key, which is only created if it doesn't
+// exist, so concurrent servers never overwrite each other's events.
+func (p *Plugin) appendPubKeyChange(event *PubKeyChange) *model.AppError {
+	head, appErr := p.getPubKeyChangesHead()
+	if appErr != nil {
+		return appErr
+	}
+	for seq := head + 1; seq <= head+pubKeyChangesAppendTries; seq++ {
+		event.Seq = seq
+		data, _ := json.Marshal(event)
+		created, appErr := p.API.KVSetWithOptions(PubKeyChangeKey(seq), data, model.PluginKVSetOptions{Atomic: true, OldValue: nil})
+		if appErr != nil {
+			return appErr
+		}
+		if !created {
+			continue
+		}
+		// The head is only a hint: a failure only makes the next append try
+		// more numbers
+		if appErr := p.raisePubKeyChangesSeq(PubKeyChangesHeadKey, seq); appErr != nil {
+			p.API.LogWarn("unable to update the head of the key change feed", "error", appErr.Error())
+		}
+		if seq%pubKeyChangesTrimInterval == 0 {
+			go p.trimPubKeyChanges(seq)
+		}
+		return nil
+	}
+	return model.NewAppError("appendPubKeyChange", "mm-e2ee.concurrent_update", nil, "too many concurrent key changes", http.StatusConflict)
+}
+
+// trimPubKeyChanges drops the events that are more than MaxPubKeyChanges
+// older than last. Servers claim the events they drop by moving the first
+// kept event, so that they don't drop the same ones.
+func (p *Plugin) trimPubKeyChanges(last int64) {
+	var from, to int64
+	appErr := p.kvAtomicUpdate(PubKeyChangesFirstKey, func(old []byte) ([]byte, *model.AppError) {
+		from = 1
+		if old != nil {
+			_ = json.Unmarshal(old, &from)
+		}
+		to = last - MaxPubKeyChanges + 1
+		if to <= from {
+			return nil, nil
+		}
+		data, _ := json.Marshal(to)
+		return data, nil
+	})
+	if appErr != nil {
+		p.API.LogError("unable to trim the key change feed", "error", appErr.Error())
+		return
+	}
+	for seq := from; seq < to; seq++ {
+		if appErr := p.API.KVDelete(PubKeyChangeKey(seq)); appErr != nil {
+			p.API.LogError("unable to trim the key change feed", "error", appErr.Error())
+			return
+		}
+	}
+}
+
+// RecordPubKeyChange appends an event to the change feed of public keys, and
+// to the key history of userID. adminID is the system admin who made the
+// change, if any.
+func (p *Plugin) RecordPubKeyChange(userID string, kind string, adminID string, keyID []byte) *model.AppError {
+	event := &PubKeyChange{UserID: userID, Kind: kind, At: model.GetMillis(), AdminID: adminID}
+	if keyID != nil {
+		event.KeyID = KeyIDString(keyID)
+	}
+	appErr := p.appendPubKeyChange(event)
+	if appErr != nil {
+		return appErr
+	}
+	return p.recordPubKeyHistory(userID, event)
+}
+
+func (p *Plugin) recordPubKeyHistory(userID string, event *PubKeyChange) *model.AppError {
+	return p.kvAtomicUpdate(StoreKeyPubKeyHistory(userID), func(old []byte) ([]byte, *model.AppError) {
+		history := make([]*PubKeyChange, 0, 1)
+		if old != nil {
+			if err := json.Unmarshal(old, &history); err != nil {
+				return nil, model.NewAppError("recordPubKeyHistory", "mm-e2ee.invalid_pubkey_history", nil, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		history = append(history, event)
+		if len(history) > MaxPubKeyHistory {
+			history = history[len(history)-MaxPubKeyHistory:]
+		}
+		data, _ := json.Marshal(history)
+		return data, nil
+	})
+}
+
+// GetPubKeyHistory returns the latest key changes of userID, oldest first.
+// Changes made before the history existed are missing.
+func (p *Plugin) GetPubKeyHistory(userID string) ([]*PubKeyChange, *model.AppError) {
+	data, appErr := p.API.KVGet(StoreKeyPubKeyHistory(userID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	history := make([]*PubKeyChange, 0)
+	if data == nil {
+		return history, nil
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, model.NewAppError("GetPubKeyHistory", "mm-e2ee.invalid_pubkey_history", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return history, nil
+}
+
+// PubKeyChangesResponse is a page of the change feed.
+type PubKeyChangesResponse struct {
+	Events []*PubKeyChange `json:"events"`
+	// Number of the last returned event, to use as the next since
+	Seq int64 `json:"seq"`
+	// More events are available after Seq
+	HasMore bool `json:"hasMore"`
+	// Events after since aren't available anymore: the client must refetch
+	// all the keys it knows, and continue from Seq
+	Reset bool `json:"reset"`
+}
+
+// GetPubKeyChanges returns the events of the change feed that happened after
+// the event number since.
+func (p *Plugin) GetPubKeyChanges(since int64) (*PubKeyChangesResponse, *model.AppError) {
+	first, appErr := p.getPubKeyChangesSeq(PubKeyChangesFirstKey, 1)
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &PubKeyChangesResponse{Events: make([]*PubKeyChange, 0), Seq: since}
+	if since < 0 || since+1 < first {
+		return p.resetPubKeyChanges(ret)
+	}
+	for seq := since + 1; ; seq++ {
+		data, appErr := p.API.KVGet(PubKeyChangeKey(seq))
+		if appErr != nil {
+			return nil, appErr
+		}
+		if data == nil {
+			break
+		}
+		if len(ret.Events) == pubKeyChangesPageSize {
+			ret.HasMore = true
+			break
+		}
+		var event PubKeyChange
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, model.NewAppError("GetPubKeyChanges", "mm-e2ee.invalid_pubkey_changes", nil, err.Error(), http.StatusInternalServerError)
+		}
+		ret.Events = append(ret.Events, &event)
+		ret.Seq = seq
+	}
+
+	// Events may have been dropped while we read them
+	first, appErr = p.getPubKeyChangesSeq(PubKeyChangesFirstKey, 1)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if since+1 < first {
+		return p.resetPubKeyChanges(ret)
+	}
+	return ret, nil
+}
+
+func (p *Plugin) resetPubKeyChanges(ret *PubKeyChangesResponse) (*PubKeyChangesResponse, *model.AppError) {
+	head, appErr := p.getPubKeyChangesHead()
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret.Events = make([]*PubKeyChange, 0)
+	ret.HasMore = false
+	ret.Reset = true
+	ret.Seq = head
+	return ret, nil
+}
+
+func (p *Plugin) GetPubKeyChangesHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid since value", http.StatusBadRequest)
+		return
+	}
+	changes, appErr := p.GetPubKeyChanges(since)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	// Events of users the caller can't see are left out, Seq still moves
+	// past them
+	viewer, appErr := p.newPubKeyViewer(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	events := make([]*PubKeyChange, 0, len(changes.Events))
+	for _, event := range changes.Events {
+		visible, appErr := viewer.CanSee(event.UserID)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if visible {
+			events = append(events, event)
+		}
+	}
+	changes.Events = events
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, changes)
+}
+
+// WriteJSONWithETag writes v like WriteJSON, with an ETag computed from its
+// content. If it matches the If-None-Match header of r, only a 304 status
+// is sent.
+func (p *Plugin) WriteJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.Sum256(data)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(hash[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if matchesIfNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// matchesIfNoneMatch returns whether the If-None-Match headers of r match
+// etag, using the weak comparison of RFC 7232: W/ prefixes are ignored, and *
+// matches anything.
+func matchesIfNoneMatch(r *http.Request, etag string) bool {
+	for _, header := range r.Header.Values("If-None-Match") {
+		for {
+			header = strings.TrimLeft(header, " \t,")
+			if header == "" {
+				break
+			}
+			if header[0] == '*' {
+				return true
+			}
+			header = strings.TrimPrefix(header, "W/")
+			if header == "" || header[0] != '"' {
+				// Malformed list
+				break
+			}
+			end := strings.IndexByte(header[1:], '"')
+			if end < 0 {
+				break
+			}
+			if header[:end+2] == etag {
+				return true
+			}
+			header = header[end+2:]
+		}
+	}
+	return false
+}
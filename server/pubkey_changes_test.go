@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mockEmptyPubKeyChanges lets events be appended to an empty change feed.
+func mockEmptyPubKeyChanges(api *plugintest.API) {
+	api.On("KVGet", PubKeyChangesHeadKey).Return(nil, nil)
+	api.On("KVSetWithOptions", PubKeyChangesHeadKey, mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+	api.On("KVSetWithOptions", mock.MatchedBy(func(key string) bool { return strings.HasPrefix(key, "pubkeyChange:") }), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+}
+
+func Test_pubkeyChanges_feed(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, _ := newTestNode(kv)
+
+	// The first 10 events have been dropped from the feed
+	last := int64(10 + MaxPubKeyChanges)
+	for i := int64(11); i <= last; i++ {
+		kv.data[PubKeyChangeKey(i)], _ = json.Marshal(&PubKeyChange{Seq: i, UserID: "user", Kind: KeyChangeRotation})
+	}
+	kv.data[PubKeyChangesFirstKey], _ = json.Marshal(11)
+	kv.data[PubKeyChangesHeadKey], _ = json.Marshal(last)
+
+	res, appErr := p.GetPubKeyChanges(5)
+	tassert.Nil(appErr)
+	tassert.True(res.Reset)
+	tassert.Equal(last, res.Seq)
+
+	res, appErr = p.GetPubKeyChanges(10)
+	tassert.Nil(appErr)
+	tassert.False(res.Reset)
+	tassert.True(res.HasMore)
+	tassert.Len(res.Events, pubKeyChangesPageSize)
+	tassert.Equal(int64(11), res.Events[0].Seq)
+	tassert.Equal(int64(10+pubKeyChangesPageSize), res.Seq)
+
+	res, appErr = p.GetPubKeyChanges(last - 1)
+	tassert.Nil(appErr)
+	tassert.False(res.HasMore)
+	tassert.Len(res.Events, 1)
+	tassert.Equal(last, res.Seq)
+
+	res, appErr = p.GetPubKeyChanges(last)
+	tassert.Nil(appErr)
+	tassert.Len(res.Events, 0)
+	tassert.Equal(last, res.Seq)
+}
+
+func Test_pubkeyChanges_record(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, _ := newTestNode(kv)
+
+	kv.data[PubKeyChangeKey(41)], _ = json.Marshal(&PubKeyChange{Seq: 41, UserID: "user1", Kind: KeyChangeRegistration})
+	kv.data[PubKeyChangesHeadKey], _ = json.Marshal(41)
+	kv.data[StoreKeyPubKeyHistory("user2")], _ = json.Marshal([]*PubKeyChange{{Seq: 12, UserID: "user2", Kind: KeyChangeRegistration}})
+
+	tassert.Nil(p.RecordPubKeyChange("user2", KeyChangeRevocation, "", nil))
+	res, appErr := p.GetPubKeyChanges(41)
+	tassert.Nil(appErr)
+	tassert.Len(res.Events, 1)
+	tassert.Equal(&PubKeyChange{Seq: 42, UserID: "user2", Kind: KeyChangeRevocation, At: res.Events[0].At}, res.Events[0])
+	tassert.Equal([]byte("42"), kv.data[PubKeyChangesHeadKey])
+
+	history, appErr := p.GetPubKeyHistory("user2")
+	tassert.Nil(appErr)
+	tassert.Len(history, 2)
+	tassert.Equal(res.Events[0], history[1])
+}
+
+func Test_pubkeyChanges_concurrentRecords(t *testing.T) {
+	tassert := assert.New(t)
+	const nodes = 4
+	kv := newTestKVStore()
+	plugins := make([]*Plugin, 0, nodes)
+	for i := 0; i < nodes; i++ {
+		p, _ := newTestNode(kv)
+		plugins = append(plugins, p)
+	}
+
+	// All the servers start from the same head
+	kv.syncFirstReads(nodes)
+	var wg sync.WaitGroup
+	for i, p := range plugins {
+		wg.Add(1)
+		go func(p *Plugin, userID string) {
+			defer wg.Done()
+			tassert.Nil(p.RecordPubKeyChange(userID, KeyChangeRegistration, "", nil))
+		}(p, fmt.Sprintf("user%d", i))
+	}
+	wg.Wait()
+
+	res, appErr := plugins[0].GetPubKeyChanges(0)
+	tassert.Nil(appErr)
+	tassert.Len(res.Events, nodes)
+	tassert.Equal(int64(nodes), res.Seq)
+	users := make(map[string]bool)
+	for _, event := range res.Events {
+		users[event.UserID] = true
+	}
+	tassert.Len(users, nodes)
+}
+
+func Test_pubkeyChanges_trim(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, _ := newTestNode(kv)
+
+	last := int64(MaxPubKeyChanges + pubKeyChangesTrimInterval)
+	for i := int64(1); i <= last; i++ {
+		kv.data[PubKeyChangeKey(i)], _ = json.Marshal(&PubKeyChange{Seq: i, UserID: "user", Kind: KeyChangeRotation})
+	}
+	kv.data[PubKeyChangesHeadKey], _ = json.Marshal(last)
+
+	p.trimPubKeyChanges(last)
+	tassert.NotContains(kv.data, PubKeyChangeKey(pubKeyChangesTrimInterval))
+	tassert.Contains(kv.data, PubKeyChangeKey(pubKeyChangesTrimInterval+1))
+	res, appErr := p.GetPubKeyChanges(pubKeyChangesTrimInterval - 1)
+	tassert.Nil(appErr)
+	tassert.True(res.Reset)
+	res, appErr = p.GetPubKeyChanges(pubKeyChangesTrimInterval)
+	tassert.Nil(appErr)
+	tassert.False(res.Reset)
+
+	// Nothing more to drop
+	p.trimPubKeyChanges(last)
+	tassert.Equal([]byte(fmt.Sprint(pubKeyChangesTrimInterval+1)), kv.data[PubKeyChangesFirstKey])
+}
+
+func Test_plugin_ServeHTTP_GetPubKeysETag(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	user1Key := GenerateValidPubKey()
+	user1KeyJSON, _ := json.Marshal(user1Key)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(user1KeyJSON, nil)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(GetPubKeysRequest{UserIds: []string{"user1"}})
+		req := httptest.NewRequest("POST", "/api/v1/pubkey/get", bytes.NewReader(body))
+		req.Header.Add("Mattermost-User-ID", "user")
+		if etag != "" {
+			req.Header.Add("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		p.ServeHTTP(nil, rr, req)
+		return rr
+	}
+
+	rr := get("")
+	tassert.Equal(http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	tassert.NotEqual("", etag)
+
+	rr = get(etag)
+	tassert.Equal(http.StatusNotModified, rr.Code)
+	tassert.Equal(0, rr.Body.Len())
+
+	rr = get(`"other"`)
+	tassert.Equal(http.StatusOK, rr.Code)
+}
+
+func Test_pubkeyChanges_matchesIfNoneMatch(t *testing.T) {
+	tassert := assert.New(t)
+	const etag = `"abc"`
+	for header, expected := range map[string]bool{
+		``:                      false,
+		`"abc"`:                 true,
+		`W/"abc"`:               true,
+		`"other", W/"abc"`:      true,
+		`"other",W/"x",  "abc"`: true,
+		`"other", "abcd"`:       false,
+		`*`:                     true,
+		`abc`:                   false,
+		`"a,b", "abc"`:          true,
+		`W/`:                    false,
+		`"unterminated`:         false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			req.Header.Add("If-None-Match", header)
+		}
+		tassert.Equal(expected, matchesIfNoneMatch(req, etag), header)
+	}
+
+	// Several headers are combined
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Add("If-None-Match", `"other"`)
+	req.Header.Add("If-None-Match", `"abc"`)
+	tassert.True(matchesIfNoneMatch(req, etag))
+}
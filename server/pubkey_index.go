@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const adminsPageSize = 100
+
+// StoreKeyPubKeyOwners is where the owners of a key are stored. The key ID is
+// URL-safe encoded to fit in the 50 characters of a KV key.
+func StoreKeyPubKeyOwners(keyID []byte) string {
+	return "keyid:" + base64.RawURLEncoding.EncodeToString(keyID)
+}
+
+// PubKeyOwners lists the users who registered a key. It should only ever hold
+// one user: more means that the same key material is used by several
+// accounts.
+type PubKeyOwners struct {
+	UserIDs []string `json:"userIDs"`
+}
+
+func (p *Plugin) GetPubKeyOwners(keyID []byte) (*PubKeyOwners, *model.AppError) {
+	data, appErr := p.API.KVGet(StoreKeyPubKeyOwners(keyID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &PubKeyOwners{UserIDs: make([]string, 0)}
+	if data == nil {
+		return ret, nil
+	}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, model.NewAppError("GetPubKeyOwners", "mm-e2ee.invalid_pubkey_owners", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// updatePubKeyOwners atomically applies update to the owners of keyID. update
+// returns whether it modified them.
+func (p *Plugin) updatePubKeyOwners(keyID []byte, update func(owners *PubKeyOwners) bool) *model.AppError {
+	return p.kvAtomicUpdate(StoreKeyPubKeyOwners(keyID), func(old []byte) ([]byte, *model.AppError) {
+		owners := PubKeyOwners{UserIDs: make([]string, 0)}
+		if old != nil {
+			if err := json.Unmarshal(old, &owners); err != nil {
+				return nil, model.NewAppError("updatePubKeyOwners", "mm-e2ee.invalid_pubkey_owners", nil, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		if !update(&owners) {
+			return nil, nil
+		}
+		data, _ := json.Marshal(owners)
+		return data, nil
+	})
+}
+
+// addPubKeyOwner records that userID owns keyID. If userID didn't own it yet,
+// the other users that already own it are returned.
+func (p *Plugin) addPubKeyOwner(keyID []byte, userID string) ([]string, *model.AppError) {
+	var others []string
+	appErr := p.updatePubKeyOwners(keyID, func(owners *PubKeyOwners) bool {
+		others = make([]string, 0, len(owners.UserIDs))
+		for _, ownerID := range owners.UserIDs {
+			if ownerID != userID {
+				others = append(others, ownerID)
+			}
+		}
+		if len(others) == len(owners.UserIDs) {
+			owners.UserIDs = append(owners.UserIDs, userID)
+			return true
+		}
+		others = nil
+		return false
+	})
+	return others, appErr
+}
+
+func (p *Plugin) removePubKeyOwner(keyID []byte, userID string) *model.AppError {
+	return p.updatePubKeyOwners(keyID, func(owners *PubKeyOwners) bool {
+		for i, ownerID := range owners.UserIDs {
+			if ownerID == userID {
+				owners.UserIDs = append(owners.UserIDs[:i], owners.UserIDs[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// IndexUserPubKey updates the index of keys when the key of userID is
+// replaced by pubkey. oldPubkey and pubkey are nil if there is no such key.
+// System admins are alerted if another account already registered pubkey.
+func (p *Plugin) IndexUserPubKey(userID string, oldPubkey *PubKey, pubkey *PubKey) *model.AppError {
+	if oldPubkey != nil && pubkey != nil && bytes.Equal(oldPubkey.ID(), pubkey.ID()) {
+		return nil
+	}
+	if oldPubkey != nil {
+		appErr := p.removePubKeyOwner(oldPubkey.ID(), userID)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	if pubkey == nil {
+		return nil
+	}
+	others, appErr := p.addPubKeyOwner(pubkey.ID(), userID)
+	if appErr != nil {
+		return appErr
+	}
+	if len(others) > 0 {
+		p.AlertDuplicatePubKey(pubkey.ID(), append(others, userID))
+	}
+	return nil
+}
+
+// AlertDuplicatePubKey tells the system admins that userIDs registered the
+// same key.
+func (p *Plugin) AlertDuplicatePubKey(keyID []byte, userIDs []string) {
+	mentions := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		user, appErr := p.API.GetUser(userID)
+		if appErr != nil {
+			mentions = append(mentions, userID)
+			continue
+		}
+		mentions = append(mentions, "@"+user.Username)
+	}
+	msg := fmt.Sprintf("The same encryption key (key ID `%s`) has been registered by several accounts: %s. One of them could have been cloned.",
+		KeyIDString(keyID), strings.Join(mentions, ", "))
+	p.API.LogWarn("same public key registered by several accounts", "key_id", KeyIDString(keyID), "user_ids", strings.Join(userIDs, ","))
+
+	for page := 0; ; page++ {
+		admins, appErr := p.API.GetUsers(&model.UserGetOptions{Role: model.SYSTEM_ADMIN_ROLE_ID, Page: page, PerPage: adminsPageSize})
+		if appErr != nil {
+			p.API.LogError("unable to list system admins", "error", appErr.Error())
+			return
+		}
+		for _, admin := range admins {
+			if appErr := p.SendBotDM(admin.Id, msg); appErr != nil {
+				p.API.LogError("unable to alert system admin", "user_id", admin.Id, "error", appErr.Error())
+			}
+		}
+		if len(admins) < adminsPageSize {
+			return
+		}
+	}
+}
+
+// indexPubKeys indexes the public keys stored in keys, for the migration that
+// indexes the keys registered before the index existed.
+func (p *Plugin) indexPubKeys(keys []string) *model.AppError {
+	for _, key := range keys {
+		if !strings.HasPrefix(key, StoreKeyPubKeyPrefix) {
+			continue
+		}
+		userID := strings.TrimPrefix(key, StoreKeyPubKeyPrefix)
+		pubkey, err := p.GetUserPubKey(userID)
+		if err != nil {
+			p.API.LogError("unable to index public key", "user_id", userID, "error", err.Error())
+			continue
+		}
+		if pubkey == nil {
+			continue
+		}
+		appErr := p.IndexUserPubKey(userID, nil, pubkey)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	return nil
+}
+
+// ParseKeyID decodes a key ID, given either like in encrypted posts, or
+// URL-safe encoded.
+func ParseKeyID(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		if keyID, err := enc.DecodeString(s); err == nil {
+			return keyID, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid key ID %q", s)
+}
+
+type GetPubKeyByIDResponse struct {
+	UserID string  `json:"userID"`
+	PubKey *PubKey `json:"pubkey"`
+}
+
+// GetPubKeyByID returns the owner of keyID, along with the key, or nil if no
+// user currently has this key.
+func (p *Plugin) GetPubKeyByID(keyID []byte) (*GetPubKeyByIDResponse, *model.AppError) {
+	owners, appErr := p.GetPubKeyOwners(keyID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	// In case of duplicates, the first user that registered the key is
+	// returned
+	for _, userID := range owners.UserIDs {
+		pubkey, err := p.GetUserPubKey(userID)
+		if err != nil {
+			return nil, model.NewAppError("GetPubKeyByID", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+		}
+		if pubkey != nil && bytes.Equal(pubkey.ID(), keyID) {
+			return &GetPubKeyByIDResponse{UserID: userID, PubKey: pubkey}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *Plugin) GetPubKeyByIDHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	keyID, err := ParseKeyID(mux.Vars(r)["keyID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, appErr := p.checkPubKeyLookupRate(c.UserID, 1)
+	if appErr != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	res, appErr := p.GetPubKeyByID(keyID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	if res != nil {
+		// Keys of users the caller can't see are reported as unknown, so
+		// that this doesn't tell whether they exist
+		viewer, appErr := p.newPubKeyViewer(c.UserID)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		visible, appErr := viewer.CanSee(res.UserID)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !visible {
+			res = nil
+		}
+	}
+	if res == nil {
+		http.Error(w, "unknown key ID", http.StatusNotFound)
+		return
+	}
+	p.WriteJSONWithETag(w, r, res)
+}
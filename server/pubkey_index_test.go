@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_pubkeyIndex_duplicate(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	oldKey := GenerateValidPubKey()
+	pubkey := GenerateValidPubKey()
+	owners, _ := json.Marshal(PubKeyOwners{UserIDs: []string{"user1"}})
+	oldOwners, _ := json.Marshal(PubKeyOwners{UserIDs: []string{"user2"}})
+	mockAPI.On("KVGet", StoreKeyPubKeyOwners(pubkey.ID())).Return(owners, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyOwners(oldKey.ID())).Return(oldOwners, nil)
+	newOwners, _ := json.Marshal(PubKeyOwners{UserIDs: []string{"user1", "user2"}})
+	mockAPI.On("KVSetWithOptions", StoreKeyPubKeyOwners(pubkey.ID()), newOwners, mock.Anything).Return(true, nil)
+	noOwners, _ := json.Marshal(PubKeyOwners{UserIDs: []string{}})
+	mockAPI.On("KVSetWithOptions", StoreKeyPubKeyOwners(oldKey.ID()), noOwners, mock.Anything).Return(true, nil)
+	mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1", Username: "alice"}, nil)
+	mockAPI.On("GetUser", "user2").Return(&model.User{Id: "user2", Username: "bob"}, nil)
+	mockAPI.On("LogWarn", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	mockAPI.On("GetUsers", &model.UserGetOptions{Role: model.SYSTEM_ADMIN_ROLE_ID, Page: 0, PerPage: adminsPageSize}).Return([]*model.User{{Id: "admin"}}, nil)
+	mockAPI.On("GetDirectChannel", "bot", "admin").Return(&model.Channel{Id: "admin_dm"}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	tassert.Nil(p.IndexUserPubKey("user2", &oldKey, &pubkey))
+	mockAPI.AssertCalled(t, "KVSetWithOptions", StoreKeyPubKeyOwners(oldKey.ID()), noOwners, mock.Anything)
+	mockAPI.AssertNumberOfCalls(t, "CreatePost", 1)
+	mockAPI.AssertCalled(t, "CreatePost", mock.MatchedBy(func(post *model.Post) bool {
+		return post.ChannelId == "admin_dm" && post.UserId == "bot"
+	}))
+
+	// Pushing the same key again changes nothing
+	tassert.Nil(p.IndexUserPubKey("user1", &pubkey, &pubkey))
+	mockAPI.AssertNumberOfCalls(t, "CreatePost", 1)
+}
+
+func Test_pubkeyIndex_parseKeyID(t *testing.T) {
+	tassert := assert.New(t)
+	pubkey := GenerateValidPubKey()
+	keyID := pubkey.ID()
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		parsed, err := ParseKeyID(enc.EncodeToString(keyID))
+		tassert.Nil(err)
+		tassert.Equal(keyID, parsed)
+	}
+	_, err := ParseKeyID("not a key ID")
+	tassert.NotNil(err)
+}
+
+func Test_plugin_ServeHTTP_GetPubKeyByID(t *testing.T) {
+	mockAPI := plugintest.API{}
+	pubkey := GenerateValidPubKey()
+	stalePubkey := GenerateValidPubKey()
+	pubkeyJSON, _ := json.Marshal(pubkey)
+	owners, _ := json.Marshal(PubKeyOwners{UserIDs: []string{"user1"}})
+	mockAPI.On("KVGet", StoreKeyPubKeyOwners(pubkey.ID())).Return(owners, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyOwners(stalePubkey.ID())).Return(owners, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(pubkeyJSON, nil)
+	unknown := GenerateValidPubKey()
+	mockAPI.On("KVGet", StoreKeyPubKeyOwners(unknown.ID())).Return(nil, nil)
+
+	apiURL := "/api/v1/pubkey/by_id/"
+	tests := []TestDesc{
+		{
+			name: "success",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL + base64.RawURLEncoding.EncodeToString(pubkey.ID()),
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusOK,
+				Body:       GetPubKeyByIDResponse{UserID: "user1", PubKey: &pubkey},
+			},
+			userID: "user",
+		},
+		{
+			name: "stale",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL + base64.RawURLEncoding.EncodeToString(stalePubkey.ID()),
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusNotFound,
+			},
+			userID: "user",
+		},
+		{
+			name: "unknown",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL + base64.RawURLEncoding.EncodeToString(unknown.ID()),
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusNotFound,
+			},
+			userID: "user",
+		},
+		{
+			name: "invalid",
+			request: testutils.Request{
+				Method: "GET",
+				URL:    apiURL + "!!",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			userID: "user",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"math/big"
 	"testing"
 
@@ -44,7 +46,7 @@ func Test_pubkey_setget(t *testing.T) {
 
 	user := "user1"
 	pubkey := GenerateValidPubKey()
-	pubkeyJSON, _ := json.Marshal(pubkey)
+	pubkeyJSON, _ := json.Marshal(NewPubKeyRecord(&pubkey))
 
 	mockAPI.On("KVSet", StoreKeyPubKey(user), pubkeyJSON).Return(nil)
 	err := p.SetUserPubKey(user, &pubkey)
@@ -56,6 +58,36 @@ func Test_pubkey_setget(t *testing.T) {
 	tassert.Equal(*gotkey, pubkey)
 }
 
+func Test_pubkey_record(t *testing.T) {
+	tassert := assert.New(t)
+	pubkey := GenerateValidPubKey()
+
+	data, _ := json.Marshal(NewPubKeyRecord(&pubkey))
+	var stored map[string]interface{}
+	_ = json.Unmarshal(data, &stored)
+	device := stored["devices"].(map[string]interface{})[DefaultDeviceID].(map[string]interface{})
+	tassert.Equal(float64(PubKeyRecordVersion), stored["version"])
+	// The ECDH point is the one sent as "encr" by the webapp
+	wire, _ := json.Marshal(pubkey)
+	var wireKey map[string]interface{}
+	_ = json.Unmarshal(wire, &wireKey)
+	tassert.Equal(wireKey["encr"], device["ecdh"])
+	tassert.Equal(wireKey["sign"], device["ecdsa"])
+
+	record, err := ParsePubKeyRecord(data)
+	tassert.Nil(err)
+	tassert.Equal(&pubkey, record.PubKey())
+
+	// Keys stored before versioning
+	record, err = ParsePubKeyRecord(wire)
+	tassert.Nil(err)
+	tassert.Equal(0, record.Version)
+	tassert.Equal(&pubkey, record.PubKey())
+
+	_, err = ParsePubKeyRecord([]byte(`{"version":99}`))
+	tassert.NotNil(err)
+}
+
 func Test_pubkey_has(t *testing.T) {
 	mockAPI := plugintest.API{}
 	p := Plugin{}
@@ -114,29 +146,53 @@ func Test_pubkey_channelsMembersWithoutKeys(t *testing.T) {
 
 	chanID := "chan1"
 
-	maxUsersPerTeam := 10
-	mockAPI.On("GetConfig").Return(&model.Config{
-		TeamSettings: model.TeamSettings{
-			MaxUsersPerTeam: &maxUsersPerTeam,
-		},
-	})
-
-	mockAPI.On("GetChannelMembers", chanID, 0, maxUsersPerTeam).Return(&model.ChannelMembers{
+	mockAPI.On("GetUsersInChannel", chanID, model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{
 		{
-			UserId: "user1",
+			Id: "user1",
 		},
 		{
-			UserId: "user2",
+			Id: "user2",
 		},
 	}, nil)
 
-	mockAPI.On("GetUser", "user1").Return(&model.User{DeleteAt: 0}, nil)
-	mockAPI.On("GetUser", "user2").Return(&model.User{DeleteAt: 0}, nil)
-
-	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return([]byte(""), nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return([]byte("{}"), nil)
 	mockAPI.On("KVGet", StoreKeyPubKey("user2")).Return(nil, nil)
 
 	uids, err := p.GetChannelMembersWithoutKeys(chanID)
 	tassert.Nil(err)
 	tassert.Equal([]string{"user2"}, uids)
 }
+
+func Test_pubkey_pagedReport(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	firstPage := make([]*model.User, 0, channelMembersPageSize)
+	for i := 0; i < channelMembersPageSize; i++ {
+		userID := fmt.Sprintf("user%d", i)
+		firstPage = append(firstPage, &model.User{Id: userID, Username: userID})
+		mockAPI.On("KVGet", StoreKeyPubKey(userID)).Return([]byte("{}"), nil)
+	}
+	mockAPI.On("GetUsersInChannel", "chan1", model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return(firstPage, nil)
+	mockAPI.On("GetUsersInChannel", "chan1", model.CHANNEL_SORT_BY_USERNAME, 1, channelMembersPageSize).Return([]*model.User{
+		{Id: "nokey", Username: "nokey"},
+		{Id: "deleted", DeleteAt: 1},
+	}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("nokey")).Return(nil, nil)
+
+	report, appErr := p.GetChannelMembersReport("chan1")
+	tassert.Nil(appErr)
+	tassert.False(report.Incomplete)
+	tassert.Equal([]string{"nokey"}, report.WithoutKeys)
+	tassert.Len(report.Users, channelMembersPageSize+1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, appErr = p.GetChannelMembersReportWithin(ctx, "chan1")
+	tassert.Nil(appErr)
+	tassert.True(report.Incomplete)
+	tassert.Empty(report.Users)
+}
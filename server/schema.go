@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+const (
+	// SchemaVersionKey holds the version of the data stored by the plugin,
+	// which is the number of migrations that have been run.
+	SchemaVersionKey = "schemaVersion"
+	// SchemaMigrationLockKey prevents several servers of a cluster from
+	// running migrations at the same time.
+	SchemaMigrationLockKey = "schemaMigrationLock"
+	// SchemaMigrationProgressKey records how far the running migration went,
+	// so that it resumes from there if interrupted.
+	SchemaMigrationProgressKey = "schemaMigrationProgress"
+	schemaMigrationLockTTL     = time.Hour
+	migrationPageSize          = 100
+)
+
+// migration brings the stored data from a schema version to the next one.
+// It goes through a sorted snapshot of the KV keys taken when it starts, so
+// that keys it adds don't shift the ones left to migrate, batch by batch,
+// resuming after the last key it completed if it was interrupted. A batch may
+// thus be migrated several times, and code reading the data must handle both
+// versions while it runs.
+type migration struct {
+	Description string
+	// MigrateKeys migrates the data stored in keys, if relevant.
+	MigrateKeys func(p *Plugin, keys []string) *model.AppError
+}
+
+// migrations are run in order. The schema version is the number of
+// migrations that have been run, so they must only be appended.
+var migrations = []migration{
+	{
+		Description: "index public keys by key ID",
+		MigrateKeys: (*Plugin).indexPubKeys,
+	},
+	{
+		Description: "store public keys by device, in a versioned format",
+		MigrateKeys: (*Plugin).migratePubKeyRecords,
+	},
+}
+
+// CurrentSchemaVersion is the version of the data stored by this version of
+// the plugin.
+func CurrentSchemaVersion() int {
+	return len(migrations)
+}
+
+// migrationProgress is the last checkpoint of a running migration.
+type migrationProgress struct {
+	// Schema version the migration starts from
+	From int `json:"from"`
+	// Last KV key migrated
+	LastKey string `json:"lastKey"`
+}
+
+func (p *Plugin) GetSchemaVersion() (int, *model.AppError) {
+	data, appErr := p.API.KVGet(SchemaVersionKey)
+	if appErr != nil || data == nil {
+		return 0, appErr
+	}
+	var version int
+	err := json.Unmarshal(data, &version)
+	if err != nil {
+		return 0, model.NewAppError("GetSchemaVersion", "mm-e2ee.invalid_schema_version", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return version, nil
+}
+
+// RunMigrations brings the stored data to the current schema version. It
+// does nothing if another server of the cluster is running them.
+func (p *Plugin) RunMigrations() *model.AppError {
+	version, appErr := p.GetSchemaVersion()
+	if appErr != nil || version >= CurrentSchemaVersion() {
+		return appErr
+	}
+	lock, appErr := p.acquireJobLock(SchemaMigrationLockKey, schemaMigrationLockTTL)
+	if appErr != nil || lock == nil {
+		return appErr
+	}
+	defer func() {
+		if appErr := p.API.KVDelete(SchemaMigrationLockKey); appErr != nil {
+			p.API.LogError("unable to release the migration lock", "error", appErr.Error())
+		}
+	}()
+
+	// Another server may have run them since we checked
+	version, appErr = p.GetSchemaVersion()
+	if appErr != nil {
+		return appErr
+	}
+	for ; version < CurrentSchemaVersion(); version++ {
+		m := migrations[version]
+		p.API.LogInfo("migrating stored data", "from_version", version, "migration", m.Description)
+		appErr = p.runMigration(lock, version, &m)
+		if appErr != nil {
+			return appErr
+		}
+		data, _ := json.Marshal(version + 1)
+		appErr = p.API.KVSet(SchemaVersionKey, data)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	return p.API.KVDelete(SchemaMigrationProgressKey)
+}
+
+func (p *Plugin) runMigration(lock *jobLock, from int, m *migration) *model.AppError {
+	var progress migrationProgress
+	data, appErr := p.API.KVGet(SchemaMigrationProgressKey)
+	if appErr != nil {
+		return appErr
+	}
+	lastKey := ""
+	if data != nil && json.Unmarshal(data, &progress) == nil && progress.From == from {
+		lastKey = progress.LastKey
+	}
+
+	keys, appErr := p.listKeysAfter(lastKey)
+	if appErr != nil {
+		return appErr
+	}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > migrationPageSize {
+			batch = batch[:migrationPageSize]
+		}
+		keys = keys[len(batch):]
+		appErr = m.MigrateKeys(p, batch)
+		if appErr != nil {
+			return appErr
+		}
+		data, _ = json.Marshal(migrationProgress{From: from, LastKey: batch[len(batch)-1]})
+		appErr = p.API.KVSet(SchemaMigrationProgressKey, data)
+		if appErr != nil {
+			return appErr
+		}
+		locked, appErr := p.refreshJobLock(lock)
+		if appErr != nil {
+			return appErr
+		}
+		if !locked {
+			return model.NewAppError("runMigration", "mm-e2ee.migration_lock_lost", nil, "", http.StatusConflict)
+		}
+	}
+	return nil
+}
+
+// listKeysAfter returns the sorted KV keys greater than after.
+func (p *Plugin) listKeysAfter(after string) ([]string, *model.AppError) {
+	var keys []string
+	for page := 0; ; page++ {
+		pageKeys, appErr := p.API.KVList(page, migrationPageSize)
+		if appErr != nil {
+			return nil, appErr
+		}
+		for _, key := range pageKeys {
+			if key > after {
+				keys = append(keys, key)
+			}
+		}
+		if len(pageKeys) < migrationPageSize {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
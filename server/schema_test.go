@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_schema_migrations(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+	mockAPI.On("LogInfo", "migrating stored data", "from_version", mock.Anything, "migration", mock.Anything).Return()
+
+	// Keys stored before versioning
+	pubkeys := make(map[string]PubKey)
+	for i := 0; i < 2*migrationPageSize; i++ {
+		userID := fmt.Sprintf("user%03d", i)
+		pubkey := GenerateValidPubKey()
+		data, _ := json.Marshal(pubkey)
+		kv.data[StoreKeyPubKey(userID)] = data
+		pubkeys[userID] = pubkey
+	}
+
+	tassert.Nil(p.RunMigrations())
+	version, appErr := p.GetSchemaVersion()
+	tassert.Nil(appErr)
+	tassert.Equal(CurrentSchemaVersion(), version)
+	tassert.NotContains(kv.data, SchemaMigrationLockKey)
+	tassert.NotContains(kv.data, SchemaMigrationProgressKey)
+
+	for userID, pubkey := range pubkeys {
+		pubkey := pubkey
+		record, err := ParsePubKeyRecord(kv.data[StoreKeyPubKey(userID)])
+		tassert.Nil(err)
+		tassert.Equal(PubKeyRecordVersion, record.Version)
+		tassert.Equal(&pubkey, record.PubKey())
+		owners, appErr := p.GetPubKeyOwners(pubkey.ID())
+		tassert.Nil(appErr)
+		tassert.Equal([]string{userID}, owners.UserIDs)
+	}
+
+	// Nothing to do anymore
+	calls := len(mockAPI.Calls)
+	tassert.Nil(p.RunMigrations())
+	tassert.Len(mockAPI.Calls, calls+1)
+}
+
+func Test_schema_resume(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+	mockAPI.On("LogInfo", "migrating stored data", "from_version", mock.Anything, "migration", mock.Anything).Return()
+
+	pubkey := GenerateValidPubKey()
+	legacy, _ := json.Marshal(pubkey)
+	kv.data[StoreKeyPubKey("user1")] = legacy
+	kv.data[StoreKeyPubKey("user2")] = legacy
+	// The previous run stopped after user1's key in the second migration
+	kv.data[SchemaVersionKey] = []byte("1")
+	kv.data[SchemaMigrationProgressKey], _ = json.Marshal(migrationProgress{From: 1, LastKey: StoreKeyPubKey("user1")})
+
+	tassert.Nil(p.RunMigrations())
+	tassert.Equal([]byte("2"), kv.data[SchemaVersionKey])
+	tassert.Equal(legacy, kv.data[StoreKeyPubKey("user1")])
+	record, err := ParsePubKeyRecord(kv.data[StoreKeyPubKey("user2")])
+	tassert.Nil(err)
+	tassert.Equal(PubKeyRecordVersion, record.Version)
+
+	// Data of both versions is read
+	got, appErr := p.GetUserPubKey("user1")
+	tassert.Nil(appErr)
+	tassert.Equal(&pubkey, got)
+}
+
+func Test_schema_snapshot(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, _ := newTestNode(kv)
+
+	for i := 0; i < 3*migrationPageSize; i++ {
+		kv.data[fmt.Sprintf("key%03d", i)] = []byte("1")
+	}
+	lock, appErr := p.acquireJobLock(SchemaMigrationLockKey, schemaMigrationLockTTL)
+	tassert.Nil(appErr)
+	tassert.NotNil(lock)
+
+	// Keys added while migrating don't make it skip or repeat any
+	seen := make(map[string]int)
+	batches := 0
+	m := migration{MigrateKeys: func(p *Plugin, keys []string) *model.AppError {
+		batches++
+		for _, key := range keys {
+			if !strings.HasPrefix(key, "key") {
+				continue
+			}
+			seen[key]++
+			kv.data["added:"+key] = []byte("1")
+		}
+		return nil
+	}}
+	tassert.Nil(p.runMigration(lock, 0, &m))
+	tassert.Len(seen, 3*migrationPageSize)
+	for key, n := range seen {
+		tassert.Equal(1, n, key)
+	}
+
+	// It stops once another server took the lock over
+	batches = 0
+	kv.data[SchemaMigrationLockKey] = []byte("1")
+	tassert.NotNil(p.runMigration(lock, 1, &m))
+	tassert.Equal(1, batches)
+}
+
+func Test_schema_locked(t *testing.T) {
+	tassert := assert.New(t)
+	kv := newTestKVStore()
+	p, mockAPI := newTestNode(kv)
+	kv.data[SchemaMigrationLockKey] = []byte("1")
+
+	tassert.Nil(p.RunMigrations())
+	tassert.NotContains(kv.data, SchemaVersionKey)
+	mockAPI.AssertNotCalled(t, "KVList", mock.Anything, mock.Anything)
+	tassert.Contains(kv.data, SchemaMigrationLockKey)
+}
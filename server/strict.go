@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// MaxStrictRemovalsRecorded is the number of removals we keep per channel.
+const MaxStrictRemovalsRecorded = 100
+
+// StrictRemoval records that a user has been removed from a strict channel.
+type StrictRemoval struct {
+	UserID string `json:"userID"`
+	Reason string `json:"reason"`
+	At     int64  `json:"at"`
+}
+
+func StrictRemovalsKey(chanID string) string {
+	return fmt.Sprintf("strictRemovals:%s", chanID)
+}
+
+func (p *Plugin) GetStrictRemovals(chanID string) ([]StrictRemoval, *model.AppError) {
+	ret := make([]StrictRemoval, 0)
+	data, appErr := p.API.KVGet(StrictRemovalsKey(chanID))
+	if appErr != nil || data == nil {
+		return ret, appErr
+	}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return ret, model.NewAppError("GetStrictRemovals", "mm-e2ee.invalid_strict_removals", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+func (p *Plugin) recordStrictRemoval(chanID string, removal StrictRemoval) *model.AppError {
+	return p.kvAtomicUpdate(StrictRemovalsKey(chanID), func(old []byte) ([]byte, *model.AppError) {
+		removals := make([]StrictRemoval, 0)
+		if old != nil {
+			if err := json.Unmarshal(old, &removals); err != nil {
+				removals = removals[:0]
+			}
+		}
+		removals = append(removals, removal)
+		if len(removals) > MaxStrictRemovalsRecorded {
+			removals = removals[len(removals)-MaxStrictRemovalsRecorded:]
+		}
+		data, _ := json.Marshal(removals)
+		return data, nil
+	})
+}
+
+// EnforceStrictMembership removes userID from chanID if this channel is
+// encrypted and strict, and userID has no key. Bots are never removed, as
+// they can't have keys. It returns whether the user has been removed.
+func (p *Plugin) EnforceStrictMembership(chanID string, userID string, reason string) (bool, *model.AppError) {
+	if !p.ChanEncrMethods.get(chanID).IsEncrypted() {
+		return false, nil
+	}
+	settings, appErr := p.GetChanSettings(chanID)
+	if appErr != nil || !settings.Strict {
+		return false, appErr
+	}
+	hasKey, appErr := p.HasUserPubKey(userID)
+	if appErr != nil || hasKey {
+		return false, appErr
+	}
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil || user.IsBot {
+		return false, appErr
+	}
+	channel, appErr := p.API.GetChannel(chanID)
+	if appErr != nil || channel.IsGroupOrDirect() {
+		return false, appErr
+	}
+
+	appErr = p.API.DeleteChannelMember(chanID, userID)
+	if appErr != nil {
+		return false, appErr
+	}
+	p.API.LogInfo("removed member without key from strict channel", "channel_id", chanID, "user_id", userID, "reason", reason)
+	appErr = p.recordStrictRemoval(chanID, StrictRemoval{UserID: userID, Reason: reason, At: model.GetMillis()})
+	if appErr != nil {
+		return true, appErr
+	}
+	appErr = p.SendBotDM(userID, fmt.Sprintf("You have been removed from ~%s because it only accepts members with an encryption key (%s). Run `/e2ee init` to setup your key, then ask to join again.", channel.Name, reason))
+	return true, appErr
+}
+
+// EnforceStrictMembershipOfUser removes userID from all the strict channels
+// they are a member of, if they don't have a key anymore.
+func (p *Plugin) EnforceStrictMembershipOfUser(userID string) *model.AppError {
+	teams, appErr := p.API.GetTeamsForUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+	for _, team := range teams {
+		channels, appErr := p.API.GetChannelsForTeamForUser(team.Id, userID, false)
+		if appErr != nil {
+			return appErr
+		}
+		for _, channel := range channels {
+			if channel.IsGroupOrDirect() {
+				continue
+			}
+			_, appErr = p.EnforceStrictMembership(channel.Id, userID, "key revoked")
+			if appErr != nil {
+				return appErr
+			}
+		}
+	}
+	return nil
+}
+
+// SetChanStrict turns strict membership on or off for a channel. Turning it
+// on doesn't remove existing members without keys.
+func (p *Plugin) SetChanStrict(chanID string, userID string, strict bool) *model.AppError {
+	allowed, appErr := p.CanManageChanEncryption(chanID, userID)
+	if appErr != nil {
+		return appErr
+	}
+	if !allowed {
+		return model.NewAppError("SetChanStrict", "mm-e2ee.not_allowed", nil, "only channel and system admins can change strict membership", http.StatusForbidden)
+	}
+	channel, appErr := p.API.GetChannel(chanID)
+	if appErr != nil {
+		return appErr
+	}
+	if channel.IsGroupOrDirect() {
+		return model.NewAppError("SetChanStrict", "mm-e2ee.invalid_channel", nil, "strict membership can't be used in direct and group messages", http.StatusBadRequest)
+	}
+
+	changed, appErr := p.UpdateChanSettings(chanID, func(settings *ChanSettings) bool {
+		if settings.Strict == strict {
+			return false
+		}
+		settings.Strict = strict
+		return true
+	})
+	if appErr != nil || !changed {
+		return appErr
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+	var msg string
+	if strict {
+		msg = fmt.Sprintf("Strict membership has been turned **on** by @%s: while this channel is encrypted, people without an encryption key are removed when they join.", user.Username)
+	} else {
+		msg = fmt.Sprintf("Strict membership has been turned **off** by @%s.", user.Username)
+	}
+	_, appErr = p.API.CreatePost(&model.Post{
+		Message:   msg,
+		UserId:    p.BotUserID,
+		ChannelId: chanID,
+	})
+	return appErr
+}
+
+func (p *Plugin) GetChanSettingsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+
+	// Check user is in channel
+	_, appErr := p.API.GetChannelMember(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	settings, appErr := p.GetChanSettings(chanID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, settings)
+}
+
+func (p *Plugin) SetChanStrictHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+	strict, err := strconv.ParseBool(r.URL.Query().Get("strict"))
+	if err != nil {
+		http.Error(w, "invalid strict value", http.StatusBadRequest)
+		return
+	}
+
+	appErr := p.SetChanStrict(chanID, c.UserID, strict)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
+
+func (p *Plugin) GetStrictRemovalsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+
+	allowed, appErr := p.CanManageChanEncryption(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !allowed {
+		http.Error(w, "only channel and system admins can see removals", http.StatusForbidden)
+		return
+	}
+
+	removals, appErr := p.GetStrictRemovals(chanID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, removals)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func mockAPIStrictChannel(mockAPI *plugintest.API, chanID string) {
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	strict, _ := json.Marshal(ChanSettings{Strict: true})
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanSettingsKey(chanID)).Return(strict, nil)
+	mockAPI.On("GetChannel", chanID).Return(&model.Channel{Id: chanID, Name: "secret", Type: model.CHANNEL_PRIVATE}, nil)
+}
+
+func Test_strict_removeNoKey(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{BotUserID: "bot"}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	mockAPIStrictChannel(&mockAPI, chanID)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return(nil, nil)
+	mockAPI.On("GetUser", "user1").Return(&model.User{Id: "user1"}, nil)
+	mockAPI.On("DeleteChannelMember", chanID, "user1").Return(nil)
+	mockAPI.On("LogInfo", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	mockAPI.On("KVGet", StrictRemovalsKey(chanID)).Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", StrictRemovalsKey(chanID), mock.AnythingOfType("[]uint8"), mock.Anything).Return(true, nil)
+	mockAPI.On("GetDirectChannel", "bot", "user1").Return(&model.Channel{Id: "dm"}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	removed, appErr := p.EnforceStrictMembership(chanID, "user1", "no encryption key")
+	tassert.Nil(appErr)
+	tassert.True(removed)
+	mockAPI.AssertCalled(t, "DeleteChannelMember", chanID, "user1")
+}
+
+func Test_strict_keepWithKey(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	mockAPIStrictChannel(&mockAPI, chanID)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return([]byte("{}"), nil)
+
+	removed, appErr := p.EnforceStrictMembership(chanID, "user1", "no encryption key")
+	tassert.Nil(appErr)
+	tassert.False(removed)
+}
+
+func Test_strict_keepBots(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	mockAPIStrictChannel(&mockAPI, chanID)
+	mockAPI.On("KVGet", StoreKeyPubKey("bot1")).Return(nil, nil)
+	mockAPI.On("GetUser", "bot1").Return(&model.User{Id: "bot1", IsBot: true}, nil)
+
+	removed, appErr := p.EnforceStrictMembership(chanID, "bot1", "no encryption key")
+	tassert.Nil(appErr)
+	tassert.False(removed)
+	mockAPI.AssertNotCalled(t, "DeleteChannelMember", mock.Anything, mock.Anything)
+}
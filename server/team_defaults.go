@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// DefaultEncrScopeDirect is the scope of the default encryption method of
+// direct and group messages, which don't belong to any team. Other scopes are
+// team IDs.
+const DefaultEncrScopeDirect = "direct"
+
+func DefaultEncrMethodKey(scope string) string {
+	return fmt.Sprintf("defaultEncrMethod:%s", scope)
+}
+
+// GetDefaultEncrMethod returns the encryption method applied to new private
+// channels of a team, or to new direct and group messages if scope is
+// DefaultEncrScopeDirect.
+func (p *Plugin) GetDefaultEncrMethod(scope string) (ChanEncryptionMethod, *model.AppError) {
+	data, appErr := p.API.KVGet(DefaultEncrMethodKey(scope))
+	if appErr != nil {
+		return ChanEncryptionMethodNone, appErr
+	}
+	if data == nil {
+		return ChanEncryptionMethodNone, nil
+	}
+	var ret ChanEncryptionMethod
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return ChanEncryptionMethodNone, model.NewAppError("GetDefaultEncrMethod", "mm-e2ee.invalid_default_method", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+// CanManageDefaultEncrMethod returns whether userID can change the default
+// encryption method of scope. Team admins can change the one of their
+// team, and system admins can change all of them.
+func (p *Plugin) CanManageDefaultEncrMethod(scope string, userID string) bool {
+	if p.API.HasPermissionTo(userID, model.PERMISSION_MANAGE_SYSTEM) {
+		return true
+	}
+	if scope == DefaultEncrScopeDirect {
+		return false
+	}
+	return p.API.HasPermissionToTeam(userID, scope, model.PERMISSION_MANAGE_TEAM)
+}
+
+func (p *Plugin) SetDefaultEncrMethod(scope string, userID string, method ChanEncryptionMethod) *model.AppError {
+	if !p.CanManageDefaultEncrMethod(scope, userID) {
+		return model.NewAppError("SetDefaultEncrMethod", "mm-e2ee.not_allowed", nil, "only team and system admins can change the default encryption method", http.StatusForbidden)
+	}
+	if method == ChanEncryptionMethodNone {
+		return p.API.KVDelete(DefaultEncrMethodKey(scope))
+	}
+	data, _ := json.Marshal(method)
+	return p.API.KVSet(DefaultEncrMethodKey(scope), data)
+}
+
+// defaultEncrScope returns the scope of the default encryption method that
+// applies to a new channel, or an empty string if none does.
+func defaultEncrScope(channel *model.Channel) string {
+	switch channel.Type {
+	case model.CHANNEL_PRIVATE:
+		return channel.TeamId
+	case model.CHANNEL_DIRECT, model.CHANNEL_GROUP:
+		return DefaultEncrScopeDirect
+	default:
+		return ""
+	}
+}
+
+// ApplyDefaultEncrMethod sets the default encryption method that applies to
+// a new channel, if any.
+func (p *Plugin) ApplyDefaultEncrMethod(channel *model.Channel) *model.AppError {
+	scope := defaultEncrScope(channel)
+	if scope == "" {
+		return nil
+	}
+	method, appErr := p.GetDefaultEncrMethod(scope)
+	if appErr != nil || method == ChanEncryptionMethodNone {
+		return appErr
+	}
+	_, appErr = p.SetChanEncryptionMethodAndNotify(channel.Id, "", method)
+	return appErr
+}
+
+type DefaultEncrMethodResponse struct {
+	Scope  string `json:"scope"`
+	Method string `json:"method"`
+}
+
+func (p *Plugin) GetDefaultEncrMethodHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	if scope != DefaultEncrScopeDirect {
+		// Check user is in the team
+		_, appErr := p.API.GetTeamMember(scope, c.UserID)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	method, appErr := p.GetDefaultEncrMethod(scope)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, DefaultEncrMethodResponse{scope, ChanEncryptionMethodString(method)})
+}
+
+func (p *Plugin) SetDefaultEncrMethodHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	methodName := r.URL.Query().Get("method")
+	method := ChanEncryptionMethodFromString(methodName)
+	if ChanEncryptionMethodString(method) != methodName {
+		http.Error(w, "invalid encryption method", http.StatusBadRequest)
+		return
+	}
+	appErr := p.SetDefaultEncrMethod(scope, c.UserID, method)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
+
+func (p *Plugin) ExecuteDefaultEncrMethodCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	scope := args.TeamId
+	if len(cmdArgs) > 0 && cmdArgs[0] == "--direct" {
+		scope = DefaultEncrScopeDirect
+		cmdArgs = cmdArgs[1:]
+	}
+	scopeDesc := "new private channels of this team"
+	if scope == DefaultEncrScopeDirect {
+		scopeDesc = "new direct and group messages"
+	}
+
+	if len(cmdArgs) == 0 {
+		method, appErr := p.GetDefaultEncrMethod(scope)
+		if appErr != nil {
+			return appErr
+		}
+		p.postCommandResponse(args, fmt.Sprintf("The default encryption mode of %s is '%s'.", scopeDesc, ChanEncryptionMethodString(method)))
+		return nil
+	}
+
+	method := ChanEncryptionMethodFromString(cmdArgs[0])
+	if ChanEncryptionMethodString(method) != cmdArgs[0] {
+		return &model.AppError{Message: "usage: " + getSubcommand("default").Usage()}
+	}
+	appErr := p.SetDefaultEncrMethod(scope, args.UserId, method)
+	if appErr != nil {
+		return appErr
+	}
+	p.postCommandResponse(args, fmt.Sprintf("The default encryption mode of %s is now '%s'.", scopeDesc, ChanEncryptionMethodString(method)))
+	return nil
+}
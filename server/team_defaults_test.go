@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/quarkslab/mattermost-plugin-e2ee/server/testutils"
+)
+
+func Test_defaults_scope(t *testing.T) {
+	tassert := assert.New(t)
+	tassert.Equal("team1", defaultEncrScope(&model.Channel{Type: model.CHANNEL_PRIVATE, TeamId: "team1"}))
+	tassert.Equal("", defaultEncrScope(&model.Channel{Type: model.CHANNEL_OPEN, TeamId: "team1"}))
+	tassert.Equal(DefaultEncrScopeDirect, defaultEncrScope(&model.Channel{Type: model.CHANNEL_DIRECT}))
+	tassert.Equal(DefaultEncrScopeDirect, defaultEncrScope(&model.Channel{Type: model.CHANNEL_GROUP}))
+}
+
+func Test_defaults_channelCreated(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+
+	chanID := "chan1"
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	mockAPI.On("KVGet", DefaultEncrMethodKey("team1")).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(chanID), p2p, mock.Anything).Return(true, nil)
+	mockAPI.On("KVSet", ChanEncryptionChangeKey(chanID), mock.AnythingOfType("[]uint8")).Return(nil)
+	mockAPI.On("PublishWebSocketEvent", "channelStateChanged", mock.Anything, mock.Anything).Return()
+	mockAPI.On("GetUsersInChannel", chanID, model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	p.ChannelHasBeenCreated(nil, &model.Channel{Id: chanID, Type: model.CHANNEL_PRIVATE, TeamId: "team1"})
+	mockAPI.AssertCalled(t, "KVSetWithOptions", ChanEncryptionMethodKey(chanID), p2p, mock.Anything)
+}
+
+func Test_defaults_setNotAllowed(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+
+	mockAPI.On("HasPermissionTo", "user1", model.PERMISSION_MANAGE_SYSTEM).Return(false)
+	appErr := p.SetDefaultEncrMethod(DefaultEncrScopeDirect, "user1", ChanEncryptionMethodP2P)
+	assert.NotNil(t, appErr)
+}
+
+func Test_defaults_invalidMethod(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+
+	appErr := p.ExecuteDefaultEncrMethodCommand(&model.CommandArgs{UserId: "user1", TeamId: "team1"}, []string{"p2pp"})
+	assert.NotNil(t, appErr)
+	mockAPI.AssertNotCalled(t, "KVDelete", mock.Anything)
+
+	tests := []TestDesc{
+		{
+			name: "invalid",
+			request: testutils.Request{
+				Method: "POST",
+				URL:    "/api/v1/default/encryption_method?scope=team1&method=p2pp",
+			},
+			expectedResponse: testutils.ExpectedResponse{
+				StatusCode: http.StatusBadRequest,
+			},
+			userID: "user1",
+		},
+	}
+	RunTests(&tests, t, &mockAPI)
+}
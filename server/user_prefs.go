@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Values of the AutoEncryptDM configuration setting
+const (
+	// Follow the preferences of the users
+	AutoEncryptDMUser = "user"
+	// Always encrypt DMs between users who both have keys
+	AutoEncryptDMAlways = "always"
+	// Never automatically encrypt DMs
+	AutoEncryptDMNever = "never"
+)
+
+// UserPrefs holds the E2EE preferences of a user.
+type UserPrefs struct {
+	// AutoEncryptDM turns on encryption of the user's direct messages once
+	// both participants have a key.
+	AutoEncryptDM bool `json:"autoEncryptDM"`
+}
+
+func UserPrefsKey(userID string) string {
+	return fmt.Sprintf("userPrefs:%s", userID)
+}
+
+func (p *Plugin) GetUserPrefs(userID string) (*UserPrefs, *model.AppError) {
+	data, appErr := p.API.KVGet(UserPrefsKey(userID))
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &UserPrefs{}
+	if data == nil {
+		return ret, nil
+	}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, model.NewAppError("GetUserPrefs", "mm-e2ee.invalid_user_prefs", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return ret, nil
+}
+
+func (p *Plugin) SetUserPrefs(userID string, prefs *UserPrefs) *model.AppError {
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		return model.NewAppError("SetUserPrefs", "mm-e2ee.invalid_user_prefs", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return p.API.KVSet(UserPrefsKey(userID), data)
+}
+
+// wantsAutoEncryptDM returns whether a DM between userIDs must automatically
+// be encrypted, according to the plugin configuration and their preferences:
+// by default, all of them must have asked for it.
+func (p *Plugin) wantsAutoEncryptDM(userIDs []string) (bool, *model.AppError) {
+	switch p.getConfiguration().AutoEncryptDM {
+	case AutoEncryptDMAlways:
+		return true, nil
+	case AutoEncryptDMNever:
+		return false, nil
+	}
+	for _, userID := range userIDs {
+		prefs, appErr := p.GetUserPrefs(userID)
+		if appErr != nil {
+			return false, appErr
+		}
+		if !prefs.AutoEncryptDM {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// MaybeAutoEncryptDM turns on encryption on a direct channel if both its
+// participants asked for it and have a key. This is only done for
+// channels whose encryption method has never been set, so that we don't
+// override a choice made by the participants.
+func (p *Plugin) MaybeAutoEncryptDM(channel *model.Channel) *model.AppError {
+	if channel.Type != model.CHANNEL_DIRECT || p.getConfiguration().AutoEncryptDM == AutoEncryptDMNever {
+		return nil
+	}
+	userIDs := strings.Split(channel.Name, "__")
+	if len(userIDs) != 2 || userIDs[0] == userIDs[1] {
+		return nil
+	}
+
+	isSet, appErr := p.ChanEncrMethods.isSet(channel.Id)
+	if appErr != nil || isSet {
+		return appErr
+	}
+	for _, userID := range userIDs {
+		hasKey, appErr := p.HasUserPubKey(userID)
+		if appErr != nil || !hasKey {
+			return appErr
+		}
+	}
+	wants, appErr := p.wantsAutoEncryptDM(userIDs)
+	if appErr != nil || !wants {
+		return appErr
+	}
+	_, appErr = p.SetChanEncryptionMethodAndNotify(channel.Id, "", ChanEncryptionMethodP2P)
+	return appErr
+}
+
+// AutoEncryptDMsOfUser runs MaybeAutoEncryptDM on every direct channel of
+// userID.
+func (p *Plugin) AutoEncryptDMsOfUser(userID string) *model.AppError {
+	if p.getConfiguration().AutoEncryptDM == AutoEncryptDMNever {
+		return nil
+	}
+	// An empty team ID only gives us direct and group channels
+	channels, appErr := p.API.GetChannelsForTeamForUser("", userID, false)
+	if appErr != nil {
+		return appErr
+	}
+	for _, channel := range channels {
+		appErr = p.MaybeAutoEncryptDM(channel)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) GetUserPrefsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	prefs, appErr := p.GetUserPrefs(c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, prefs)
+}
+
+func (p *Plugin) SetUserPrefsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	var prefs UserPrefs
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appErr := p.SetUserPrefs(c.UserID, &prefs)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	if prefs.AutoEncryptDM {
+		appErr = p.AutoEncryptDMsOfUser(c.UserID)
+		if appErr != nil {
+			http.Error(w, appErr.Error(), appErr.StatusCode)
+		}
+	}
+}
+
+func (p *Plugin) ExecutePrefsCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	prefs, appErr := p.GetUserPrefs(args.UserId)
+	if appErr != nil {
+		return appErr
+	}
+
+	if len(cmdArgs) == 0 {
+		msg := fmt.Sprintf("Your E2EE preferences:\n* auto_encrypt_dm: %t", prefs.AutoEncryptDM)
+		switch p.getConfiguration().AutoEncryptDM {
+		case AutoEncryptDMAlways:
+			msg += " (overridden by your administrator: direct messages are always encrypted)"
+		case AutoEncryptDMNever:
+			msg += " (overridden by your administrator: direct messages are never automatically encrypted)"
+		}
+		p.postCommandResponse(args, msg)
+		return nil
+	}
+
+	if len(cmdArgs) != 2 || cmdArgs[0] != "auto_encrypt_dm" {
+		return &model.AppError{Message: "usage: /e2ee prefs [auto_encrypt_dm on|off]"}
+	}
+	value, err := parseOnOff(cmdArgs[1])
+	if err != nil {
+		return &model.AppError{Message: err.Error()}
+	}
+	prefs.AutoEncryptDM = value
+	appErr = p.SetUserPrefs(args.UserId, prefs)
+	if appErr != nil {
+		return appErr
+	}
+	if value {
+		appErr = p.AutoEncryptDMsOfUser(args.UserId)
+		if appErr != nil {
+			return appErr
+		}
+	}
+	p.postCommandResponse(args, fmt.Sprintf("auto_encrypt_dm is now %t.", value))
+	return nil
+}
+
+func parseOnOff(v string) (bool, error) {
+	switch v {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	ret, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value '%s', expected on or off", v)
+	}
+	return ret, nil
+}
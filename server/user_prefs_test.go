@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func mockAPIDMUsers(mockAPI *plugintest.API, user1Prefs UserPrefs, user2Prefs UserPrefs, user2HasKey bool) {
+	user1PrefsJSON, _ := json.Marshal(user1Prefs)
+	user2PrefsJSON, _ := json.Marshal(user2Prefs)
+	mockAPI.On("KVGet", UserPrefsKey("user1")).Return(user1PrefsJSON, nil)
+	mockAPI.On("KVGet", UserPrefsKey("user2")).Return(user2PrefsJSON, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("user1")).Return([]byte("{}"), nil)
+	if user2HasKey {
+		mockAPI.On("KVGet", StoreKeyPubKey("user2")).Return([]byte("{}"), nil)
+	} else {
+		mockAPI.On("KVGet", StoreKeyPubKey("user2")).Return(nil, nil)
+	}
+}
+
+func Test_prefs_autoEncryptDM(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	channel := &model.Channel{Id: "dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "user2")}
+	mockAPIDMUsers(&mockAPI, UserPrefs{AutoEncryptDM: true}, UserPrefs{AutoEncryptDM: true}, true)
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(channel.Id)).Return(nil, nil)
+	mockAPI.On("KVSetWithOptions", ChanEncryptionMethodKey(channel.Id), p2p, mock.Anything).Return(true, nil)
+	mockAPI.On("KVSet", ChanEncryptionChangeKey(channel.Id), mock.AnythingOfType("[]uint8")).Return(nil)
+	mockAPI.On("PublishWebSocketEvent", "channelStateChanged", mock.Anything, mock.Anything).Return()
+	mockAPI.On("GetUsersInChannel", channel.Id, model.CHANNEL_SORT_BY_USERNAME, 0, channelMembersPageSize).Return([]*model.User{}, nil)
+	mockAPI.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(&model.Post{}, nil)
+
+	tassert.Nil(p.MaybeAutoEncryptDM(channel))
+	mockAPI.AssertCalled(t, "KVSetWithOptions", ChanEncryptionMethodKey(channel.Id), p2p, mock.Anything)
+}
+
+func Test_prefs_autoEncryptDMMissingKey(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	channel := &model.Channel{Id: "dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "user2")}
+	mockAPIDMUsers(&mockAPI, UserPrefs{AutoEncryptDM: true}, UserPrefs{AutoEncryptDM: true}, false)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(channel.Id)).Return(nil, nil)
+
+	tassert.Nil(p.MaybeAutoEncryptDM(channel))
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_prefs_autoEncryptDMOneSided(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	channel := &model.Channel{Id: "dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "user2")}
+	mockAPIDMUsers(&mockAPI, UserPrefs{AutoEncryptDM: true}, UserPrefs{}, true)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(channel.Id)).Return(nil, nil)
+
+	tassert.Nil(p.MaybeAutoEncryptDM(channel))
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_prefs_autoEncryptDMAlreadySet(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	channel := &model.Channel{Id: "dm", Type: model.CHANNEL_DIRECT, Name: model.GetDMNameFromIds("user1", "user2")}
+	none, _ := json.Marshal(ChanEncryptionMethodNone)
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(channel.Id)).Return(none, nil)
+
+	tassert.Nil(p.MaybeAutoEncryptDM(channel))
+	mockAPI.AssertNotCalled(t, "KVSetWithOptions", mock.Anything, mock.Anything, mock.Anything)
+}
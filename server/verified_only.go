@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// encryptedPostKeys is the part of the e2ee property of encrypted posts that
+// lists the keys a message is encrypted for.
+type encryptedPostKeys struct {
+	// Pairs of base64 encoded (key ID, wrapped message key)
+	EncryptedKey [][]string `json:"encryptedKey"`
+}
+
+// recipientKeyIDs returns the base64 encoded IDs of the keys an encrypted
+// post is encrypted for.
+func recipientKeyIDs(post *model.Post) ([]string, error) {
+	data, err := json.Marshal(post.GetProp("e2ee"))
+	if err != nil {
+		return nil, err
+	}
+	var keys encryptedPostKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(keys.EncryptedKey))
+	for _, pair := range keys.EncryptedKey {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid encrypted key")
+		}
+		ret = append(ret, pair[0])
+	}
+	return ret, nil
+}
+
+// trustedAttester is a user whose attestations are trusted, along with their
+// current key.
+type trustedAttester struct {
+	attestations KeyAttestations
+	key          *PubKey
+}
+
+// keyOwnerInChannel returns the member of chanID whose current key is keyID,
+// or nil if there is none. Only the owners of keyID are looked up, through
+// the key ID index.
+func (p *Plugin) keyOwnerInChannel(chanID string, keyID string) (*model.ChannelMember, *model.AppError) {
+	rawKeyID, err := ParseKeyID(keyID)
+	if err != nil {
+		return nil, nil
+	}
+	owners, appErr := p.GetPubKeyOwners(rawKeyID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	for _, userID := range owners.UserIDs {
+		pubkey, err := p.GetUserPubKey(userID)
+		if err != nil {
+			return nil, model.NewAppError("keyOwnerInChannel", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+		}
+		if pubkey == nil || !bytes.Equal(pubkey.ID(), rawKeyID) {
+			continue
+		}
+		member, appErr := p.API.GetChannelMember(chanID, userID)
+		if appErr != nil {
+			continue
+		}
+		return member, nil
+	}
+	return nil, nil
+}
+
+// trustedAttesterOf returns userID as a trusted attester, or nil if they have
+// no key.
+func (p *Plugin) trustedAttesterOf(userID string) (*trustedAttester, *model.AppError) {
+	pubkey, err := p.GetUserPubKey(userID)
+	if err != nil {
+		return nil, model.NewAppError("trustedAttesterOf", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if pubkey == nil {
+		return nil, nil
+	}
+	attestations, appErr := p.GetKeyAttestations(userID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return &trustedAttester{attestations, pubkey}, nil
+}
+
+// UnverifiedRecipients returns the usernames of the recipients of an
+// encrypted post whose key hasn't been attested by the sender or by a channel
+// admin among the recipients. Keys that don't belong to any member of the
+// channel are reported as their key ID.
+func (p *Plugin) UnverifiedRecipients(post *model.Post) ([]string, *model.AppError) {
+	keyIDs, err := recipientKeyIDs(post)
+	if err != nil {
+		return nil, model.NewAppError("UnverifiedRecipients", "mm-e2ee.invalid_post", nil, err.Error(), http.StatusBadRequest)
+	}
+
+	// Attestations of the sender and of the channel admins are trusted
+	trusted := make([]*trustedAttester, 0)
+	sender, appErr := p.trustedAttesterOf(post.UserId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if sender != nil {
+		trusted = append(trusted, sender)
+	}
+	owners := make(map[string]string)
+	for _, keyID := range keyIDs {
+		if _, seen := owners[keyID]; seen {
+			continue
+		}
+		member, appErr := p.keyOwnerInChannel(post.ChannelId, keyID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if member == nil {
+			continue
+		}
+		owners[keyID] = member.UserId
+		if member.SchemeAdmin && member.UserId != post.UserId {
+			admin, appErr := p.trustedAttesterOf(member.UserId)
+			if appErr != nil {
+				return nil, appErr
+			}
+			trusted = append(trusted, admin)
+		}
+	}
+
+	ret := make([]string, 0)
+	for _, keyID := range keyIDs {
+		ownerID, has := owners[keyID]
+		if !has {
+			ret = append(ret, fmt.Sprintf("unknown key %s", keyID))
+			continue
+		}
+		if ownerID == post.UserId {
+			continue
+		}
+		verified := false
+		for _, attester := range trusted {
+			if attester.attestations.Attests(ownerID, keyID, attester.key) {
+				verified = true
+				break
+			}
+		}
+		if verified {
+			continue
+		}
+		user, appErr := p.API.GetUser(ownerID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		ret = append(ret, "@"+user.Username)
+	}
+	return ret, nil
+}
+
+// CheckVerifiedOnly returns why post must be rejected if its channel only
+// accepts verified keys, or an empty string.
+func (p *Plugin) CheckVerifiedOnly(post *model.Post) (string, *model.AppError) {
+	settings, appErr := p.GetChanSettings(post.ChannelId)
+	if appErr != nil || !settings.VerifiedOnly {
+		return "", appErr
+	}
+	unverified, appErr := p.UnverifiedRecipients(post)
+	if appErr != nil {
+		return "", appErr
+	}
+	if len(unverified) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("This channel only accepts messages encrypted for verified keys, and these keys haven't been verified by you or a channel admin: %s. Check their fingerprints and verify them before sending your message.",
+		strings.Join(unverified, ", ")), nil
+}
+
+// SetChanVerifiedOnly turns the verified keys only policy on or off for a
+// channel.
+func (p *Plugin) SetChanVerifiedOnly(chanID string, userID string, verifiedOnly bool) *model.AppError {
+	allowed, appErr := p.CanManageChanEncryption(chanID, userID)
+	if appErr != nil {
+		return appErr
+	}
+	if !allowed {
+		return model.NewAppError("SetChanVerifiedOnly", "mm-e2ee.not_allowed", nil, "only channel and system admins can change the verified keys policy", http.StatusForbidden)
+	}
+
+	changed, appErr := p.UpdateChanSettings(chanID, func(settings *ChanSettings) bool {
+		if settings.VerifiedOnly == verifiedOnly {
+			return false
+		}
+		settings.VerifiedOnly = verifiedOnly
+		return true
+	})
+	if appErr != nil || !changed {
+		return appErr
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+	var msg string
+	if verifiedOnly {
+		msg = fmt.Sprintf("@%s has restricted this channel to **verified keys**: encrypted messages are rejected if the key of a recipient hasn't been verified by the sender or a channel admin.", user.Username)
+	} else {
+		msg = fmt.Sprintf("@%s has allowed unverified keys in this channel.", user.Username)
+	}
+	_, appErr = p.API.CreatePost(&model.Post{
+		Message:   msg,
+		UserId:    p.BotUserID,
+		ChannelId: chanID,
+	})
+	return appErr
+}
+
+func (p *Plugin) SetChanVerifiedOnlyHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	chanID := r.URL.Query().Get("chanID")
+	verifiedOnly, err := strconv.ParseBool(r.URL.Query().Get("verifiedOnly"))
+	if err != nil {
+		http.Error(w, "invalid verifiedOnly value", http.StatusBadRequest)
+		return
+	}
+
+	appErr := p.SetChanVerifiedOnly(chanID, c.UserID, verifiedOnly)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+	}
+}
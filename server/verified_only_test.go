@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_verifiedOnly_rejectUnverified(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	chanID := "chan1"
+	p2p, _ := json.Marshal(ChanEncryptionMethodP2P)
+	settings, _ := json.Marshal(ChanSettings{VerifiedOnly: true})
+	mockAPI.On("KVGet", ChanEncryptionMethodKey(chanID)).Return(p2p, nil)
+	mockAPI.On("KVGet", ChanSettingsKey(chanID)).Return(settings, nil)
+
+	members := map[string]*model.ChannelMember{
+		"sender":   {UserId: "sender"},
+		"admin":    {UserId: "admin", SchemeAdmin: true},
+		"user1":    {UserId: "user1"},
+		"user2":    {UserId: "user2"},
+		"outsider": nil,
+	}
+	keys := make(map[string]string)
+	privs := make(map[string]*ecdsa.PrivateKey)
+	for userID, member := range members {
+		pubkey, priv := GenerateSigningPubKey()
+		data, _ := json.Marshal(pubkey)
+		owners, _ := json.Marshal(PubKeyOwners{UserIDs: []string{userID}})
+		mockAPI.On("KVGet", StoreKeyPubKey(userID)).Return(data, nil)
+		mockAPI.On("KVGet", StoreKeyPubKeyOwners(pubkey.ID())).Return(owners, nil)
+		if member != nil {
+			mockAPI.On("GetChannelMember", chanID, userID).Return(member, nil)
+		} else {
+			mockAPI.On("GetChannelMember", chanID, userID).Return(nil, &model.AppError{StatusCode: http.StatusNotFound})
+		}
+		keys[userID] = KeyIDString(pubkey.ID())
+		privs[userID] = priv
+	}
+	mockAPI.On("GetUser", "user2").Return(&model.User{Id: "user2", Username: "user2"}, nil)
+	attest := func(attesterID string, targetUserID string) *KeyAttestation {
+		return &KeyAttestation{
+			AttesterID:    attesterID,
+			AttesterKeyID: keys[attesterID],
+			TargetUserID:  targetUserID,
+			KeyID:         keys[targetUserID],
+			Signature:     signAttestation(privs[attesterID], targetUserID, keys[targetUserID]),
+		}
+	}
+
+	// The sender verified the admin's key, and the admin verified user1's key.
+	// The admin also verified user2's key with a previous key.
+	_, oldPriv := GenerateSigningPubKey()
+	user2Att := attest("admin", "user2")
+	user2Att.Signature = signAttestation(oldPriv, "user2", keys["user2"])
+	senderAtts, _ := json.Marshal(KeyAttestations{"admin": attest("sender", "admin")})
+	adminAtts, _ := json.Marshal(KeyAttestations{"user1": attest("admin", "user1"), "user2": user2Att})
+	mockAPI.On("KVGet", StoreKeyAttestations("sender")).Return(senderAtts, nil)
+	mockAPI.On("KVGet", StoreKeyAttestations("admin")).Return(adminAtts, nil)
+
+	encryptedPost := func(userIDs ...string) *model.Post {
+		encryptedKey := make([]interface{}, 0)
+		for _, userID := range userIDs {
+			encryptedKey = append(encryptedKey, []interface{}{keys[userID], "d3JhcHBlZA=="})
+		}
+		post := &model.Post{UserId: "sender", ChannelId: chanID, Type: "custom_e2ee"}
+		post.AddProp("e2ee", map[string]interface{}{"encryptedKey": encryptedKey})
+		return post
+	}
+
+	_, reason := p.MessageWillBePosted(nil, encryptedPost("sender", "admin", "user1"))
+	tassert.Equal("", reason)
+
+	_, reason = p.MessageWillBePosted(nil, encryptedPost("sender", "admin", "user1", "user2"))
+	tassert.Contains(reason, "@user2")
+
+	_, reason = p.MessageWillBePosted(nil, encryptedPost("sender", "admin", "user1", "outsider"))
+	tassert.Contains(reason, "unknown key "+keys["outsider"])
+	mockAPI.AssertNotCalled(t, "GetChannelMembers", chanID, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+)
+
+// Key status of a channel member
+const (
+	KeyStatusOK = "key"
+	// The member never setup a key
+	KeyStatusNone = "none"
+	// The member revoked their key and didn't setup a new one
+	KeyStatusRevoked = "revoked"
+	// The key of the member expired, according to the key expiry policy
+	KeyStatusExpired = "expired"
+)
+
+const (
+	// Number of members listed per page by /e2ee who
+	whoCommandPageSize = 20
+	// Maximum number of members returned per page by /channel/who
+	maxWhoPageSize = 200
+)
+
+// MemberKeyInfo tells whether a channel member can read encrypted messages.
+type MemberKeyInfo struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	// Fingerprint of the key of the member, if any
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// Number of devices the member registered a key for
+	Devices int `json:"devices"`
+	// When the member last setup a key, 0 if unknown
+	RotatedAt int64 `json:"rotatedAt,omitempty"`
+}
+
+// ChanWhoPage is a page of the key status of the members of a channel.
+// Deactivated members are left out of Members, so a page can have less than
+// PerPage of them even if more are available.
+type ChanWhoPage struct {
+	ChanID  string `json:"chanID"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"perPage"`
+	// Number of members of the channel, according to the server statistics
+	Total   int64            `json:"total"`
+	HasMore bool             `json:"hasMore"`
+	Members []*MemberKeyInfo `json:"members"`
+}
+
+func (p *Plugin) getMemberKeyInfo(user *model.User) (*MemberKeyInfo, *model.AppError) {
+	ret := &MemberKeyInfo{UserID: user.Id, Username: user.Username}
+	record, err := p.GetUserPubKeyRecord(user.Id)
+	if err != nil {
+		return nil, model.NewAppError("getMemberKeyInfo", "mm-e2ee.invalid_pubkey", nil, err.Error(), http.StatusInternalServerError)
+	}
+	var pubkey *PubKey
+	if record != nil {
+		pubkey = record.PubKey()
+	}
+	if pubkey == nil {
+		revoked, appErr := p.API.KVGet(StoreKeyPubKeyRevoked(user.Id))
+		if appErr != nil {
+			return nil, appErr
+		}
+		ret.Status = KeyStatusNone
+		if revoked != nil {
+			ret.Status = KeyStatusRevoked
+		}
+		return ret, nil
+	}
+
+	ret.Status = KeyStatusOK
+	ret.Fingerprint = NewFingerprint(user.Id, pubkey.ID())
+	ret.Devices = len(record.Devices)
+	meta, appErr := p.GetPubKeyMetadata(user.Id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if meta != nil {
+		ret.RotatedAt = meta.CreateAt
+	}
+	expired, appErr := p.IsUserPubKeyExpired(user.Id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if expired {
+		ret.Status = KeyStatusExpired
+	}
+	return ret, nil
+}
+
+// GetChanWho returns the key status of the members of chanID, perPage members
+// at a time. Deactivated users are skipped.
+func (p *Plugin) GetChanWho(chanID string, page int, perPage int) (*ChanWhoPage, *model.AppError) {
+	stats, appErr := p.API.GetChannelStats(chanID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	members, appErr := p.API.GetChannelMembers(chanID, page, perPage)
+	if appErr != nil {
+		return nil, appErr
+	}
+	ret := &ChanWhoPage{
+		ChanID:  chanID,
+		Page:    page,
+		PerPage: perPage,
+		Total:   stats.MemberCount,
+		HasMore: len(*members) == perPage,
+		Members: make([]*MemberKeyInfo, 0, len(*members)),
+	}
+	for _, member := range *members {
+		user, appErr := p.API.GetUser(member.UserId)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if user.DeleteAt != 0 {
+			continue
+		}
+		info, appErr := p.getMemberKeyInfo(user)
+		if appErr != nil {
+			return nil, appErr
+		}
+		ret.Members = append(ret.Members, info)
+	}
+	return ret, nil
+}
+
+func formatDate(millis int64) string {
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("January 2, 2006")
+}
+
+func (w *ChanWhoPage) String() string {
+	var sb strings.Builder
+	sb.WriteString("| Member | Key | Fingerprint | Devices | Last rotated |\n")
+	sb.WriteString("|---|---|---|---|---|\n")
+	for _, member := range w.Members {
+		fingerprint := ""
+		if member.Fingerprint != nil {
+			fingerprint = strings.Join(member.Fingerprint.Words, " ")
+		}
+		rotatedAt := ""
+		if member.RotatedAt != 0 {
+			rotatedAt = formatDate(member.RotatedAt)
+		}
+		fmt.Fprintf(&sb, "| @%s | %s | %s | %d | %s |\n", member.Username, member.Status, fingerprint, member.Devices, rotatedAt)
+	}
+	fmt.Fprintf(&sb, "\nPage %d: %d members shown, out of %d.", w.Page+1, len(w.Members), w.Total)
+	if w.HasMore {
+		fmt.Fprintf(&sb, " Run `/e2ee who %d` to see the next page.", w.Page+2)
+	}
+	return sb.String()
+}
+
+func (p *Plugin) ExecuteWhoCommand(args *model.CommandArgs, cmdArgs []string) *model.AppError {
+	page := 0
+	if len(cmdArgs) == 1 {
+		n, err := strconv.Atoi(cmdArgs[0])
+		if err != nil || n < 1 {
+			return &model.AppError{Message: "usage: /e2ee who [page]"}
+		}
+		page = n - 1
+	}
+	who, appErr := p.GetChanWho(args.ChannelId, page, whoCommandPageSize)
+	if appErr != nil {
+		return appErr
+	}
+	p.postCommandResponse(args, who.String())
+	return nil
+}
+
+func (p *Plugin) GetChanWhoHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chanID := query.Get("chanID")
+
+	// Check user is in channel
+	_, appErr := p.API.GetChannelMember(chanID, c.UserID)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+	perPage, err := strconv.Atoi(query.Get("perPage"))
+	if err != nil || perPage <= 0 || perPage > maxWhoPageSize {
+		perPage = maxWhoPageSize
+	}
+	who, appErr := p.GetChanWho(chanID, page, perPage)
+	if appErr != nil {
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	if appErr := p.checkAllPubKeyLookupsRate(c.UserID, len(who.Members)); appErr != nil {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, appErr.Error(), appErr.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p.WriteJSON(w, who)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v5/model"
+	"github.com/mattermost/mattermost-server/v5/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_who_page(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	p.setConfiguration(&configuration{MaxKeyAgeDays: 10, KeyExpiryGraceDays: 5})
+	tassert := assert.New(t)
+
+	now := model.GetMillis()
+	day := int64(24 * 3600 * 1000)
+	key := GenerateValidPubKey()
+	keyJSON, _ := json.Marshal(key)
+	// ok registered a second device
+	record := NewPubKeyRecord(&key)
+	record.Devices["phone"] = record.Devices[DefaultDeviceID]
+	recordJSON, _ := json.Marshal(record)
+	fresh, _ := json.Marshal(PubKeyMetadata{CreateAt: now - day})
+	old, _ := json.Marshal(PubKeyMetadata{CreateAt: now - 20*day})
+	revoked, _ := json.Marshal(PubKeyRevocation{RevokeAt: now})
+
+	mockAPI.On("GetChannelStats", "chan1").Return(&model.ChannelStats{ChannelId: "chan1", MemberCount: 5}, nil)
+	mockAPI.On("GetChannelMembers", "chan1", 0, 4).Return(&model.ChannelMembers{
+		{UserId: "ok"}, {UserId: "expired"}, {UserId: "revoked"}, {UserId: "deleted"},
+	}, nil)
+	mockAPI.On("GetChannelMembers", "chan1", 1, 4).Return(&model.ChannelMembers{{UserId: "none"}}, nil)
+	for _, userID := range []string{"ok", "expired", "revoked", "none"} {
+		mockAPI.On("GetUser", userID).Return(&model.User{Id: userID, Username: userID}, nil)
+	}
+	mockAPI.On("GetUser", "deleted").Return(&model.User{Id: "deleted", DeleteAt: 1}, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("ok")).Return(recordJSON, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("expired")).Return(keyJSON, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("revoked")).Return(nil, nil)
+	mockAPI.On("KVGet", StoreKeyPubKey("none")).Return(nil, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyMeta("ok")).Return(fresh, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyMeta("expired")).Return(old, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyRevoked("revoked")).Return(revoked, nil)
+	mockAPI.On("KVGet", StoreKeyPubKeyRevoked("none")).Return(nil, nil)
+
+	who, appErr := p.GetChanWho("chan1", 0, 4)
+	tassert.Nil(appErr)
+	tassert.True(who.HasMore)
+	tassert.Equal(int64(5), who.Total)
+	tassert.Len(who.Members, 3)
+	tassert.Equal(&MemberKeyInfo{
+		UserID:      "ok",
+		Username:    "ok",
+		Status:      KeyStatusOK,
+		Fingerprint: NewFingerprint("ok", key.ID()),
+		Devices:     2,
+		RotatedAt:   now - day,
+	}, who.Members[0])
+	tassert.Equal(KeyStatusExpired, who.Members[1].Status)
+	tassert.Equal(&MemberKeyInfo{UserID: "revoked", Username: "revoked", Status: KeyStatusRevoked}, who.Members[2])
+
+	msg := who.String()
+	tassert.Contains(msg, "| @revoked | revoked |  | 0 |  |\n")
+	tassert.Contains(msg, "| 1 | ")
+	tassert.True(strings.HasSuffix(msg, "Page 1: 3 members shown, out of 5. Run `/e2ee who 2` to see the next page."))
+
+	who, appErr = p.GetChanWho("chan1", 1, 4)
+	tassert.Nil(appErr)
+	tassert.False(who.HasMore)
+	tassert.Equal([]*MemberKeyInfo{{UserID: "none", Username: "none", Status: KeyStatusNone}}, who.Members)
+}
+
+func Test_who_command(t *testing.T) {
+	mockAPI := plugintest.API{}
+	p := Plugin{}
+	p.SetAPI(&mockAPI)
+	p.InitializeAPI()
+	tassert := assert.New(t)
+
+	mockAPI.On("GetChannelMember", "chan1", "user1").Return(&model.ChannelMember{}, nil)
+	mockAPI.On("GetChannelStats", "chan1").Return(&model.ChannelStats{ChannelId: "chan1", MemberCount: 1}, nil)
+	mockAPI.On("GetChannelMembers", "chan1", 2, whoCommandPageSize).Return(&model.ChannelMembers{}, nil)
+	mockAPI.On("SendEphemeralPost", "user1", mock.AnythingOfType("*model.Post")).Return(nil)
+
+	run := func(command string) *model.AppError {
+		_, appErr := p.ExecuteCommand(nil, &model.CommandArgs{Command: command, ChannelId: "chan1", UserId: "user1"})
+		return appErr
+	}
+	tassert.Nil(run("/e2ee who 3"))
+	mockAPI.AssertCalled(t, "GetChannelMembers", "chan1", 2, whoCommandPageSize)
+	tassert.Equal("usage: /e2ee who [page]", run("/e2ee who 0").Message)
+}
@@ -7,6 +7,7 @@ import {GlobalState} from 'mattermost-redux/types/store';
 import {getCurrentChannelId} from 'mattermost-redux/selectors/entities/common';
 
 import {KEYLOCK_OPEN, KEYLOCK_CLOSED} from 'svgs';
+import {E2EE_CHAN_ENCR_METHOD_NONE, E2EE_CHAN_ENCR_METHOD_P2P, E2EE_CHAN_ENCR_METHOD_MONITOR} from '../constants';
 import {getChannelEncryptionMethod} from 'actions';
 import {getPluginState} from 'selectors';
 
@@ -30,19 +31,25 @@ export type IconComponentProps = ReturnType<typeof mapStateToProps> &
 ReturnType<typeof mapDispatchToProps>;
 
 const IconComponent: React.FC<IconComponentProps> = (props) => {
-    const [isEncrypted, setIsEncrypted] = useState(false);
+    const [method, setMethod] = useState(E2EE_CHAN_ENCR_METHOD_NONE);
 
     const {chanID, chansEncrMethod, actions} = props;
     useEffect(() => {
         actions.getChannelEncryptionMethod(chanID).then((meth) => {
-            setIsEncrypted(meth.data !== 'none');
+            setMethod(meth.data);
         });
     }, [chanID, actions, chansEncrMethod]);
     const style = getStyle();
+
+    // Messages are only encrypted in p2p mode. In monitor mode, they are sent
+    // in clear form, so the lock stays open.
+    const isEncrypted = method === E2EE_CHAN_ENCR_METHOD_P2P;
+    const isMonitored = method === E2EE_CHAN_ENCR_METHOD_MONITOR;
     return (
         <span
-            style={style.iconStyle}
+            style={isMonitored ? style.monitorIconStyle : style.iconStyle}
             className='icon'
+            title={isMonitored ? 'Monitor mode: messages are not encrypted' : undefined}
             aria-hidden='true'
             dangerouslySetInnerHTML={{__html: isEncrypted ? KEYLOCK_CLOSED : KEYLOCK_OPEN}}
         />
@@ -53,6 +60,9 @@ function getStyle(): { [key: string]: React.CSSProperties } {
     return {
         iconStyle: {
         },
+        monitorIconStyle: {
+            color: 'var(--away-indicator)',
+        },
     };
 }
 
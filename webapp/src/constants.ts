@@ -11,5 +11,6 @@ const StateID = `plugins-${pluginId}`;
 
 const E2EE_CHAN_ENCR_METHOD_NONE = 'none';
 const E2EE_CHAN_ENCR_METHOD_P2P = 'p2p';
+const E2EE_CHAN_ENCR_METHOD_MONITOR = 'monitor';
 
-export {E2EE_POST_TYPE, E2EE_CHAN_ENCR_METHOD_NONE, E2EE_CHAN_ENCR_METHOD_P2P, StateID};
+export {E2EE_POST_TYPE, E2EE_CHAN_ENCR_METHOD_NONE, E2EE_CHAN_ENCR_METHOD_P2P, E2EE_CHAN_ENCR_METHOD_MONITOR, StateID};
@@ -280,7 +280,7 @@ export default class E2EEHooks {
         }
 
         this.setLastEncryptionMethodForChannel(chanID, method);
-        if (method === 'p2p') {
+        if (method === E2EE_CHAN_ENCR_METHOD_P2P) {
             const {data: users, error: errUsers} = await this.getUserIdsInChannel(chanID);
             if (errUsers) {
                 return {error: {message: 'Unable to get the list of users in this channel: ' + errUsers}};